@@ -0,0 +1,626 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const defaultTimezone = "Asia/Kolkata"
+
+// Slot generation settings
+var (
+	slotInterval        = 30 * time.Minute
+	defaultSlotDuration = 50
+	maxSlotRange        = 31 * 24 * time.Hour
+)
+
+// activeSessionStatuses are the statuses that occupy a counsellor's time.
+var activeSessionStatuses = []string{SessionPendingPayment, SessionPending, SessionConfirmed, SessionInProgress}
+
+// AvailabilityRule is one block of recurring weekly working hours, expressed
+// as wall-clock times in the counsellor's timezone.
+type AvailabilityRule struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	CounsellorID uint      `json:"counsellor_id" gorm:"index;not null"`
+	Weekday      int       `json:"weekday"`    // 0 = Sunday
+	StartTime    string    `json:"start_time"` // "09:00"
+	EndTime      string    `json:"end_time"`   // "17:00"
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// AvailabilityException overrides the weekly rules on a single local date.
+// With Available=false and no times the whole day is off; with times it
+// blocks that window. With Available=true it adds extra hours.
+type AvailabilityException struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	CounsellorID uint      `json:"counsellor_id" gorm:"index;not null"`
+	Date         string    `json:"date"` // "2006-01-02"
+	StartTime    string    `json:"start_time,omitempty"`
+	EndTime      string    `json:"end_time,omitempty"`
+	Available    bool      `json:"available"`
+	Reason       string    `json:"reason,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// TimeOff blocks an absolute time range, e.g. a holiday spanning several days.
+type TimeOff struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	CounsellorID uint      `json:"counsellor_id" gorm:"index;not null"`
+	StartsAt     time.Time `json:"starts_at"`
+	EndsAt       time.Time `json:"ends_at"`
+	Reason       string    `json:"reason,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Request/Response DTOs
+type WeeklyRuleInput struct {
+	Weekday   int    `json:"weekday" binding:"min=0,max=6"`
+	StartTime string `json:"start_time" binding:"required"`
+	EndTime   string `json:"end_time" binding:"required"`
+}
+
+type WeeklyAvailabilityRequest struct {
+	Timezone string            `json:"timezone"`
+	Rules    []WeeklyRuleInput `json:"rules"`
+}
+
+type AvailabilityExceptionRequest struct {
+	Date      string `json:"date" binding:"required"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason"`
+}
+
+type TimeOffRequest struct {
+	StartsAt string `json:"starts_at" binding:"required"`
+	EndsAt   string `json:"ends_at" binding:"required"`
+	Reason   string `json:"reason"`
+}
+
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// interval is a half-open [start, end) time range.
+type interval struct {
+	start, end time.Time
+}
+
+// Counsellor portal handlers
+func getAvailability(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	var counsellor Counsellor
+	db.First(&counsellor, counsellorID)
+
+	var rules []AvailabilityRule
+	var exceptions []AvailabilityException
+	var timeOff []TimeOff
+	db.Where("counsellor_id = ?", counsellorID).Order("weekday, start_time").Find(&rules)
+	db.Where("counsellor_id = ?", counsellorID).Order("date").Find(&exceptions)
+	db.Where("counsellor_id = ? AND ends_at > ?", counsellorID, time.Now().UTC()).Order("starts_at").Find(&timeOff)
+
+	c.JSON(http.StatusOK, gin.H{
+		"timezone":   counsellor.Timezone,
+		"rules":      rules,
+		"exceptions": exceptions,
+		"time_off":   timeOff,
+	})
+}
+
+// updateWeeklyAvailability replaces the counsellor's weekly schedule.
+func updateWeeklyAvailability(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	var req WeeklyAvailabilityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Timezone != "" {
+		if !isValidTimezone(req.Timezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+			return
+		}
+	}
+
+	rules := make([]AvailabilityRule, 0, len(req.Rules))
+	for _, input := range req.Rules {
+		if err := validateClockRange(input.StartTime, input.EndTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rules = append(rules, AvailabilityRule{
+			CounsellorID: counsellorID,
+			Weekday:      input.Weekday,
+			StartTime:    input.StartTime,
+			EndTime:      input.EndTime,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if req.Timezone != "" {
+			if err := tx.Model(&Counsellor{}).Where("id = ?", counsellorID).Update("timezone", req.Timezone).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("counsellor_id = ?", counsellorID).Delete(&AvailabilityRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update availability"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Availability updated successfully", "rules": rules})
+}
+
+func createAvailabilityException(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	var req AvailabilityExceptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format, expected YYYY-MM-DD"})
+		return
+	}
+
+	if req.StartTime != "" || req.EndTime != "" || req.Available {
+		if err := validateClockRange(req.StartTime, req.EndTime); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	exception := AvailabilityException{
+		CounsellorID: counsellorID,
+		Date:         req.Date,
+		StartTime:    req.StartTime,
+		EndTime:      req.EndTime,
+		Available:    req.Available,
+		Reason:       req.Reason,
+	}
+
+	if err := db.Create(&exception).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create exception"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, exception)
+}
+
+func deleteAvailabilityException(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	result := db.Where("id = ? AND counsellor_id = ?", c.Param("id"), counsellorID).Delete(&AvailabilityException{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete exception"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Exception not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Exception deleted successfully"})
+}
+
+func createTimeOff(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	var req TimeOffRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	startsAt, err := time.Parse(time.RFC3339, req.StartsAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid starts_at format"})
+		return
+	}
+
+	endsAt, err := time.Parse(time.RFC3339, req.EndsAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ends_at format"})
+		return
+	}
+
+	if !endsAt.After(startsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+		return
+	}
+
+	timeOff := TimeOff{
+		CounsellorID: counsellorID,
+		StartsAt:     startsAt.UTC(),
+		EndsAt:       endsAt.UTC(),
+		Reason:       req.Reason,
+	}
+
+	if err := db.Create(&timeOff).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create time off"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, timeOff)
+}
+
+func deleteTimeOff(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	result := db.Where("id = ? AND counsellor_id = ?", c.Param("id"), counsellorID).Delete(&TimeOff{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete time off"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Time off not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Time off deleted successfully"})
+}
+
+// Counsellor handlers
+func getCounsellorSlots(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	// Bare dates in from/to are days in the caller's timezone
+	var user User
+	db.First(&user, userID)
+	userLoc := loadLocation(user.Timezone)
+
+	var counsellor Counsellor
+	if err := db.First(&counsellor, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	from, err := parseRangeBound(c.Query("from"), time.Now(), userLoc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from, expected YYYY-MM-DD or RFC 3339"})
+		return
+	}
+
+	to, err := parseRangeBound(c.Query("to"), from.Add(7*24*time.Hour), userLoc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to, expected YYYY-MM-DD or RFC 3339"})
+		return
+	}
+
+	// Times are stored in UTC and SQLite compares them as text, so every
+	// bound is queried in UTC too.
+	from, to = from.UTC(), to.UTC()
+
+	if !to.After(from) || to.Sub(from) > maxSlotRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from and at most 31 days later"})
+		return
+	}
+
+	duration := defaultSlotDuration
+	if d := c.Query("duration"); d != "" {
+		duration, err = strconv.Atoi(d)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+	}
+
+	slots, err := computeFreeSlots(db, counsellor, from, to, time.Duration(duration)*time.Minute)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute slots"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"counsellor_id": counsellor.ID,
+		"timezone":      counsellor.Timezone,
+		"user_timezone": userLoc.String(),
+		"duration":      duration,
+		"slots":         slots,
+	})
+}
+
+// computeFreeSlots returns the bookable slots of the given length that start
+// within [from, to), on a slotInterval grid anchored at each working window.
+func computeFreeSlots(tx *gorm.DB, counsellor Counsellor, from, to time.Time, length time.Duration) ([]Slot, error) {
+	windows, err := workingWindows(tx, counsellor, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	busy, err := busyIntervals(tx, counsellor.ID, from, to.Add(length), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	slots := []Slot{}
+	for _, w := range windows {
+		for start := w.start; !start.Add(length).After(w.end); start = start.Add(slotInterval) {
+			end := start.Add(length)
+			if start.Before(from) || !start.Before(to) || start.Before(now) {
+				continue
+			}
+			if overlapsAny(interval{start, end}, busy) {
+				continue
+			}
+			slots = append(slots, Slot{Start: start.UTC(), End: end.UTC()})
+		}
+	}
+
+	return slots, nil
+}
+
+// isWithinAvailability reports whether [start, start+length) lies entirely
+// inside the counsellor's working hours and clear of time off.
+func isWithinAvailability(tx *gorm.DB, counsellor Counsellor, start time.Time, length time.Duration) (bool, error) {
+	end := start.Add(length)
+
+	windows, err := workingWindows(tx, counsellor, start, end)
+	if err != nil {
+		return false, err
+	}
+
+	inside := false
+	for _, w := range windows {
+		if !start.Before(w.start) && !end.After(w.end) {
+			inside = true
+			break
+		}
+	}
+	if !inside {
+		return false, nil
+	}
+
+	var timeOff int64
+	err = tx.Model(&TimeOff{}).
+		Where("counsellor_id = ? AND starts_at < ? AND ends_at > ?", counsellor.ID, end.UTC(), start.UTC()).
+		Count(&timeOff).Error
+	return timeOff == 0, err
+}
+
+// workingWindows expands the weekly rules and exceptions into concrete
+// intervals covering every local day that touches [from, to).
+func workingWindows(tx *gorm.DB, counsellor Counsellor, from, to time.Time) ([]interval, error) {
+	loc := loadLocation(counsellor.Timezone)
+
+	var rules []AvailabilityRule
+	if err := tx.Where("counsellor_id = ?", counsellor.ID).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	firstDay := from.In(loc).Format("2006-01-02")
+	lastDay := to.In(loc).Format("2006-01-02")
+
+	var exceptions []AvailabilityException
+	if err := tx.Where("counsellor_id = ? AND date BETWEEN ? AND ?", counsellor.ID, firstDay, lastDay).
+		Find(&exceptions).Error; err != nil {
+		return nil, err
+	}
+
+	var windows []interval
+	day := startOfLocalDay(from.In(loc))
+	for !day.After(to) {
+		date := day.Format("2006-01-02")
+
+		var open, blocked []interval
+		dayOff := false
+		for _, r := range rules {
+			if time.Weekday(r.Weekday) == day.Weekday() {
+				open = append(open, clockInterval(day, r.StartTime, r.EndTime))
+			}
+		}
+		for _, e := range exceptions {
+			if e.Date != date {
+				continue
+			}
+			switch {
+			case e.Available:
+				open = append(open, clockInterval(day, e.StartTime, e.EndTime))
+			case e.StartTime == "" && e.EndTime == "":
+				dayOff = true
+			default:
+				blocked = append(blocked, clockInterval(day, e.StartTime, e.EndTime))
+			}
+		}
+
+		if !dayOff {
+			windows = append(windows, subtractIntervals(mergeIntervals(open), blocked)...)
+		}
+
+		day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc)
+	}
+
+	var timeOff []TimeOff
+	if err := tx.Where("counsellor_id = ? AND starts_at < ? AND ends_at > ?", counsellor.ID, to.UTC(), from.UTC()).
+		Find(&timeOff).Error; err != nil {
+		return nil, err
+	}
+	var off []interval
+	for _, t := range timeOff {
+		off = append(off, interval{t.StartsAt, t.EndsAt})
+	}
+
+	return subtractIntervals(windows, off), nil
+}
+
+// busyIntervals returns the counsellor's occupied time in [from, to),
+// ignoring the session with ID exclude (0 to ignore none).
+func busyIntervals(tx *gorm.DB, counsellorID uint, from, to time.Time, exclude uint) ([]interval, error) {
+	// Look back far enough to catch long sessions that started before from.
+	var sessions []Session
+	if err := tx.Where("counsellor_id = ? AND id <> ? AND status IN ? AND session_date < ? AND session_date > ?",
+		counsellorID, exclude, activeSessionStatuses, to.UTC(), from.Add(-maxSessionLength).UTC()).
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	busy := make([]interval, 0, len(sessions))
+	for _, s := range sessions {
+		busy = append(busy, interval{s.SessionDate, s.SessionDate.Add(time.Duration(s.Duration) * time.Minute)})
+	}
+	return busy, nil
+}
+
+func startOfLocalDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// clockInterval builds the interval between two "HH:MM" wall-clock times on
+// the given local day. time.Date normalises times that fall in a DST gap.
+func clockInterval(day time.Time, startClock, endClock string) interval {
+	sh, sm, _ := parseClock(startClock)
+	eh, em, _ := parseClock(endClock)
+	return interval{
+		start: time.Date(day.Year(), day.Month(), day.Day(), sh, sm, 0, 0, day.Location()),
+		end:   time.Date(day.Year(), day.Month(), day.Day(), eh, em, 0, 0, day.Location()),
+	}
+}
+
+// parseClock parses "HH:MM", also accepting "24:00" as the end of the day.
+func parseClock(s string) (int, int, error) {
+	if s == "24:00" {
+		return 24, 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func validateClockRange(start, end string) error {
+	sh, sm, err := parseClock(start)
+	if err != nil {
+		return fmt.Errorf("invalid start time %q, expected HH:MM", start)
+	}
+
+	eh, em, err := parseClock(end)
+	if err != nil {
+		return fmt.Errorf("invalid end time %q, expected HH:MM", end)
+	}
+
+	if eh*60+em <= sh*60+sm {
+		return fmt.Errorf("end time must be after start time")
+	}
+	return nil
+}
+
+// parseRangeBound accepts a date (YYYY-MM-DD, taken as midnight in loc) or a
+// full RFC 3339 timestamp, returning fallback for an empty value.
+func parseRangeBound(value string, fallback time.Time, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func overlapsAny(target interval, others []interval) bool {
+	for _, o := range others {
+		if target.start.Before(o.end) && o.start.Before(target.end) {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeIntervals(in []interval) []interval {
+	if len(in) == 0 {
+		return nil
+	}
+
+	sorted := append([]interval(nil), in...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start.Before(sorted[j].start) })
+
+	merged := []interval{sorted[0]}
+	for _, next := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if !next.start.After(last.end) {
+			if next.end.After(last.end) {
+				last.end = next.end
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// subtractIntervals removes every part of base covered by cut.
+func subtractIntervals(base, cut []interval) []interval {
+	result := base
+	for _, c := range cut {
+		var next []interval
+		for _, b := range result {
+			if !c.start.Before(b.end) || !b.start.Before(c.end) {
+				next = append(next, b)
+				continue
+			}
+			if b.start.Before(c.start) {
+				next = append(next, interval{b.start, c.start})
+			}
+			if c.end.Before(b.end) {
+				next = append(next, interval{c.end, b.end})
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// seedCounsellorAvailability gives a new counsellor weekday office hours,
+// so they can be booked before setting their own.
+func seedCounsellorAvailability(tx *gorm.DB, counsellorID uint) error {
+	rules := make([]AvailabilityRule, 0, 5)
+	for weekday := 1; weekday <= 5; weekday++ {
+		rules = append(rules, AvailabilityRule{
+			CounsellorID: counsellorID,
+			Weekday:      weekday,
+			StartTime:    "09:00",
+			EndTime:      "17:00",
+		})
+	}
+	return tx.Create(&rules).Error
+}
+
+// seedDefaultAvailability gives every existing counsellor office hours. It
+// runs once, when the availability tables are created, so catalogues from
+// before availability existed stay bookable after upgrading.
+func seedDefaultAvailability(tx *gorm.DB) error {
+	var counsellors []Counsellor
+	if err := tx.Find(&counsellors).Error; err != nil {
+		return err
+	}
+
+	for _, counsellor := range counsellors {
+		if err := seedCounsellorAvailability(tx, counsellor.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
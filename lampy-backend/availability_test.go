@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func at(clock string) time.Time {
+	t, _ := time.Parse("15:04", clock)
+	return time.Date(2030, 7, 1, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func span(start, end string) interval {
+	return interval{at(start), at(end)}
+}
+
+func formatIntervals(in []interval) string {
+	s := ""
+	for _, i := range in {
+		s += fmt.Sprintf("[%s-%s)", i.start.Format("15:04"), i.end.Format("15:04"))
+	}
+	return s
+}
+
+func TestMergeIntervals(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []interval
+		want string
+	}{
+		{"empty", nil, ""},
+		{"disjoint", []interval{span("09:00", "10:00"), span("11:00", "12:00")}, "[09:00-10:00)[11:00-12:00)"},
+		{"overlapping", []interval{span("09:00", "11:00"), span("10:00", "12:00")}, "[09:00-12:00)"},
+		{"touching", []interval{span("09:00", "10:00"), span("10:00", "11:00")}, "[09:00-11:00)"},
+		{"contained", []interval{span("09:00", "12:00"), span("10:00", "11:00")}, "[09:00-12:00)"},
+		{"unsorted", []interval{span("13:00", "14:00"), span("09:00", "10:00")}, "[09:00-10:00)[13:00-14:00)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIntervals(mergeIntervals(tt.in)); got != tt.want {
+				t.Errorf("mergeIntervals() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractIntervals(t *testing.T) {
+	base := []interval{span("09:00", "17:00")}
+
+	tests := []struct {
+		name string
+		cut  []interval
+		want string
+	}{
+		{"nothing", nil, "[09:00-17:00)"},
+		{"middle", []interval{span("12:00", "13:00")}, "[09:00-12:00)[13:00-17:00)"},
+		{"start", []interval{span("08:00", "10:00")}, "[10:00-17:00)"},
+		{"end", []interval{span("16:00", "18:00")}, "[09:00-16:00)"},
+		{"everything", []interval{span("08:00", "18:00")}, ""},
+		{"outside", []interval{span("07:00", "08:00")}, "[09:00-17:00)"},
+		{"touching end", []interval{span("17:00", "18:00")}, "[09:00-17:00)"},
+		{"several", []interval{span("10:00", "11:00"), span("14:00", "15:00")}, "[09:00-10:00)[11:00-14:00)[15:00-17:00)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIntervals(subtractIntervals(base, tt.cut)); got != tt.want {
+				t.Errorf("subtractIntervals() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateClockRange(t *testing.T) {
+	tests := []struct {
+		start, end string
+		valid      bool
+	}{
+		{"09:00", "17:00", true},
+		{"00:00", "24:00", true},
+		{"17:00", "09:00", false},
+		{"09:00", "09:00", false},
+		{"9am", "17:00", false},
+		{"09:00", "25:00", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.start+"-"+tt.end, func(t *testing.T) {
+			if err := validateClockRange(tt.start, tt.end); (err == nil) != tt.valid {
+				t.Errorf("validateClockRange() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestComputeFreeSlots(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		prepare  func(counsellor Counsellor, day time.Time)
+		want     []string // slot starts, UTC
+	}{
+		{
+			name:     "working hours only",
+			timezone: "Asia/Kolkata",
+			want:     []string{"03:30", "04:00", "04:30", "05:00", "05:30"},
+		},
+		{
+			name:     "summer time",
+			timezone: "Europe/London",
+			want:     []string{"08:00", "08:30", "09:00", "09:30", "10:00"},
+		},
+		{
+			name:     "day off",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&AvailabilityException{CounsellorID: counsellor.ID, Date: day.Format("2006-01-02")})
+			},
+			want: nil,
+		},
+		{
+			name:     "blocked hour",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&AvailabilityException{CounsellorID: counsellor.ID, Date: day.Format("2006-01-02"), StartTime: "10:00", EndTime: "11:00"})
+			},
+			want: []string{"03:30", "05:30"},
+		},
+		{
+			name:     "extra hours",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&AvailabilityException{CounsellorID: counsellor.ID, Date: day.Format("2006-01-02"), StartTime: "14:00", EndTime: "15:00", Available: true})
+			},
+			want: []string{"03:30", "04:00", "04:30", "05:00", "05:30", "08:30"},
+		},
+		{
+			name:     "time off",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&TimeOff{CounsellorID: counsellor.ID, StartsAt: day.Add(-24 * time.Hour).UTC(), EndsAt: day.Add(10 * time.Hour).UTC()})
+			},
+			want: []string{"04:30", "05:00", "05:30"},
+		},
+		{
+			name:     "booked session",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&Session{CounsellorID: counsellor.ID, SessionDate: day.Add(10 * time.Hour).UTC(), Duration: 50, Status: SessionConfirmed})
+			},
+			want: []string{"03:30", "05:30"},
+		},
+		{
+			name:     "cancelled session frees its time",
+			timezone: "Asia/Kolkata",
+			prepare: func(counsellor Counsellor, day time.Time) {
+				db.Create(&Session{CounsellorID: counsellor.ID, SessionDate: day.Add(10 * time.Hour).UTC(), Duration: 50, Status: SessionCancelledByUser})
+			},
+			want: []string{"03:30", "04:00", "04:30", "05:00", "05:30"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			counsellor := createTestCounsellor(t, "Dr Slots", nil)
+			counsellor.Timezone = tt.timezone
+			db.Save(&counsellor)
+
+			day := time.Date(2030, 7, 1, 0, 0, 0, 0, loadLocation(tt.timezone))
+			db.Create(&AvailabilityRule{CounsellorID: counsellor.ID, Weekday: int(day.Weekday()), StartTime: "09:00", EndTime: "12:00"})
+			if tt.prepare != nil {
+				tt.prepare(counsellor, day)
+			}
+
+			slots, err := computeFreeSlots(db, counsellor, day.UTC(), day.Add(24*time.Hour).UTC(), 50*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, s := range slots {
+				got = append(got, s.Start.Format("15:04"))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("slots = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsWithinAvailability(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string // local time on the working day
+		want  bool
+	}{
+		{"start of hours", "09:00", true},
+		{"ends at close", "11:10", true},
+		{"runs past close", "11:30", false},
+		{"before opening", "08:30", false},
+		{"off grid but inside", "09:17", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			counsellor := createTestCounsellor(t, "Dr Hours", nil)
+
+			loc := loadLocation(counsellor.Timezone)
+			clock, _ := time.Parse("15:04", tt.start)
+			start := time.Date(2030, 7, 1, clock.Hour(), clock.Minute(), 0, 0, loc)
+			db.Create(&AvailabilityRule{CounsellorID: counsellor.ID, Weekday: int(start.Weekday()), StartTime: "09:00", EndTime: "12:00"})
+
+			got, err := isWithinAvailability(db, counsellor, start.UTC(), 50*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("isWithinAvailability() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCounsellorSeedsHours(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin@example.com", RoleAdmin)
+	body := Counsellor{Name: "Dr New", Role: "Psychologist", Prices: inrPrices(500, 800, 1400)}
+
+	w := serveTest(createCounsellor, http.MethodPost, "/counsellors", "/counsellors", body, admin.ID, admin.Role)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	var rules []AvailabilityRule
+	db.Order("weekday").Find(&rules)
+	if len(rules) != 5 || rules[0].Weekday != 1 || rules[4].Weekday != 5 || rules[0].StartTime != "09:00" || rules[0].EndTime != "17:00" {
+		t.Errorf("rules = %+v, want weekday office hours", rules)
+	}
+}
+
+func TestMigrateSchemaSeedsAvailabilityOnce(t *testing.T) {
+	setupTestDB(t)
+
+	// A catalogue from before availability existed.
+	db.Migrator().DropTable(&AvailabilityRule{})
+	for _, name := range []string{"Dr One", "Dr Two"} {
+		db.Create(&Counsellor{Name: name, Role: "Psychologist", Timezone: defaultTimezone})
+	}
+
+	steps := []struct {
+		name   string
+		before func()
+		want   int64
+	}{
+		{"upgrade", func() {}, 10},
+		{"restart", func() {}, 10},
+		{"every rule deleted", func() { db.Where("1 = 1").Delete(&AvailabilityRule{}) }, 0},
+	}
+
+	for _, step := range steps {
+		step.before()
+		if err := migrateSchema(db); err != nil {
+			t.Fatalf("%s: migrateSchema() error = %v", step.name, err)
+		}
+		var count int64
+		db.Model(&AvailabilityRule{}).Count(&count)
+		if count != step.want {
+			t.Errorf("%s: %d rules, want %d", step.name, count, step.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BlobStore holds uploaded files. Keys are slash-separated paths such as
+// "profiles/<sha256>". The implementation is chosen at startup from
+// BLOB_STORE ("local", "s3" or "memory").
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var blobStore BlobStore
+
+func initBlobStore() {
+	switch store := getEnv("BLOB_STORE", "local"); store {
+	case "local":
+		blobStore = &localBlobStore{root: getEnv("UPLOAD_DIR", "uploads")}
+	case "s3":
+		s3 := newS3BlobStore()
+		if s3.bucket == "" || s3.accessKey == "" || s3.secretKey == "" {
+			log.Fatal("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+		}
+		blobStore = s3
+	case "memory":
+		blobStore = newMemoryBlobStore()
+	default:
+		log.Fatalf("BLOB_STORE must be local, s3 or memory, got %q", store)
+	}
+}
+
+// storeUpload saves an uploaded file under prefix, keyed by the SHA-256 of
+// its contents, and returns the key. Uploading the same bytes twice stores
+// them once. Encrypted files get a random key instead: a hash of the
+// plaintext would let anyone holding the key confirm a guess at the document.
+func storeUpload(prefix string, data []byte, contentType string, encrypt bool) (string, error) {
+	sum := sha256.Sum256(data)
+	key := prefix + "/" + hex.EncodeToString(sum[:])
+	if encrypt {
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		key = prefix + "/" + hex.EncodeToString(id)
+
+		var err error
+		if data, err = encryptDocument(data); err != nil {
+			return "", err
+		}
+		contentType = "application/octet-stream"
+	}
+	if err := blobStore.Put(key, data, contentType); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// localBlobStore keeps blobs as files under root. It only suits a single
+// replica, or several sharing a network volume.
+type localBlobStore struct {
+	root string
+}
+
+// path maps key to a file under root, refusing keys that would escape it.
+func (s *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *localBlobStore) Put(key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so readers never see a
+	// partly written blob.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// memoryBlobStore keeps blobs in process memory. It is for development and
+// tests; everything is lost on restart.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memoryBlobStore) Put(key string, data []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryBlobStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
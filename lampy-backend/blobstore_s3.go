@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3BlobStore keeps blobs in an S3-compatible bucket: AWS S3, or MinIO and
+// similar for local development. Requests are signed with AWS Signature
+// Version 4.
+type s3BlobStore struct {
+	endpoint  string // scheme and host, e.g. https://s3.ap-south-1.amazonaws.com
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool // bucket in the path rather than the host name; MinIO needs this
+	client    *http.Client
+}
+
+func newS3BlobStore() *s3BlobStore {
+	region := getEnv("S3_REGION", "us-east-1")
+	return &s3BlobStore{
+		endpoint:  strings.TrimRight(getEnv("S3_ENDPOINT", "https://s3."+region+".amazonaws.com"), "/"),
+		region:    region,
+		bucket:    getEnv("S3_BUCKET", ""),
+		accessKey: getEnv("S3_ACCESS_KEY_ID", ""),
+		secretKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+		pathStyle: getEnv("S3_PATH_STYLE", "false") == "true",
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *s3BlobStore) Put(key string, data []byte, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	resp, err := s.do(http.MethodPut, key, data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectURL returns the URL of key in the bucket.
+func (s *s3BlobStore) objectURL(key string) (*url.URL, error) {
+	base, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path, escaped := "/"+key, "/"+s3EscapePath(key)
+	if s.pathStyle {
+		path, escaped = "/"+s.bucket+path, "/"+s.bucket+escaped
+	} else {
+		base.Host = s.bucket + "." + base.Host
+	}
+	base.Path = path
+	base.RawPath = escaped
+	return base, nil
+}
+
+// do sends a signed request for key, returning errBlobNotFound for a 404
+// and an error carrying S3's message for any other failure.
+func (s *s3BlobStore) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	target, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// sign adds the headers and Authorization for AWS Signature Version 4. The
+// payload hash is signed too, so S3 rejects a body altered in transit.
+func (s *s3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		values := req.Header.Values(name)
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath percent-encodes each segment of key as SigV4 expects:
+// everything except unreserved characters, keeping the slashes.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxSessionLength bounds how far back overlap queries look for sessions that
+// started before the requested slot but may still be running.
+const maxSessionLength = 24 * time.Hour
+
+const suggestedSlotCount = 5
+
+// BookingLock is a row per calendar (a counsellor's or a user's) that
+// bookings write before checking for overlaps. The write locks the row
+// until the transaction ends, so concurrent bookings on the same calendar
+// are serialised by the database, across every replica.
+type BookingLock struct {
+	Owner   string `gorm:"primaryKey"` // "counsellor:<id>" or "user:<id>"
+	Version int64  `gorm:"not null;default:0"`
+}
+
+// BookingConflictError reports the existing session that overlaps a
+// requested slot and whose calendar it is on ("counsellor" or "user").
+type BookingConflictError struct {
+	Party   string
+	Session Session
+}
+
+func (e *BookingConflictError) Error() string {
+	return fmt.Sprintf("slot overlaps %s's session %d", e.Party, e.Session.ID)
+}
+
+// reserveSession inserts the session if neither the counsellor nor the user
+// has an overlapping active session. exclude names a session to ignore, so
+// a session can be moved without conflicting with itself.
+func reserveSession(session *Session, exclude uint, save func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := lockBookingCalendars(tx, session.CounsellorID, session.UserID); err != nil {
+			return err
+		}
+
+		start := session.SessionDate
+		length := time.Duration(session.Duration) * time.Minute
+
+		conflict, err := findOverlappingSession(tx, "counsellor_id = ?", session.CounsellorID, start, length, exclude)
+		if err != nil {
+			return err
+		}
+		if conflict != nil {
+			return &BookingConflictError{Party: "counsellor", Session: *conflict}
+		}
+
+		conflict, err = findOverlappingSession(tx, "user_id = ?", session.UserID, start, length, exclude)
+		if err != nil {
+			return err
+		}
+		if conflict != nil {
+			return &BookingConflictError{Party: "user", Session: *conflict}
+		}
+
+		return save(tx)
+	})
+}
+
+// lockBookingCalendars takes the booking locks of a counsellor and a user
+// for the rest of tx. The counsellor is always locked first, so two bookings
+// cannot each hold the lock the other is waiting for.
+func lockBookingCalendars(tx *gorm.DB, counsellorID, userID uint) error {
+	for _, owner := range []string{fmt.Sprintf("counsellor:%d", counsellorID), fmt.Sprintf("user:%d", userID)} {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&BookingLock{Owner: owner}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&BookingLock{}).Where("owner = ?", owner).
+			UpdateColumn("version", gorm.Expr("version + 1")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findOverlappingSession returns the first active session matching owner
+// that overlaps [start, start+length), or nil.
+func findOverlappingSession(tx *gorm.DB, owner string, ownerID uint, start time.Time, length time.Duration, exclude uint) (*Session, error) {
+	end := start.Add(length)
+
+	var candidates []Session
+	if err := tx.Where(owner, ownerID).
+		Where("id <> ? AND status IN ? AND session_date < ? AND session_date > ?",
+			exclude, activeSessionStatuses, end.UTC(), start.Add(-maxSessionLength).UTC()).
+		Order("session_date").
+		Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	for _, s := range candidates {
+		sessionEnd := s.SessionDate.Add(time.Duration(s.Duration) * time.Minute)
+		if s.SessionDate.Before(end) && start.Before(sessionEnd) {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+// respondBookingConflict writes a 409 describing the clash together with the
+// next slots of the same length that are free for both parties.
+func respondBookingConflict(c *gin.Context, err error, counsellor Counsellor, userID uint, start time.Time, duration int) bool {
+	var conflict *BookingConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+
+	length := time.Duration(duration) * time.Minute
+	free, _ := computeFreeSlots(db, counsellor, start, start.Add(7*24*time.Hour), length)
+
+	suggestions := []Slot{}
+	for _, slot := range free {
+		if len(suggestions) == suggestedSlotCount {
+			break
+		}
+		if clash, err := findOverlappingSession(db, "user_id = ?", userID, slot.Start, length, 0); err != nil || clash != nil {
+			continue
+		}
+		suggestions = append(suggestions, slot)
+	}
+
+	message := "Counsellor is already booked at this time"
+	if conflict.Party == "user" {
+		message = "You already have a session at this time"
+	}
+
+	c.JSON(http.StatusConflict, gin.H{
+		"error": message,
+		"conflict": Slot{
+			Start: conflict.Session.SessionDate.UTC(),
+			End:   conflict.Session.SessionDate.Add(time.Duration(conflict.Session.Duration) * time.Minute).UTC(),
+		},
+		"suggested_slots": suggestions,
+	})
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestFindOverlappingSession(t *testing.T) {
+	base := time.Date(2030, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		start        time.Duration // offset from the existing 50-minute session
+		length       time.Duration
+		status       string // status of the existing session
+		exclude      bool
+		wantConflict bool
+	}{
+		{"before", -time.Hour, 50 * time.Minute, SessionConfirmed, false, false},
+		{"ends as it starts", -50 * time.Minute, 50 * time.Minute, SessionConfirmed, false, false},
+		{"overlaps start", -30 * time.Minute, 50 * time.Minute, SessionConfirmed, false, true},
+		{"same slot", 0, 50 * time.Minute, SessionPending, false, true},
+		{"inside", 10 * time.Minute, 20 * time.Minute, SessionPendingPayment, false, true},
+		{"surrounds", -time.Hour, 3 * time.Hour, SessionInProgress, false, true},
+		{"overlaps end", 30 * time.Minute, 50 * time.Minute, SessionConfirmed, false, true},
+		{"starts as it ends", 50 * time.Minute, 50 * time.Minute, SessionConfirmed, false, false},
+		{"cancelled session", 0, 50 * time.Minute, SessionCancelledByUser, false, false},
+		{"expired session", 0, 50 * time.Minute, SessionExpired, false, false},
+		{"excluded session", 0, 50 * time.Minute, SessionConfirmed, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Busy", nil)
+			existing := createTestSession(t, user, counsellor, base, tt.status)
+
+			var exclude uint
+			if tt.exclude {
+				exclude = existing.ID
+			}
+
+			conflict, err := findOverlappingSession(db, "counsellor_id = ?", counsellor.ID, base.Add(tt.start), tt.length, exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (conflict != nil) != tt.wantConflict {
+				t.Errorf("conflict = %v, want %v", conflict != nil, tt.wantConflict)
+			}
+		})
+	}
+}
+
+func TestReserveSessionSerialisesConcurrentBookings(t *testing.T) {
+	tests := []struct {
+		name      string
+		sameUser  bool // one user books several counsellors at once
+		wantParty string
+	}{
+		{"many users, one counsellor", false, "counsellor"},
+		{"one user, many counsellors", true, "user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			start := time.Now().Add(48 * time.Hour).Truncate(time.Hour).UTC()
+
+			const bookings = 8
+			sessions := make([]Session, bookings)
+			shared := createTestUser(t, "shared@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Shared", nil)
+			for i := range sessions {
+				user, c := shared, counsellor
+				if tt.sameUser {
+					c = createTestCounsellor(t, fmt.Sprintf("Dr %d", i), nil)
+				} else {
+					user = createTestUser(t, fmt.Sprintf("user%d@example.com", i), RoleUser)
+				}
+				sessions[i] = Session{UserID: user.ID, CounsellorID: c.ID, SessionDate: start, Duration: 50, Status: SessionPending}
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, bookings)
+			for i := range sessions {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = reserveSession(&sessions[i], 0, func(tx *gorm.DB) error {
+						return tx.Create(&sessions[i]).Error
+					})
+				}(i)
+			}
+			wg.Wait()
+
+			booked := 0
+			for _, err := range errs {
+				var conflict *BookingConflictError
+				switch {
+				case err == nil:
+					booked++
+				case errors.As(err, &conflict):
+					if conflict.Party != tt.wantParty {
+						t.Errorf("conflict party = %q, want %q", conflict.Party, tt.wantParty)
+					}
+				default:
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if booked != 1 {
+				t.Errorf("%d overlapping bookings succeeded, want exactly 1", booked)
+			}
+
+			var stored int64
+			db.Model(&Session{}).Count(&stored)
+			if stored != 1 {
+				t.Errorf("%d sessions stored, want 1", stored)
+			}
+		})
+	}
+}
+
+func TestBookSession(t *testing.T) {
+	slot := time.Now().Add(72 * time.Hour).Truncate(time.Hour).UTC()
+
+	tests := []struct {
+		name       string
+		date       string
+		unverified bool
+		closed     bool // counsellor has no working hours
+		prepare    func(t *testing.T, user User, counsellor Counsellor)
+		want       int
+	}{
+		{name: "books a paid session", date: slot.Format(time.RFC3339), want: http.StatusCreated},
+		{name: "offset timestamp", date: slot.In(time.FixedZone("", 5*3600+1800)).Format(time.RFC3339), want: http.StatusCreated},
+		{name: "past date", date: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), want: http.StatusBadRequest},
+		{name: "malformed date", date: "tomorrow", want: http.StatusBadRequest},
+		{name: "unverified email", date: slot.Format(time.RFC3339), unverified: true, want: http.StatusForbidden},
+		{name: "outside working hours", date: slot.Format(time.RFC3339), closed: true, want: http.StatusBadRequest},
+		{
+			name: "counsellor already booked",
+			date: slot.Format(time.RFC3339),
+			prepare: func(t *testing.T, user User, counsellor Counsellor) {
+				other := createTestUser(t, "other@example.com", RoleUser)
+				createTestSession(t, other, counsellor, slot.Add(-20*time.Minute), SessionConfirmed)
+			},
+			want: http.StatusConflict,
+		},
+		{
+			name: "user already booked elsewhere",
+			date: slot.Format(time.RFC3339),
+			prepare: func(t *testing.T, user User, counsellor Counsellor) {
+				elsewhere := createTestCounsellor(t, "Dr Elsewhere", nil)
+				createTestSession(t, user, elsewhere, slot.Add(20*time.Minute), SessionPending)
+			},
+			want: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			if tt.unverified {
+				db.Model(&user).Update("is_verified", false)
+			}
+			counsellor := createTestCounsellor(t, "Dr Book", nil)
+			if !tt.closed {
+				openAllWeek(t, counsellor)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, user, counsellor)
+			}
+
+			req := SessionBookingRequest{CounsellorID: counsellor.ID, SessionDate: tt.date, Duration: 50}
+			w := serveTest(bookSession, http.MethodPost, "/book", "/book", req, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusCreated {
+				return
+			}
+
+			var got SessionResponse
+			json.Unmarshal(w.Body.Bytes(), &got)
+			if !got.SessionDate.Equal(slot) || got.Status != SessionPendingPayment || got.Payment == nil {
+				t.Errorf("booked %s status %q payment %v, want %s pending payment", got.SessionDate, got.Status, got.Payment, slot)
+			}
+			if got.Payment != nil && got.Payment.Amount != 80000 {
+				t.Errorf("payment amount = %d, want 80000", got.Payment.Amount)
+			}
+		})
+	}
+}
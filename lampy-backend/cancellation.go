@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Policy applied to counsellors that have not configured their own.
+var defaultCancellationPolicy = CancellationPolicy{
+	FreeCancelHours:      24,
+	LateCancelFeePercent: 50,
+	NoShowFeePercent:     100,
+}
+
+// Cancellation outcomes
+const (
+	CancellationFree       = "free"
+	CancellationLate       = "late"
+	CancellationNoShow     = "no_show"
+	CancellationCounsellor = "counsellor"
+)
+
+// CancellationPolicy is a counsellor's terms for cancelled and missed
+// sessions. Fees are a percentage of the session price.
+type CancellationPolicy struct {
+	ID                   uint      `json:"id,omitempty" gorm:"primaryKey"`
+	CounsellorID         uint      `json:"counsellor_id" gorm:"uniqueIndex;not null"`
+	FreeCancelHours      int       `json:"free_cancel_hours"`
+	LateCancelFeePercent int       `json:"late_cancel_fee_percent"`
+	NoShowFeePercent     int       `json:"no_show_fee_percent"`
+	CreatedAt            time.Time `json:"-"`
+	UpdatedAt            time.Time `json:"-"`
+}
+
+type CancellationPolicyRequest struct {
+	FreeCancelHours      int `json:"free_cancel_hours" binding:"min=0,max=720"`
+	LateCancelFeePercent int `json:"late_cancel_fee_percent" binding:"min=0,max=100"`
+	NoShowFeePercent     int `json:"no_show_fee_percent" binding:"min=0,max=100"`
+}
+
+type CancelSessionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CancellationOutcome is the result of evaluating a policy for one session.
+type CancellationOutcome struct {
+	Type             string             `json:"type"`
+	FeePercent       int                `json:"fee_percent"`
+	FreeUntil        time.Time          `json:"free_until"`
+	HoursBeforeStart float64            `json:"hours_before_start"`
+	Policy           CancellationPolicy `json:"policy"`
+	Refund           *Money             `json:"refund,omitempty"` // only for paid sessions
+	CreditRestored   bool               `json:"credit_restored,omitempty"`
+}
+
+// cancellationPolicyFor returns the counsellor's policy, or the default.
+func cancellationPolicyFor(tx *gorm.DB, counsellorID uint) CancellationPolicy {
+	var policy CancellationPolicy
+	if err := tx.Where("counsellor_id = ?", counsellorID).First(&policy).Error; err != nil {
+		policy = defaultCancellationPolicy
+		policy.CounsellorID = counsellorID
+	}
+	return policy
+}
+
+// evaluateCancellation decides what a cancellation at time at costs the
+// user. status is the status the session is moving to.
+func evaluateCancellation(policy CancellationPolicy, session Session, status string, at time.Time) CancellationOutcome {
+	freeUntil := session.SessionDate.Add(-time.Duration(policy.FreeCancelHours) * time.Hour)
+	outcome := CancellationOutcome{
+		Type:             CancellationFree,
+		FreeUntil:        freeUntil,
+		HoursBeforeStart: session.SessionDate.Sub(at).Hours(),
+		Policy:           policy,
+	}
+
+	switch {
+	case status == SessionCancelledByCounsellor:
+		outcome.Type = CancellationCounsellor
+	case status == SessionNoShow:
+		outcome.Type = CancellationNoShow
+		outcome.FeePercent = policy.NoShowFeePercent
+	case at.After(freeUntil):
+		outcome.Type = CancellationLate
+		outcome.FeePercent = policy.LateCancelFeePercent
+	}
+
+	return outcome
+}
+
+// withRefund adds what the user gets back under outcome, if they paid.
+// Sessions paid with a wallet credit get the credit back when the
+// cancellation carries no fee; a credit cannot be partly returned.
+func withRefund(tx *gorm.DB, session Session, outcome CancellationOutcome) (CancellationOutcome, error) {
+	if paidWithCredit(tx, session.ID) {
+		outcome.CreditRestored = outcome.FeePercent == 0
+		return outcome, nil
+	}
+
+	balance, err := sessionBalance(tx, session.ID)
+	if err != nil || balance.Paid == 0 {
+		return outcome, err
+	}
+	outcome.Refund = &Money{Amount: cancellationRefund(balance, outcome), Currency: balance.Currency}
+	return outcome, nil
+}
+
+// applyCancellationPolicy evaluates the policy for a session that has just
+// moved to status, records the result on the session and queues the refund
+// or restores the credit the user is owed.
+func applyCancellationPolicy(tx *gorm.DB, session *Session, status, reason string) (CancellationOutcome, error) {
+	now := time.Now()
+	outcome, err := withRefund(tx, *session, evaluateCancellation(cancellationPolicyFor(tx, session.CounsellorID), *session, status, now))
+	if err != nil {
+		return outcome, err
+	}
+
+	session.CancelledAt = &now
+	session.CancellationType = outcome.Type
+	session.CancellationFeePercent = outcome.FeePercent
+	session.CancellationReason = reason
+
+	if err := tx.Model(&Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+		"cancelled_at":             now,
+		"cancellation_type":        outcome.Type,
+		"cancellation_fee_percent": outcome.FeePercent,
+		"cancellation_reason":      reason,
+	}).Error; err != nil {
+		return outcome, err
+	}
+
+	if outcome.CreditRestored {
+		_, err = restoreCredit(tx, *session, reason)
+	}
+	if outcome.Refund != nil {
+		_, err = queueRefund(tx, *session, outcome.Refund.Amount, RefundCancellation, reason, 0)
+	}
+	return outcome, err
+}
+
+// Session handlers
+// previewCancellation tells the app what cancelling now would cost, so it can
+// warn the user before they confirm.
+func previewCancellation(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if !canTransitionSession(session.Status, SessionCancelledByUser) {
+		respondSessionTransitionError(c, &SessionTransitionError{From: session.Status, To: SessionCancelledByUser})
+		return
+	}
+
+	policy := cancellationPolicyFor(db, session.CounsellorID)
+	outcome, err := withRefund(db, session, evaluateCancellation(policy, session, SessionCancelledByUser, time.Now()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up payment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, outcome)
+}
+
+// Counsellor handlers
+func getCounsellorCancellationPolicy(c *gin.Context) {
+	var counsellor Counsellor
+	if err := db.First(&counsellor, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, cancellationPolicyFor(db, counsellor.ID))
+}
+
+// Counsellor portal handlers
+func getOwnCancellationPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, cancellationPolicyFor(db, c.MustGet("counsellor_id").(uint)))
+}
+
+func updateOwnCancellationPolicy(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	var req CancellationPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := cancellationPolicyFor(db, counsellorID)
+	policy.FreeCancelHours = req.FreeCancelHours
+	policy.LateCancelFeePercent = req.LateCancelFeePercent
+	policy.NoShowFeePercent = req.NoShowFeePercent
+
+	if err := db.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cancellation policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
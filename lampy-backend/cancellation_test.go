@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEvaluateCancellation(t *testing.T) {
+	policy := CancellationPolicy{FreeCancelHours: 24, LateCancelFeePercent: 50, NoShowFeePercent: 100}
+	start := time.Date(2030, 7, 1, 10, 0, 0, 0, time.UTC)
+	session := Session{SessionDate: start}
+
+	tests := []struct {
+		name     string
+		status   string
+		before   time.Duration
+		wantType string
+		wantFee  int
+	}{
+		{"well ahead", SessionCancelledByUser, 48 * time.Hour, CancellationFree, 0},
+		{"exactly at the cut-off", SessionCancelledByUser, 24 * time.Hour, CancellationFree, 0},
+		{"just after the cut-off", SessionCancelledByUser, 24*time.Hour - time.Second, CancellationLate, 50},
+		{"after the start", SessionCancelledByUser, -time.Hour, CancellationLate, 50},
+		{"counsellor cancels late", SessionCancelledByCounsellor, time.Hour, CancellationCounsellor, 0},
+		{"no-show", SessionNoShow, -time.Hour, CancellationNoShow, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluateCancellation(policy, session, tt.status, start.Add(-tt.before))
+			if got.Type != tt.wantType || got.FeePercent != tt.wantFee {
+				t.Errorf("evaluateCancellation() = %s %d%%, want %s %d%%", got.Type, got.FeePercent, tt.wantType, tt.wantFee)
+			}
+			if !got.FreeUntil.Equal(start.Add(-24 * time.Hour)) {
+				t.Errorf("free until %s", got.FreeUntil)
+			}
+		})
+	}
+}
+
+func TestCancelSessionAppliesPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *CancellationPolicy
+		startsIn time.Duration
+		status   string
+		want     int
+		wantType string
+		wantFee  int
+	}{
+		{"default policy, early", nil, 72 * time.Hour, SessionConfirmed, http.StatusOK, CancellationFree, 0},
+		{"default policy, late", nil, 2 * time.Hour, SessionConfirmed, http.StatusOK, CancellationLate, defaultCancellationPolicy.LateCancelFeePercent},
+		{"own policy, late", &CancellationPolicy{FreeCancelHours: 1, LateCancelFeePercent: 20}, 2 * time.Hour, SessionConfirmed, http.StatusOK, CancellationFree, 0},
+		{"own policy, within window", &CancellationPolicy{FreeCancelHours: 4, LateCancelFeePercent: 20}, 2 * time.Hour, SessionPending, http.StatusOK, CancellationLate, 20},
+		{"already completed", nil, -2 * time.Hour, SessionCompleted, http.StatusConflict, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Policy", nil)
+			if tt.policy != nil {
+				policy := *tt.policy
+				policy.CounsellorID = counsellor.ID
+				db.Create(&policy)
+			}
+			session := createTestSession(t, user, counsellor, time.Now().Add(tt.startsIn), tt.status)
+
+			target := fmt.Sprintf("/sessions/%d", session.ID)
+			preview := serveTest(previewCancellation, http.MethodGet, "/sessions/:id", target, nil, user.ID, user.Role)
+			w := serveTest(cancelSession, http.MethodPut, "/sessions/:id", target, CancelSessionRequest{Reason: "busy"}, user.ID, user.Role)
+			if w.Code != tt.want || preview.Code != tt.want {
+				t.Fatalf("cancel status = %d, preview status = %d, want %d; body %s", w.Code, preview.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var previewed CancellationOutcome
+			json.Unmarshal(preview.Body.Bytes(), &previewed)
+			if previewed.Type != tt.wantType || previewed.FeePercent != tt.wantFee {
+				t.Errorf("preview = %s %d%%, want %s %d%%", previewed.Type, previewed.FeePercent, tt.wantType, tt.wantFee)
+			}
+
+			db.First(&session, session.ID)
+			if session.Status != SessionCancelledByUser || session.CancellationType != tt.wantType ||
+				session.CancellationFeePercent != tt.wantFee || session.CancellationReason != "busy" || session.CancelledAt == nil {
+				t.Errorf("session recorded %q %s %d%% %q", session.Status, session.CancellationType, session.CancellationFeePercent, session.CancellationReason)
+			}
+		})
+	}
+}
+
+func TestUpdateOwnCancellationPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		body CancellationPolicyRequest
+		want int
+	}{
+		{"valid", CancellationPolicyRequest{FreeCancelHours: 12, LateCancelFeePercent: 25, NoShowFeePercent: 100}, http.StatusOK},
+		{"fee over 100", CancellationPolicyRequest{FreeCancelHours: 12, LateCancelFeePercent: 150}, http.StatusBadRequest},
+		{"negative hours", CancellationPolicyRequest{FreeCancelHours: -1}, http.StatusBadRequest},
+		{"window over a month", CancellationPolicyRequest{FreeCancelHours: 721}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			account := createTestUser(t, "counsellor@example.com", RoleCounsellor)
+			counsellor := createTestCounsellor(t, "Dr Policy", &account)
+
+			w := servePortal(updateOwnCancellationPolicy, http.MethodPut, "/policy", "/policy", tt.body, account)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var stored []CancellationPolicy
+			db.Where("counsellor_id = ?", counsellor.ID).Find(&stored)
+			if tt.want != http.StatusOK {
+				if len(stored) != 0 {
+					t.Errorf("rejected policy was stored: %+v", stored)
+				}
+				return
+			}
+			if len(stored) != 1 || stored[0].FreeCancelHours != tt.body.FreeCancelHours ||
+				stored[0].LateCancelFeePercent != tt.body.LateCancelFeePercent || stored[0].NoShowFeePercent != tt.body.NoShowFeePercent {
+				t.Errorf("stored policy %+v, want %+v", stored, tt.body)
+			}
+		})
+	}
+}
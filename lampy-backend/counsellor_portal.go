@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type CounsellorAccountRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+type CounsellorAuthResponse struct {
+	AuthResponse
+	Counsellor Counsellor `json:"counsellor"`
+}
+
+// Middleware
+// counsellorMiddleware must run after authMiddleware. It resolves the
+// counsellor profile linked to the caller and stores its ID in the context.
+func counsellorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("role") != RoleCounsellor {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Counsellor account required"})
+			c.Abort()
+			return
+		}
+
+		var counsellor Counsellor
+		if err := db.Where("user_id = ?", c.MustGet("user_id").(uint)).First(&counsellor).Error; err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No counsellor profile linked to this account"})
+			c.Abort()
+			return
+		}
+
+		c.Set("counsellor_id", counsellor.ID)
+		c.Next()
+	}
+}
+
+// Auth handlers
+func counsellorLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	if err := db.Where("email = ? AND role = ?", req.Email, RoleCounsellor).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	var counsellor Counsellor
+	if err := db.Where("user_id = ?", user.ID).First(&counsellor).Error; err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No counsellor profile linked to this account"})
+		return
+	}
+
+	pair, err := issueTokenPair(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, CounsellorAuthResponse{
+		AuthResponse: AuthResponse{Token: pair.AccessToken, RefreshToken: pair.RefreshToken, ExpiresIn: pair.ExpiresIn, User: user},
+		Counsellor:   counsellor,
+	})
+}
+
+// Counsellor portal handlers
+func getCounsellorSessions(c *gin.Context) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+
+	query := db.Where("counsellor_id = ?", counsellorID)
+
+	// Upcoming sessions only unless the caller asks for history
+	if c.Query("include_past") != "true" {
+		query = query.Where("session_date >= ?", time.Now().UTC())
+	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var sessions []Session
+	if err := query.Preload("User").Preload("Counsellor").Order("session_date ASC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, presentSessions(sessions))
+}
+
+func confirmCounsellorSession(c *gin.Context) {
+	updateCounsellorSessionStatus(c, SessionConfirmed, "Session confirmed successfully")
+}
+
+func declineCounsellorSession(c *gin.Context) {
+	updateCounsellorSessionStatus(c, SessionCancelledByCounsellor, "Session declined successfully")
+}
+
+func startCounsellorSession(c *gin.Context) {
+	updateCounsellorSessionStatus(c, SessionInProgress, "Session started")
+}
+
+func completeCounsellorSession(c *gin.Context) {
+	updateCounsellorSessionStatus(c, SessionCompleted, "Session marked as completed")
+}
+
+func markCounsellorSessionNoShow(c *gin.Context) {
+	updateCounsellorSessionStatus(c, SessionNoShow, "Session marked as no-show")
+}
+
+// updateCounsellorSessionStatus moves one of the caller's sessions to status,
+// subject to the session state machine.
+func updateCounsellorSessionStatus(c *gin.Context, status, message string) {
+	counsellorID := c.MustGet("counsellor_id").(uint)
+	userID := c.MustGet("user_id").(uint)
+	sessionID := c.Param("id")
+
+	var session Session
+	if err := db.Where("id = ? AND counsellor_id = ?", sessionID, counsellorID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	// The body is optional
+	var req CancelSessionRequest
+	c.ShouldBindJSON(&req)
+
+	var outcome *CancellationOutcome
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionSession(tx, &session, status, userID, req.Reason); err != nil {
+			return err
+		}
+
+		if status != SessionCancelledByCounsellor && status != SessionNoShow {
+			return nil
+		}
+		result, err := applyCancellationPolicy(tx, &session, status, req.Reason)
+		outcome = &result
+		return err
+	})
+	if respondSessionTransitionError(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+
+	response := gin.H{"message": message, "status": status}
+	if outcome != nil {
+		response["cancellation"] = outcome
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Admin handlers
+// createCounsellorAccount gives a catalogue counsellor login credentials by
+// linking it to a user with the counsellor role.
+func createCounsellorAccount(c *gin.Context) {
+	id := c.Param("id")
+
+	var req CounsellorAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var counsellor Counsellor
+	if err := db.First(&counsellor, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	if counsellor.UserID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Counsellor already has an account"})
+		return
+	}
+
+	var existingUser User
+	if err := db.Where("email = ?", req.Email).First(&existingUser).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	user := User{
+		Name:     counsellor.Name,
+		Email:    req.Email,
+		Password: string(hashedPassword),
+		Role:     RoleCounsellor,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return tx.Model(&counsellor).Update("user_id", user.ID).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create counsellor account"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"user": user, "counsellor": counsellor})
+}
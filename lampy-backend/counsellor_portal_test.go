@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// servePortal runs a counsellor portal handler behind counsellorMiddleware
+// as the given user.
+func servePortal(handler gin.HandlerFunc, method, route, target string, body any, user User) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(method, route, func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Set("role", user.Role)
+	}, counsellorMiddleware(), handler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newTestRequest(method, target, body))
+	return w
+}
+
+func TestCounsellorMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string
+		linked bool
+		want   int
+	}{
+		{"linked counsellor", RoleCounsellor, true, http.StatusOK},
+		{"counsellor without profile", RoleCounsellor, false, http.StatusForbidden},
+		{"user linked to a profile", RoleUser, true, http.StatusForbidden},
+		{"admin", RoleAdmin, false, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			account := createTestUser(t, "counsellor@example.com", tt.role)
+			var counsellor Counsellor
+			if tt.linked {
+				counsellor = createTestCounsellor(t, "Dr Linked", &account)
+			}
+
+			var gotID uint
+			w := servePortal(func(c *gin.Context) {
+				gotID = c.MustGet("counsellor_id").(uint)
+				c.Status(http.StatusOK)
+			}, http.MethodGet, "/", "/", nil, account)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && gotID != counsellor.ID {
+				t.Errorf("counsellor_id = %d, want %d", gotID, counsellor.ID)
+			}
+		})
+	}
+}
+
+func TestUpdateCounsellorSessionStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		status     string
+		ownSession bool
+		want       int
+		wantStatus string
+	}{
+		{"confirm own pending session", confirmCounsellorSession, SessionPending, true, http.StatusOK, SessionConfirmed},
+		{"confirm another counsellor's session", confirmCounsellorSession, SessionPending, false, http.StatusNotFound, SessionPending},
+		{"decline own session", declineCounsellorSession, SessionPending, true, http.StatusOK, SessionCancelledByCounsellor},
+		{"start confirmed session", startCounsellorSession, SessionConfirmed, true, http.StatusOK, SessionInProgress},
+		{"complete pending session", completeCounsellorSession, SessionPending, true, http.StatusConflict, SessionPending},
+		{"confirm cancelled session", confirmCounsellorSession, SessionCancelledByUser, true, http.StatusConflict, SessionCancelledByUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			client := createTestUser(t, "user@example.com", RoleUser)
+			account := createTestUser(t, "counsellor@example.com", RoleCounsellor)
+			own := createTestCounsellor(t, "Dr Own", &account)
+			other := createTestCounsellor(t, "Dr Other", nil)
+
+			counsellor := own
+			if !tt.ownSession {
+				counsellor = other
+			}
+			session := createTestSession(t, client, counsellor, time.Now().Add(48*time.Hour), tt.status)
+
+			w := servePortal(tt.handler, http.MethodPut, "/sessions/:id", fmt.Sprintf("/sessions/%d", session.ID), nil, account)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&session, session.ID)
+			if session.Status != tt.wantStatus {
+				t.Errorf("session status = %q, want %q", session.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == SessionCancelledByCounsellor && session.CancellationType != CancellationCounsellor {
+				t.Errorf("cancellation type = %q, want %q", session.CancellationType, CancellationCounsellor)
+			}
+		})
+	}
+}
+
+func TestGetCounsellorSessionsListsOnlyOwn(t *testing.T) {
+	setupTestDB(t)
+	client := createTestUser(t, "user@example.com", RoleUser)
+	account := createTestUser(t, "counsellor@example.com", RoleCounsellor)
+	own := createTestCounsellor(t, "Dr Own", &account)
+	other := createTestCounsellor(t, "Dr Other", nil)
+
+	upcoming := createTestSession(t, client, own, time.Now().Add(24*time.Hour), SessionPending)
+	past := createTestSession(t, client, own, time.Now().Add(-24*time.Hour), SessionCompleted)
+	createTestSession(t, client, other, time.Now().Add(24*time.Hour), SessionPending)
+
+	tests := []struct {
+		query string
+		want  []uint
+	}{
+		{"", []uint{upcoming.ID}},
+		{"?include_past=true", []uint{past.ID, upcoming.ID}},
+		{"?include_past=true&status=completed", []uint{past.ID}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := servePortal(getCounsellorSessions, http.MethodGet, "/sessions", "/sessions"+tt.query, nil, account)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			var sessions []SessionResponse
+			json.Unmarshal(w.Body.Bytes(), &sessions)
+			var got []uint
+			for _, s := range sessions {
+				got = append(got, s.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("sessions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
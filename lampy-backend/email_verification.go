@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Email OTP settings
+var (
+	emailOTPTTL         = 10 * time.Minute
+	emailOTPMaxAttempts = 5
+	emailOTPCooldown    = time.Minute
+)
+
+// EmailVerificationCode is a 6-digit one-time code mailed to the user at
+// registration. Only a bcrypt hash of the code is stored.
+type EmailVerificationCode struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"index;not null"`
+	CodeHash   string     `json:"-" gorm:"not null"`
+	Attempts   int        `json:"attempts" gorm:"default:0"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type VerifyEmailRequest struct {
+	Code string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// Auth handlers
+func verifyEmail(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.IsVerified {
+		c.JSON(http.StatusOK, gin.H{"message": "Email already verified"})
+		return
+	}
+
+	var code EmailVerificationCode
+	if err := db.Where("user_id = ? AND consumed_at IS NULL", userID).
+		Order("created_at DESC").
+		First(&code).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No active verification code, request a new one"})
+		return
+	}
+
+	if time.Now().After(code.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification code has expired, request a new one"})
+		return
+	}
+
+	// Claim an attempt before comparing, so parallel guesses cannot all
+	// read the same count and slip past the limit.
+	claim := db.Model(&EmailVerificationCode{}).
+		Where("id = ? AND attempts < ?", code.ID, emailOTPMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if claim.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if claim.RowsAffected == 0 {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, request a new code"})
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(code.CodeHash), []byte(req.Code)); err != nil {
+		db.First(&code, code.ID)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":              "Invalid verification code",
+			"attempts_remaining": max(emailOTPMaxAttempts-code.Attempts, 0),
+		})
+		return
+	}
+
+	consumed := db.Model(&EmailVerificationCode{}).
+		Where("id = ? AND consumed_at IS NULL", code.ID).
+		Update("consumed_at", time.Now())
+	if consumed.Error != nil || consumed.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No active verification code, request a new one"})
+		return
+	}
+
+	if err := db.Model(&User{}).Where("id = ?", userID).Update("is_verified", true).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+func resendVerificationEmail(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.IsVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already verified"})
+		return
+	}
+
+	var last EmailVerificationCode
+	if err := db.Where("user_id = ?", userID).Order("created_at DESC").First(&last).Error; err == nil {
+		if wait := emailOTPCooldown - time.Since(last.CreatedAt); wait > 0 {
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Please wait before requesting another code",
+				"retry_after": int(wait.Seconds()) + 1,
+			})
+			return
+		}
+	}
+
+	if err := sendEmailVerificationCode(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification code sent"})
+}
+
+// sendEmailVerificationCode replaces any outstanding code for the user with a
+// fresh one and mails it.
+func sendEmailVerificationCode(user User) error {
+	otp, err := generateOTP()
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(otp), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	db.Model(&EmailVerificationCode{}).
+		Where("user_id = ? AND consumed_at IS NULL", user.ID).
+		Update("consumed_at", time.Now())
+
+	code := EmailVerificationCode{
+		UserID:    user.ID,
+		CodeHash:  string(hash),
+		ExpiresAt: time.Now().Add(emailOTPTTL),
+	}
+	if err := db.Create(&code).Error; err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nYour LAMPY verification code is %s. It expires in %d minutes.",
+		user.Name, otp, int(emailOTPTTL.Minutes()))
+	if err := mailer.Send(user.Email, "Your LAMPY verification code", body); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", user.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+func generateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+var otpPattern = regexp.MustCompile(`code is (\d{6})`)
+
+// mailedOTP returns the code from the last verification email.
+func mailedOTP(t *testing.T, mails *testMailer) string {
+	t.Helper()
+	match := otpPattern.FindStringSubmatch(mails.last().Body)
+	if match == nil {
+		t.Fatalf("no code in mail %q", mails.last().Body)
+	}
+	return match[1]
+}
+
+// wrongOTP returns a well-formed code other than otp.
+func wrongOTP(otp string) string {
+	if otp == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func createUnverifiedUser(t *testing.T, mails *testMailer) (User, string) {
+	t.Helper()
+	user := createTestUser(t, "user@example.com", RoleUser)
+	db.Model(&user).Update("is_verified", false)
+	user.IsVerified = false
+	if err := sendEmailVerificationCode(user); err != nil {
+		t.Fatal(err)
+	}
+	return user, mailedOTP(t, mails)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	tests := []struct {
+		name          string
+		wrongGuesses  int
+		expire        bool
+		want          int
+		wantVerified  bool
+		wantRemaining int
+	}{
+		{name: "correct code", want: http.StatusOK, wantVerified: true},
+		{name: "correct after some misses", wrongGuesses: emailOTPMaxAttempts - 1, want: http.StatusOK, wantVerified: true},
+		{name: "locked after max attempts", wrongGuesses: emailOTPMaxAttempts, want: http.StatusTooManyRequests},
+		{name: "expired code", expire: true, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mails := setupTestDB(t)
+			user, otp := createUnverifiedUser(t, mails)
+
+			for i := 0; i < tt.wrongGuesses; i++ {
+				w := serveTest(verifyEmail, http.MethodPost, "/verify", "/verify", VerifyEmailRequest{Code: wrongOTP(otp)}, user.ID, user.Role)
+				var body struct {
+					Remaining int `json:"attempts_remaining"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if w.Code != http.StatusBadRequest || body.Remaining != emailOTPMaxAttempts-i-1 {
+					t.Fatalf("guess %d: status = %d, remaining = %d", i, w.Code, body.Remaining)
+				}
+			}
+			if tt.expire {
+				db.Model(&EmailVerificationCode{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Second))
+			}
+
+			w := serveTest(verifyEmail, http.MethodPost, "/verify", "/verify", VerifyEmailRequest{Code: otp}, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&user, user.ID)
+			if user.IsVerified != tt.wantVerified {
+				t.Errorf("is_verified = %v, want %v", user.IsVerified, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestVerifyEmailParallelGuessesRespectLimit(t *testing.T) {
+	mails := setupTestDB(t)
+	user, otp := createUnverifiedUser(t, mails)
+
+	const guesses = 20
+	var wg sync.WaitGroup
+	codes := make(chan int, guesses)
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serveTest(verifyEmail, http.MethodPost, "/verify", "/verify", VerifyEmailRequest{Code: wrongOTP(otp)}, user.ID, user.Role)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	checked := 0
+	for code := range codes {
+		if code == http.StatusBadRequest {
+			checked++
+		}
+	}
+	if checked > emailOTPMaxAttempts {
+		t.Errorf("%d guesses were checked, limit is %d", checked, emailOTPMaxAttempts)
+	}
+
+	var code EmailVerificationCode
+	db.Where("user_id = ?", user.ID).First(&code)
+	if code.Attempts > emailOTPMaxAttempts {
+		t.Errorf("attempts = %d, limit is %d", code.Attempts, emailOTPMaxAttempts)
+	}
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration // how long ago the last code was sent
+		want    int
+		newCode bool
+	}{
+		{"within cooldown", 0, http.StatusTooManyRequests, false},
+		{"after cooldown", emailOTPCooldown + time.Second, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mails := setupTestDB(t)
+			user, otp := createUnverifiedUser(t, mails)
+			db.Model(&EmailVerificationCode{}).Where("user_id = ?", user.ID).Update("created_at", time.Now().Add(-tt.age))
+
+			w := serveTest(resendVerificationEmail, http.MethodPost, "/resend", "/resend", nil, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if !tt.newCode {
+				return
+			}
+
+			// Only the newest code works once a new one is sent.
+			if mailedOTP(t, mails) == otp {
+				t.Skip("new code happens to equal the old one")
+			}
+			w = serveTest(verifyEmail, http.MethodPost, "/verify", "/verify", VerifyEmailRequest{Code: otp}, user.ID, user.Role)
+			if w.Code == http.StatusOK {
+				t.Error("superseded code still verified the email")
+			}
+		})
+	}
+}
+
+func TestEmailChangeRequiresReverification(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        string
+		want         int
+		wantVerified bool
+		wantMail     bool
+	}{
+		{"new address", "new@example.com", http.StatusOK, false, true},
+		{"same address", "user@example.com", http.StatusOK, true, false},
+		{"address taken", "other@example.com", http.StatusConflict, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mails := setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			createTestUser(t, "other@example.com", RoleUser)
+
+			w := serveTest(updateProfile, http.MethodPut, "/profile", "/profile", map[string]any{"email": tt.email}, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&user, user.ID)
+			if user.IsVerified != tt.wantVerified {
+				t.Errorf("is_verified = %v, want %v", user.IsVerified, tt.wantVerified)
+			}
+			if sent := mails.last().To == tt.email; sent != tt.wantMail {
+				t.Errorf("code mailed to %q = %v, want %v", tt.email, sent, tt.wantMail)
+			}
+		})
+	}
+}
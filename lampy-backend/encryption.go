@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// KeyWrapper protects data keys with master keys that never leave it, the
+// way a KMS does. Master keys are named so that documents wrapped under an
+// older key can still be opened after rotation.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+	CurrentKeyID() string
+}
+
+var keyWrapper KeyWrapper
+
+// Encrypted blobs start with envelopeMagic and a version byte, followed by
+// the master key ID, the wrapped data key, and the AES-GCM nonce and
+// ciphertext of the file. Re-wrapping replaces the header and keeps the
+// ciphertext.
+var envelopeMagic = []byte("LAMPYENC")
+
+const envelopeVersion = 1
+
+var errUnknownMasterKey = errors.New("unknown master key")
+
+// initKeyWrapper loads the master keys from DOCUMENT_MASTER_KEYS
+// ("id:base64key,..." with DOCUMENT_MASTER_KEY_ID naming the current one),
+// or otherwise from the keyring file at DOCUMENT_KEYRING_FILE, which stands
+// in for a KMS in development and is created on first use. Release builds
+// never create one: a key generated on a replica's disk sits beside the
+// documents it protects and is unknown to the other replicas.
+func initKeyWrapper() {
+	if spec := os.Getenv("DOCUMENT_MASTER_KEYS"); spec != "" {
+		ring, err := parseMasterKeys(spec, os.Getenv("DOCUMENT_MASTER_KEY_ID"))
+		if err != nil {
+			log.Fatal("Invalid DOCUMENT_MASTER_KEYS: ", err)
+		}
+		keyWrapper = ring
+		return
+	}
+
+	path := getEnv("DOCUMENT_KEYRING_FILE", "keys/keyring.json")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && gin.Mode() == gin.ReleaseMode {
+		log.Fatal("DOCUMENT_MASTER_KEYS must be set with GIN_MODE=release")
+	}
+	ring, err := openKeyringFile(path)
+	if err != nil {
+		log.Fatal("Failed to load document keyring: ", err)
+	}
+	keyWrapper = ring
+}
+
+// localKeyring holds AES-256 master keys in memory. When it was loaded from
+// a file it picks up keys added to the file later, so running servers can
+// open documents re-wrapped by rotate-keys without a restart.
+type localKeyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+
+	path     string
+	loadedAt time.Time
+}
+
+type keyringFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"` // base64
+}
+
+func parseMasterKeys(spec, current string) (*localKeyring, error) {
+	ring := &localKeyring{keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("entry %q is not id:key", entry)
+		}
+		key, err := decodeMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		ring.keys[id] = key
+		ring.current = id
+	}
+	if current != "" {
+		if _, ok := ring.keys[current]; !ok {
+			return nil, fmt.Errorf("current key %s is not listed", current)
+		}
+		ring.current = current
+	}
+	return ring, nil
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("master keys must be 32 bytes")
+	}
+	return key, nil
+}
+
+func openKeyringFile(path string) (*localKeyring, error) {
+	ring := &localKeyring{path: path}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		log.Printf("creating document keyring at %s; configure DOCUMENT_MASTER_KEYS in production", path)
+		if _, err := ring.addKey(); err != nil {
+			return nil, err
+		}
+		return ring, nil
+	}
+	return ring, ring.reload()
+}
+
+// reload reads the keyring file if it changed since it was last read.
+func (r *localKeyring) reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !info.ModTime().After(r.loadedAt) {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := decodeMasterKey(encoded)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[file.Current]; !ok {
+		return fmt.Errorf("current key %s is not in the keyring", file.Current)
+	}
+
+	r.current, r.keys, r.loadedAt = file.Current, keys, info.ModTime()
+	return nil
+}
+
+// addKey generates a master key, makes it current and saves the keyring
+// file. Older keys are kept to open documents not yet re-wrapped.
+func (r *localKeyring) addKey() (string, error) {
+	if r.path == "" {
+		return "", errors.New("master keys come from DOCUMENT_MASTER_KEYS; add the new key there")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format("20060102T150405Z")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file := keyringFile{Current: id, Keys: map[string]string{id: base64.StdEncoding.EncodeToString(key)}}
+	for existing, k := range r.keys {
+		file.Keys[existing] = base64.StdEncoding.EncodeToString(k)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return "", err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return "", err
+	}
+
+	if r.keys == nil {
+		r.keys = make(map[string][]byte)
+	}
+	r.keys[id] = key
+	r.current = id
+	if info, err := os.Stat(r.path); err == nil {
+		r.loadedAt = info.ModTime()
+	}
+	return id, nil
+}
+
+func (r *localKeyring) CurrentKeyID() string {
+	if r.path != "" {
+		r.reload()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+func (r *localKeyring) WrapKey(dataKey []byte) (string, []byte, error) {
+	id := r.CurrentKeyID()
+	r.mu.RLock()
+	master := r.keys[id]
+	r.mu.RUnlock()
+
+	wrapped, err := sealAESGCM(master, dataKey, []byte(id))
+	return id, wrapped, err
+}
+
+func (r *localKeyring) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	r.mu.RLock()
+	master, ok := r.keys[keyID]
+	r.mu.RUnlock()
+	if !ok && r.path != "" {
+		if err := r.reload(); err != nil {
+			return nil, err
+		}
+		r.mu.RLock()
+		master, ok = r.keys[keyID]
+		r.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownMasterKey, keyID)
+	}
+
+	// The key ID is bound to the wrapped key, so a header cannot claim a
+	// different master key.
+	return openAESGCM(master, wrapped, []byte(keyID))
+}
+
+// sealAESGCM encrypts plaintext under key, returning the nonce followed by
+// the ciphertext.
+func sealAESGCM(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openAESGCM(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additional)
+}
+
+// envelope is a parsed encrypted blob.
+type envelope struct {
+	keyID      string
+	wrappedKey []byte
+	sealed     []byte // nonce and ciphertext of the file
+}
+
+func isEncryptedBlob(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+// encryptDocument seals data under a fresh data key, wrapped by the current
+// master key.
+func encryptDocument(data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	sealed, err := sealAESGCM(dataKey, data, envelopeMagic)
+	if err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := keyWrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return envelope{keyID: keyID, wrappedKey: wrapped, sealed: sealed}.marshal(), nil
+}
+
+// decryptDocument opens a blob written by encryptDocument. Blobs stored
+// before encryption was added are returned unchanged.
+func decryptDocument(data []byte) ([]byte, error) {
+	if !isEncryptedBlob(data) {
+		return data, nil
+	}
+
+	env, err := parseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := keyWrapper.UnwrapKey(env.keyID, env.wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openAESGCM(dataKey, env.sealed, envelopeMagic)
+}
+
+func (e envelope) marshal() []byte {
+	var b bytes.Buffer
+	b.Write(envelopeMagic)
+	b.WriteByte(envelopeVersion)
+	b.WriteByte(byte(len(e.keyID)))
+	b.WriteString(e.keyID)
+	binary.Write(&b, binary.BigEndian, uint16(len(e.wrappedKey)))
+	b.Write(e.wrappedKey)
+	b.Write(e.sealed)
+	return b.Bytes()
+}
+
+func parseEnvelope(data []byte) (envelope, error) {
+	malformed := errors.New("malformed encrypted blob")
+
+	rest := data[len(envelopeMagic):]
+	if len(rest) < 2 || rest[0] != envelopeVersion {
+		return envelope{}, malformed
+	}
+	idLen := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < idLen+2 {
+		return envelope{}, malformed
+	}
+	keyID := string(rest[:idLen])
+	rest = rest[idLen:]
+
+	wrappedLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < wrappedLen {
+		return envelope{}, malformed
+	}
+
+	return envelope{keyID: keyID, wrappedKey: rest[:wrappedLen], sealed: rest[wrappedLen:]}, nil
+}
+
+// rewrapDocument moves a blob to the current master key. Only the data key
+// is re-wrapped; the file ciphertext is unchanged. Plaintext blobs from
+// before encryption are encrypted. It reports whether anything changed.
+func rewrapDocument(data []byte) ([]byte, bool, error) {
+	if !isEncryptedBlob(data) {
+		sealed, err := encryptDocument(data)
+		return sealed, err == nil, err
+	}
+
+	env, err := parseEnvelope(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if env.keyID == keyWrapper.CurrentKeyID() {
+		return data, false, nil
+	}
+
+	dataKey, err := keyWrapper.UnwrapKey(env.keyID, env.wrappedKey)
+	if err != nil {
+		return nil, false, err
+	}
+	env.keyID, env.wrappedKey, err = keyWrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	return env.marshal(), true, nil
+}
+
+// encryptedDocumentKeys lists the blobs that hold ID documents.
+func encryptedDocumentKeys() ([]string, error) {
+	var stored []string
+	if err := db.Model(&VerificationRequest{}).Where("type = ? AND image_url <> ''", "age").
+		Distinct().Pluck("image_url", &stored).Error; err != nil {
+		return nil, err
+	}
+
+	var profiles []string
+	if err := db.Model(&User{}).Where("age_verification_photo_url <> ''").
+		Distinct().Pluck("age_verification_photo_url", &profiles).Error; err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, s := range append(stored, profiles...) {
+		key := blobKeyFromStored(s)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// rewrapStoredDocument re-wraps one stored ID document and reports whether
+// it changed. It locks the rows that reference the blob first, the rows
+// purgeVerificationDocument redacts before deleting it, so a document purged
+// while rotate-keys runs is skipped rather than written back.
+func rewrapStoredDocument(key string) (bool, error) {
+	changed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		stored := []string{key, "uploads/" + key}
+		requests := tx.Model(&VerificationRequest{}).Where("image_url IN ?", stored).
+			UpdateColumn("image_url", gorm.Expr("image_url"))
+		if requests.Error != nil {
+			return requests.Error
+		}
+		users := tx.Model(&User{}).Where("age_verification_photo_url IN ?", stored).
+			UpdateColumn("age_verification_photo_url", gorm.Expr("age_verification_photo_url"))
+		if users.Error != nil {
+			return users.Error
+		}
+		if requests.RowsAffected+users.RowsAffected == 0 {
+			return nil
+		}
+
+		data, err := blobStore.Get(key)
+		if errors.Is(err, errBlobNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if data, changed, err = rewrapDocument(data); err != nil || !changed {
+			return err
+		}
+		return blobStore.Put(key, data, "application/octet-stream")
+	})
+	return changed, err
+}
+
+// rotateKeysCommand implements "lampy-backend rotate-keys". It re-wraps
+// every ID document under the current master key, optionally generating a
+// new one first. Each blob is replaced in a single write and servers can
+// open documents under either key, so it runs alongside live servers.
+func rotateKeysCommand(args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	newKey := flags.Bool("new-key", false, "generate a new master key in the keyring file and make it current")
+	flags.Parse(args)
+
+	initDB()
+	initBlobStore()
+	initKeyWrapper()
+
+	if *newKey {
+		ring, ok := keyWrapper.(*localKeyring)
+		if !ok {
+			log.Fatal("The configured key wrapper cannot generate keys")
+		}
+		id, err := ring.addKey()
+		if err != nil {
+			log.Fatal("Failed to generate master key: ", err)
+		}
+		log.Printf("generated master key %s", id)
+	}
+
+	keys, err := encryptedDocumentKeys()
+	if err != nil {
+		log.Fatal("Failed to list documents: ", err)
+	}
+
+	var rewrapped, current, failed int
+	for _, key := range keys {
+		changed, err := rewrapStoredDocument(key)
+		switch {
+		case err != nil:
+			log.Printf("failed to re-wrap %s: %v", key, err)
+			failed++
+		case changed:
+			rewrapped++
+		default:
+			current++
+		}
+	}
+
+	log.Printf("rotate-keys: %d re-wrapped, %d already under %s, %d failed", rewrapped, current, keyWrapper.CurrentKeyID(), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMasterKey returns a 32-byte master key filled with b, base64 encoded.
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// useTestKeyring installs a keyring holding the master keys "old" and
+// "new", with current as the current key.
+func useTestKeyring(t *testing.T, current string) *localKeyring {
+	t.Helper()
+	ring, err := parseMasterKeys("old:"+testMasterKey(1)+",new:"+testMasterKey(2), current)
+	if err != nil {
+		t.Fatalf("parseMasterKeys() error = %v", err)
+	}
+	previous := keyWrapper
+	keyWrapper = ring
+	t.Cleanup(func() { keyWrapper = previous })
+	return ring
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		current     string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{"single key", "a:" + testMasterKey(1), "", "a", false},
+		{"last key is current", "a:" + testMasterKey(1) + ", b:" + testMasterKey(2), "", "b", false},
+		{"named current", "a:" + testMasterKey(1) + ",b:" + testMasterKey(2), "a", "a", false},
+		{"current not listed", "a:" + testMasterKey(1), "b", "", true},
+		{"missing id", ":" + testMasterKey(1), "", "", true},
+		{"no separator", testMasterKey(1), "", "", true},
+		{"short key", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), "", "", true},
+		{"not base64", "a:not base64!", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := parseMasterKeys(tt.spec, tt.current)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMasterKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && ring.CurrentKeyID() != tt.wantCurrent {
+				t.Errorf("current key = %q, want %q", ring.CurrentKeyID(), tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestEncryptDocument(t *testing.T) {
+	useTestKeyring(t, "new")
+	plaintext := []byte("passport scan")
+
+	sealed, err := encryptDocument(plaintext)
+	if err != nil {
+		t.Fatalf("encryptDocument() error = %v", err)
+	}
+	if !isEncryptedBlob(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Fatalf("sealed blob is not an envelope or contains the plaintext")
+	}
+	if again, _ := encryptDocument(plaintext); bytes.Equal(again, sealed) {
+		t.Error("encrypting twice gave the same blob")
+	}
+
+	flip := func(offset int) []byte {
+		tampered := bytes.Clone(sealed)
+		tampered[offset] ^= 1
+		return tampered
+	}
+	env, _ := parseEnvelope(sealed)
+	headerLen := len(sealed) - len(env.sealed)
+	anyErr := errors.New("any error")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr error
+	}{
+		{"round trip", sealed, plaintext, nil},
+		{"plaintext from before encryption", []byte("legacy scan"), []byte("legacy scan"), nil},
+		{"tampered ciphertext", flip(len(sealed) - 1), nil, anyErr},
+		{"tampered wrapped key", flip(headerLen - 1), nil, anyErr},
+		{"key id swapped", bytes.Replace(sealed, []byte("new"), []byte("old"), 1), nil, anyErr},
+		{"unknown key id", bytes.Replace(sealed, []byte("new"), []byte("xyz"), 1), nil, errUnknownMasterKey},
+		{"unknown version", flip(len(envelopeMagic)), nil, anyErr},
+		{"truncated header", sealed[:len(envelopeMagic)+3], nil, anyErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptDocument(tt.data)
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("decryptDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(tt.wantErr, errUnknownMasterKey) && !errors.Is(err, errUnknownMasterKey) {
+				t.Errorf("decryptDocument() error = %v, want errUnknownMasterKey", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decryptDocument() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewrapDocument(t *testing.T) {
+	ring := useTestKeyring(t, "old")
+	plaintext := []byte("passport scan")
+	underOld, _ := encryptDocument(plaintext)
+	ring.current = "new"
+	underNew, _ := encryptDocument(plaintext)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantChanged bool
+	}{
+		{"old key", underOld, true},
+		{"current key", underNew, false},
+		{"plaintext", plaintext, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := rewrapDocument(tt.data)
+			if err != nil || changed != tt.wantChanged {
+				t.Fatalf("rewrapDocument() changed = %v, error = %v; want changed %v", changed, err, tt.wantChanged)
+			}
+			env, err := parseEnvelope(got)
+			if err != nil || env.keyID != "new" {
+				t.Fatalf("rewrapped blob is under %q, %v; want new", env.keyID, err)
+			}
+			if opened, err := decryptDocument(got); err != nil || !bytes.Equal(opened, plaintext) {
+				t.Errorf("decryptDocument() = %q, %v", opened, err)
+			}
+		})
+	}
+
+	// Re-wrapping replaces the header only.
+	oldEnv, _ := parseEnvelope(underOld)
+	rewrapped, _, _ := rewrapDocument(underOld)
+	if !bytes.HasSuffix(rewrapped, oldEnv.sealed) {
+		t.Error("re-wrapping changed the file ciphertext")
+	}
+}
+
+func TestRewrapStoredDocument(t *testing.T) {
+	setupTestDB(t)
+	ring := useTestKeyring(t, "old")
+	user := createTestUser(t, "user@example.com", RoleUser)
+
+	stored := func(name string) string {
+		key, err := storeUpload("age_verification", []byte(name), ContentJPEG, true)
+		if err != nil {
+			t.Fatalf("storeUpload() error = %v", err)
+		}
+		return key
+	}
+	onRequest := stored("on a request")
+	legacyPath := stored("legacy path")
+	onProfile := stored("on the profile")
+	purged := stored("purged")
+
+	db.Create(&VerificationRequest{UserID: user.ID, Type: "age", Status: "pending", ImageURL: onRequest})
+	db.Create(&VerificationRequest{UserID: user.ID, Type: "age", Status: "pending", ImageURL: "uploads/" + legacyPath})
+	db.Model(&user).Update("age_verification_photo_url", onProfile)
+	ring.current = "new"
+
+	tests := []struct {
+		name        string
+		key         string
+		wantChanged bool
+		wantKeyID   string
+	}{
+		{"request", onRequest, true, "new"},
+		{"legacy path", legacyPath, true, "new"},
+		{"profile", onProfile, true, "new"},
+		{"no longer referenced", purged, false, "old"},
+		{"missing blob", "age_verification/missing", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := rewrapStoredDocument(tt.key)
+			if err != nil || changed != tt.wantChanged {
+				t.Fatalf("rewrapStoredDocument() = %v, %v; want %v", changed, err, tt.wantChanged)
+			}
+			if tt.wantKeyID == "" {
+				return
+			}
+			data, _ := blobStore.Get(tt.key)
+			if env, _ := parseEnvelope(data); env.keyID != tt.wantKeyID {
+				t.Errorf("blob is under %q, want %q", env.keyID, tt.wantKeyID)
+			}
+		})
+	}
+
+	if again, err := rewrapStoredDocument(onRequest); again || err != nil {
+		t.Errorf("second rewrapStoredDocument() = %v, %v; want no change", again, err)
+	}
+
+	keys, _ := encryptedDocumentKeys()
+	if len(keys) != 3 {
+		t.Errorf("encryptedDocumentKeys() = %v, want the three referenced documents", keys)
+	}
+}
+
+func TestKeyringFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "keyring.json")
+	ring, err := openKeyringFile(path)
+	if err != nil {
+		t.Fatalf("openKeyringFile() error = %v", err)
+	}
+
+	// A second server reads the same file.
+	server, err := openKeyringFile(path)
+	if err != nil || server.CurrentKeyID() != ring.CurrentKeyID() {
+		t.Fatalf("reopened keyring current = %q, %v; want %q", server.CurrentKeyID(), err, ring.CurrentKeyID())
+	}
+
+	// Key IDs have second resolution, so rename the first key to keep the
+	// one added below distinct.
+	ring.keys = map[string][]byte{"initial": ring.keys[ring.current]}
+	ring.current = "initial"
+	previous := keyWrapper
+	keyWrapper = ring
+	t.Cleanup(func() { keyWrapper = previous })
+	sealed, _ := encryptDocument([]byte("passport scan"))
+
+	time.Sleep(10 * time.Millisecond)
+	added, err := ring.addKey()
+	if err != nil || added == "initial" {
+		t.Fatalf("addKey() = %q, %v", added, err)
+	}
+	if server.CurrentKeyID() != added {
+		t.Errorf("server current key = %q, want %q after reload", server.CurrentKeyID(), added)
+	}
+
+	keyWrapper = server
+	if opened, err := decryptDocument(sealed); err != nil || string(opened) != "passport scan" {
+		t.Errorf("document under the previous key = %q, %v", opened, err)
+	}
+
+	env, _ := parseMasterKeys("a:"+testMasterKey(1), "")
+	if _, err := env.addKey(); err == nil {
+		t.Error("addKey() on keys from DOCUMENT_MASTER_KEYS succeeded")
+	}
+}
+
+func TestStoreUploadEncrypted(t *testing.T) {
+	setupTestDB(t)
+	useTestKeyring(t, "new")
+	data := []byte("passport scan")
+
+	first, err := storeUpload("age_verification", data, ContentJPEG, true)
+	if err != nil {
+		t.Fatalf("storeUpload() error = %v", err)
+	}
+	second, _ := storeUpload("age_verification", data, ContentJPEG, true)
+	if first == second || strings.Contains(first, sha256Hex(data)) {
+		t.Errorf("encrypted uploads stored as %q and %q, want random keys", first, second)
+	}
+
+	stored, _ := blobStore.Get(first)
+	if bytes.Contains(stored, data) || !isEncryptedBlob(stored) {
+		t.Fatalf("stored blob is not encrypted")
+	}
+
+	w := serveTest(serveFile, http.MethodGet, fileRoute, signFileURL(first, time.Now()).URL, nil, 0, "")
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Errorf("serveFile() = %d %q, want the decrypted document", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// fileURLSecret signs file URLs. Without FILE_URL_SECRET it is derived from
+// the JWT secret under its own label, so the two uses never share a key.
+var (
+	fileURLSecret = getEnv("FILE_URL_SECRET", deriveSecret(jwtSecret, "lampy file url signing"))
+	fileURLTTL    = time.Duration(getEnvInt("FILE_URL_TTL_SECONDS", 300)) * time.Second
+)
+
+// profilePhotoWindow is how long a profile photo URL stays the same. URLs
+// issued within one window share an expiry, so browsers can cache the photo
+// instead of refetching it under a new signature on every page.
+const profilePhotoWindow = 24 * time.Hour
+
+type FileURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type AssignReviewerRequest struct {
+	ReviewerID uint `json:"reviewer_id" binding:"required"`
+}
+
+// blobKeyFromStored turns a stored file reference into a blob key. Uploads
+// made before the blob store kept their local path, e.g.
+// "uploads/profiles/profile_1_...".
+func blobKeyFromStored(stored string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(stored, "/"), "uploads/")
+}
+
+// validBlobKey reports whether key is already in canonical form. Keys are
+// checked as given, so "profiles/../age_verification/..." cannot pass as a
+// profile photo and then be cleaned into another file by the store.
+func validBlobKey(key string) bool {
+	return key != "" && path.Clean(key) == key && !path.IsAbs(key) &&
+		!strings.Contains(key, "..") && !strings.Contains(key, "\\")
+}
+
+func isProfilePhoto(key string) bool {
+	return strings.HasPrefix(key, profilePhotoUpload.Prefix+"/")
+}
+
+// signFileURL returns a URL for the file that works without a token until
+// it expires.
+func signFileURL(key string, now time.Time) FileURLResponse {
+	expires := now.Add(fileURLTTL)
+	if isProfilePhoto(key) {
+		expires = now.Truncate(profilePhotoWindow).Add(2 * profilePhotoWindow)
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", fileSignature(key, expires.Unix()))
+
+	return FileURLResponse{
+		URL:       "/api/v1/files/raw/" + key + "?" + query.Encode(),
+		ExpiresAt: expires,
+	}
+}
+
+// deriveSecret derives an independent key for one purpose from secret with
+// HKDF-SHA256.
+func deriveSecret(secret []byte, label string) string {
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), derived); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(derived)
+}
+
+func fileSignature(key string, expires int64) string {
+	return signHMAC([]byte(fmt.Sprintf("%s\n%d", key, expires)), fileURLSecret)
+}
+
+// canAccessFile reports whether the user may see the file. Profile photos
+// are visible to every signed-in user. Verification photos and ID documents
+// are visible to their owner, the reviewer assigned to them and admins.
+func canAccessFile(userID uint, role, key string) bool {
+	if isProfilePhoto(key) {
+		return true
+	}
+	if hasPermission(role, PermVerificationAssign) {
+		return true
+	}
+
+	stored := []string{key, "uploads/" + key}
+	var owned int64
+	db.Model(&VerificationRequest{}).Where("image_url IN ? AND user_id = ?", stored, userID).Count(&owned)
+	if owned > 0 {
+		return true
+	}
+
+	if !hasPermission(role, PermVerificationReview) {
+		return false
+	}
+	var assigned int64
+	db.Model(&VerificationRequest{}).Where("image_url IN ? AND reviewer_id = ?", stored, userID).Count(&assigned)
+	return assigned > 0
+}
+
+// File handlers
+// getFileURL issues a signed URL for a stored file the caller may see.
+func getFileURL(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	key := blobKeyFromStored(c.Query("key"))
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "key is required"})
+		return
+	}
+	if !validBlobKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key"})
+		return
+	}
+
+	// Unknown and forbidden files get the same answer, so keys cannot be
+	// probed.
+	if !canAccessFile(userID, c.GetString("role"), key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, signFileURL(key, time.Now()))
+}
+
+// serveFile returns a file to anyone holding a valid signed URL for it.
+func serveFile(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !validBlobKey(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || !validHMAC([]byte(fmt.Sprintf("%s\n%d", key, expires)), c.Query("sig"), fileURLSecret) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid file signature"})
+		return
+	}
+	remaining := time.Until(time.Unix(expires, 0))
+	if remaining <= 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "File link has expired"})
+		return
+	}
+
+	// Keys are content hashes, so a key always names the same bytes.
+	etag := `"` + key[strings.LastIndex(key, "/")+1:] + `"`
+	c.Header("X-Content-Type-Options", "nosniff")
+	if isProfilePhoto(key) {
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d, immutable", int(remaining.Seconds())))
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	} else {
+		c.Header("Cache-Control", "no-store")
+	}
+
+	data, err := blobStore.Get(key)
+	if errors.Is(err, errBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err == nil {
+		data, err = decryptDocument(data)
+	}
+	if err != nil {
+		log.Printf("failed to read blob %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	contentType := sniffContentType(data)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", "inline")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// Admin handlers
+// assignVerificationReviewer gives a reviewer access to a request's files.
+func assignVerificationReviewer(c *gin.Context) {
+	var request VerificationRequest
+	if err := db.First(&request, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Verification request not found"})
+		return
+	}
+
+	var req AssignReviewerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var reviewer User
+	if err := db.First(&reviewer, req.ReviewerID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reviewer not found"})
+		return
+	}
+	if !hasPermission(reviewer.Role, PermVerificationReview) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User cannot review verifications"})
+		return
+	}
+
+	if err := db.Model(&request).Update("reviewer_id", reviewer.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign reviewer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const fileRoute = "/api/v1/files/raw/*key"
+
+func TestValidBlobKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"profiles/abc123", true},
+		{"verification/abc123", true},
+		{"", false},
+		{"/profiles/abc123", false},
+		{"profiles/../age_verification/abc123", false},
+		{"profiles/./abc123", false},
+		{"profiles//abc123", false},
+		{"profiles/abc123/", false},
+		{"../etc/passwd", false},
+		{"profiles/a..b", false},
+		{`profiles\abc123`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := validBlobKey(tt.key); got != tt.want {
+				t.Errorf("validBlobKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobKeyFromStored(t *testing.T) {
+	tests := []struct {
+		stored, want string
+	}{
+		{"profiles/abc", "profiles/abc"},
+		{"uploads/profiles/profile_1.jpg", "profiles/profile_1.jpg"},
+		{"/uploads/verification/v_1.jpg", "verification/v_1.jpg"},
+	}
+
+	for _, tt := range tests {
+		if got := blobKeyFromStored(tt.stored); got != tt.want {
+			t.Errorf("blobKeyFromStored(%q) = %q, want %q", tt.stored, got, tt.want)
+		}
+	}
+}
+
+func TestCanAccessFile(t *testing.T) {
+	setupTestDB(t)
+	owner := createTestUser(t, "owner@example.com", RoleUser)
+	stranger := createTestUser(t, "stranger@example.com", RoleUser)
+	assigned := createTestUser(t, "assigned@example.com", RoleReviewer)
+	unassigned := createTestUser(t, "unassigned@example.com", RoleReviewer)
+	admin := createTestUser(t, "admin@example.com", RoleAdmin)
+
+	db.Create(&VerificationRequest{UserID: owner.ID, Type: "age", Status: "pending", ImageURL: "age_verification/doc", ReviewerID: &assigned.ID})
+	db.Create(&VerificationRequest{UserID: owner.ID, Type: "photo", Status: "pending", ImageURL: "uploads/verification/legacy.jpg"})
+	// A reviewer_id on a user without review rights grants nothing.
+	db.Create(&VerificationRequest{UserID: owner.ID, Type: "photo", Status: "pending", ImageURL: "verification/other", ReviewerID: &stranger.ID})
+
+	tests := []struct {
+		name string
+		user User
+		key  string
+		want bool
+	}{
+		{"profile photo, any user", stranger, "profiles/abc", true},
+		{"owner", owner, "age_verification/doc", true},
+		{"owner, legacy path", owner, "verification/legacy.jpg", true},
+		{"stranger", stranger, "age_verification/doc", false},
+		{"assigned reviewer", assigned, "age_verification/doc", true},
+		{"unassigned reviewer", unassigned, "age_verification/doc", false},
+		{"admin", admin, "age_verification/doc", true},
+		{"reviewer id on a plain user", stranger, "verification/other", false},
+		{"unknown file", owner, "verification/unknown", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canAccessFile(tt.user.ID, tt.user.Role, tt.key); got != tt.want {
+				t.Errorf("canAccessFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFileURL(t *testing.T) {
+	setupTestDB(t)
+	owner := createTestUser(t, "owner@example.com", RoleUser)
+	stranger := createTestUser(t, "stranger@example.com", RoleUser)
+	db.Create(&VerificationRequest{UserID: owner.ID, Type: "photo", Status: "pending", ImageURL: "verification/abc"})
+
+	tests := []struct {
+		name string
+		user User
+		key  string
+		want int
+	}{
+		{"owner", owner, "verification/abc", http.StatusOK},
+		{"legacy form of the key", owner, "uploads/verification/abc", http.StatusOK},
+		{"stranger", stranger, "verification/abc", http.StatusNotFound},
+		{"traversal", owner, "profiles/../verification/abc", http.StatusBadRequest},
+		{"missing", owner, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(getFileURL, http.MethodGet, "/files/url", "/files/url?key="+tt.key, nil, tt.user.ID, tt.user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK {
+				var resp FileURLResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				if !strings.HasPrefix(resp.URL, "/api/v1/files/raw/verification/abc?") {
+					t.Errorf("url = %q", resp.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	setupTestDB(t)
+	photo := pngBytes(2, 2)
+	blobStore.Put("profiles/photo", photo, ContentPNG)
+	blobStore.Put("verification/doc", pdfBytes, ContentPDF)
+
+	now := time.Now()
+	tests := []struct {
+		name      string
+		target    string
+		want      int
+		wantCache string
+	}{
+		{"profile photo", signFileURL("profiles/photo", now).URL, http.StatusOK, "immutable"},
+		{"document", signFileURL("verification/doc", now).URL, http.StatusOK, "no-store"},
+		{"expired", signFileURL("verification/doc", now.Add(-2*fileURLTTL)).URL, http.StatusGone, ""},
+		{"signature for another file", strings.Replace(signFileURL("profiles/photo", now).URL, "profiles/photo", "verification/doc", 1), http.StatusForbidden, ""},
+		{"extended expiry", extendExpiry(signFileURL("verification/doc", now).URL), http.StatusForbidden, ""},
+		{"no signature", "/api/v1/files/raw/verification/doc", http.StatusForbidden, ""},
+		{"missing blob", signFileURL("verification/gone", now).URL, http.StatusNotFound, ""},
+		{"traversal", "/api/v1/files/raw/profiles/../verification/doc?expires=1&sig=00", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(serveFile, http.MethodGet, fileRoute, tt.target, nil, 0, "")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if !strings.Contains(w.Header().Get("Cache-Control"), tt.wantCache) || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("headers = %v", w.Header())
+			}
+		})
+	}
+}
+
+// extendExpiry pushes a signed URL's expiry a day later without re-signing.
+func extendExpiry(target string) string {
+	before, after, _ := strings.Cut(target, "expires=")
+	expires, rest, _ := strings.Cut(after, "&")
+	var unix int64
+	fmt.Sscan(expires, &unix)
+	return fmt.Sprintf("%sexpires=%d&%s", before, unix+86400, rest)
+}
+
+func TestServeProfilePhotoRevalidation(t *testing.T) {
+	setupTestDB(t)
+	blobStore.Put("profiles/photo", pngBytes(2, 2), ContentPNG)
+	target := signFileURL("profiles/photo", time.Now()).URL
+
+	r := serveTest(serveFile, http.MethodGet, fileRoute, target, nil, 0, "")
+	etag := r.Header().Get("ETag")
+	if etag != `"photo"` {
+		t.Fatalf("ETag = %q", etag)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	router := gin.New()
+	router.GET(fileRoute, serveFile)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation status = %d with %d bytes, want 304 and no body", w.Code, w.Body.Len())
+	}
+}
+
+func TestSignFileURLExpiry(t *testing.T) {
+	morning := time.Date(2030, 7, 1, 8, 0, 0, 0, time.UTC)
+	evening := morning.Add(10 * time.Hour)
+
+	if a, b := signFileURL("profiles/photo", morning), signFileURL("profiles/photo", evening); a.URL != b.URL {
+		t.Errorf("profile photo URLs differ within a day: %s and %s", a.URL, b.URL)
+	}
+	if a, b := signFileURL("verification/doc", morning), signFileURL("verification/doc", evening); a.URL == b.URL {
+		t.Error("document URLs are reused across requests")
+	}
+	if got := signFileURL("verification/doc", morning).ExpiresAt; !got.Equal(morning.Add(fileURLTTL)) {
+		t.Errorf("document URL expires at %s, want %s", got, morning.Add(fileURLTTL))
+	}
+	if got := signFileURL("profiles/photo", evening).ExpiresAt; got.Sub(evening) < profilePhotoWindow {
+		t.Errorf("profile photo URL expires at %s, less than a window after it was issued", got)
+	}
+}
+
+func TestUserJSONOmitsVerificationKeys(t *testing.T) {
+	user := User{
+		Email:                   "user@example.com",
+		ProfilePhotoURL:         "profiles/abc",
+		VerificationPhotoURL:    "verification/secret",
+		AgeVerificationPhotoURL: "age_verification/secret",
+		CalendarToken:           "calendar-secret",
+	}
+	data, _ := json.Marshal(user)
+	for _, secret := range []string{"verification/secret", "age_verification/secret", "calendar-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("user JSON exposes %q: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), "profiles/abc") {
+		t.Errorf("user JSON lacks the profile photo: %s", data)
+	}
+}
+
+func TestAssignVerificationReviewer(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		want int
+	}{
+		{"reviewer", RoleReviewer, http.StatusOK},
+		{"admin", RoleAdmin, http.StatusOK},
+		{"plain user", RoleUser, http.StatusBadRequest},
+		{"counsellor", RoleCounsellor, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "admin@example.com", RoleAdmin)
+			owner := createTestUser(t, "owner@example.com", RoleUser)
+			candidate := createTestUser(t, "candidate@example.com", tt.role)
+			request := VerificationRequest{UserID: owner.ID, Type: "age", Status: "pending", ImageURL: "age_verification/doc"}
+			db.Create(&request)
+
+			w := serveTest(assignVerificationReviewer, http.MethodPut, "/verifications/:id/reviewer", fmt.Sprintf("/verifications/%d/reviewer", request.ID),
+				AssignReviewerRequest{ReviewerID: candidate.ID}, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if got := canAccessFile(candidate.ID, candidate.Role, request.ImageURL); got != (tt.want == http.StatusOK) {
+				t.Errorf("candidate can access the document = %v", got)
+			}
+		})
+	}
+}
+
+func TestDecideVerification(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string // "assigned", "other" or "admin"
+		status string
+		action string
+		want   int
+	}{
+		{"assigned reviewer approves", "assigned", "pending", "approve", http.StatusOK},
+		{"assigned reviewer rejects", "assigned", "pending", "reject", http.StatusOK},
+		{"other reviewer approves", "other", "pending", "approve", http.StatusForbidden},
+		{"other reviewer rejects", "other", "pending", "reject", http.StatusForbidden},
+		{"admin approves", "admin", "pending", "approve", http.StatusOK},
+		{"approve again", "assigned", "approved", "approve", http.StatusConflict},
+		{"reject after approval", "admin", "approved", "reject", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			owner := createTestUser(t, "owner@example.com", RoleUser)
+			callers := map[string]User{
+				"assigned": createTestUser(t, "assigned@example.com", RoleReviewer),
+				"other":    createTestUser(t, "other@example.com", RoleReviewer),
+				"admin":    createTestUser(t, "admin@example.com", RoleAdmin),
+			}
+			assigned := callers["assigned"].ID
+			reviewedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+			request := VerificationRequest{UserID: owner.ID, Type: "age", Status: tt.status, ImageURL: "age_verification/doc", ReviewerID: &assigned}
+			if tt.status != "pending" {
+				request.ReviewedAt = &reviewedAt
+			}
+			db.Create(&request)
+
+			caller := callers[tt.caller]
+			route := "/verifications/:id/" + tt.action
+			target := fmt.Sprintf("/verifications/%d/%s", request.ID, tt.action)
+			handler, body := approveVerification, any(nil)
+			if tt.action == "reject" {
+				handler, body = rejectVerification, map[string]string{"reason": "Unreadable"}
+			}
+			w := serveTest(handler, http.MethodPost, route, target, body, caller.ID, caller.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var stored VerificationRequest
+			db.First(&stored, request.ID)
+			if tt.want != http.StatusOK {
+				if stored.Status != tt.status || (stored.ReviewedAt != nil && !stored.ReviewedAt.Equal(reviewedAt)) {
+					t.Errorf("refused decision changed the request: status %q, reviewed_at %v", stored.Status, stored.ReviewedAt)
+				}
+				return
+			}
+			wantStatus := map[string]string{"approve": "approved", "reject": "rejected"}[tt.action]
+			if stored.Status != wantStatus || stored.ReviewedAt == nil {
+				t.Errorf("request = %+v, want it %s with reviewed_at set", stored, wantStatus)
+			}
+		})
+	}
+}
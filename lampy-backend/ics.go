@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const icsTimeFormat = "20060102T150405Z"
+
+// feedSessionStatuses are the statuses published in calendar feeds.
+// Cancelled sessions are kept so subscribed calendars remove the event.
+var feedSessionStatuses = []string{
+	SessionConfirmed, SessionInProgress, SessionCompleted,
+	SessionCancelledByUser, SessionCancelledByCounsellor, SessionCancelled,
+}
+
+// Session handlers
+func getSessionICS(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+	sessionID := c.Param("id")
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", sessionID, userID).
+		Preload("User").
+		Preload("Counsellor").
+		First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	method := "PUBLISH"
+	if isCancelledStatus(session.Status) {
+		method = "CANCEL"
+	}
+
+	body := renderCalendar(method, []Session{session}, sessionSequences([]uint{session.ID}))
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="lampy-session-%d.ics"`, session.ID))
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(body))
+}
+
+// User handlers
+func getCalendarFeed(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.CalendarToken == "" {
+		user.CalendarToken = generateRandomString(40)
+		if err := db.Model(&user).Update("calendar_token", user.CalendarToken).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create calendar feed"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": calendarFeedURL(user.CalendarToken)})
+}
+
+// rotateCalendarFeed invalidates the old feed URL, e.g. after it was shared
+// by mistake.
+func rotateCalendarFeed(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	token := generateRandomString(40)
+	if err := db.Model(&User{}).Where("id = ?", userID).Update("calendar_token", token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate calendar feed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": calendarFeedURL(token)})
+}
+
+// Calendar feed handler. The secret token in the URL is the only credential,
+// since calendar apps cannot send an Authorization header.
+func serveCalendarFeed(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+	var user User
+	if token == "" || db.Where("calendar_token = ?", token).First(&user).Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return
+	}
+
+	// Counsellors also see the sessions booked with them.
+	query := db.Where("user_id = ?", user.ID)
+	var counsellor Counsellor
+	if db.Where("user_id = ?", user.ID).First(&counsellor).Error == nil {
+		query = db.Where("user_id = ? OR counsellor_id = ?", user.ID, counsellor.ID)
+	}
+
+	var sessions []Session
+	if err := query.Where("status IN ?", feedSessionStatuses).
+		Preload("User").
+		Preload("Counsellor").
+		Order("session_date").
+		Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load calendar"})
+		return
+	}
+
+	ids := make([]uint, 0, len(sessions))
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+	}
+
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(renderCalendar("PUBLISH", sessions, sessionSequences(ids))))
+}
+
+func calendarFeedURL(token string) string {
+	return getEnv("API_BASE_URL", "http://localhost:8080") + "/api/v1/calendar/" + token + ".ics"
+}
+
+// sessionSequences returns the iCalendar SEQUENCE for each session: the
+// number of recorded changes, so every reschedule or status change
+// supersedes the copy a calendar already has.
+func sessionSequences(ids []uint) map[uint]int {
+	sequences := make(map[uint]int, len(ids))
+	if len(ids) == 0 {
+		return sequences
+	}
+
+	var rows []struct {
+		SessionID uint
+		Changes   int
+	}
+	db.Model(&SessionHistory{}).
+		Select("session_id, COUNT(*) AS changes").
+		Where("session_id IN ?", ids).
+		Group("session_id").
+		Scan(&rows)
+
+	for _, row := range rows {
+		sequences[row.SessionID] = row.Changes
+	}
+	return sequences
+}
+
+func isCancelledStatus(status string) bool {
+	return status == SessionCancelledByUser || status == SessionCancelledByCounsellor || status == SessionCancelled
+}
+
+// renderCalendar builds an RFC 5545 VCALENDAR containing one VEVENT per
+// session.
+func renderCalendar(method string, sessions []Session, sequences map[uint]int) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//LAMPY//Sessions//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:" + method,
+		"X-WR-CALNAME:LAMPY sessions",
+	}
+
+	for _, s := range sessions {
+		status := "CONFIRMED"
+		switch {
+		case isCancelledStatus(s.Status):
+			status = "CANCELLED"
+		case s.Status == SessionPending || s.Status == SessionPendingPayment:
+			// Awaiting the counsellor or the payment
+			status = "TENTATIVE"
+		}
+
+		end := s.SessionDate.Add(time.Duration(s.Duration) * time.Minute)
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:session-%d@lampy.app", s.ID),
+			"DTSTAMP:"+s.UpdatedAt.UTC().Format(icsTimeFormat),
+			"DTSTART:"+s.SessionDate.UTC().Format(icsTimeFormat),
+			"DTEND:"+end.UTC().Format(icsTimeFormat),
+			fmt.Sprintf("SEQUENCE:%d", sequences[s.ID]),
+			"STATUS:"+status,
+			"SUMMARY:"+escapeICSText(fmt.Sprintf("Counselling session: %s with %s", s.User.Name, s.Counsellor.Name)),
+			"DESCRIPTION:"+escapeICSText(fmt.Sprintf("%d minute %s session on LAMPY.", s.Duration, s.Counsellor.Role)),
+			"END:VEVENT",
+		)
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(foldICSLine(line))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+func escapeICSText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// foldICSLine splits lines longer than 75 octets as required by RFC 5545,
+// without breaking UTF-8 sequences.
+func foldICSLine(line string) string {
+	const limit = 75
+	if len(line) <= limit {
+		return line
+	}
+
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
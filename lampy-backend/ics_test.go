@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestEscapeICSText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"a, b; c", `a\, b\; c`},
+		{`back\slash`, `back\\slash`},
+		{"two\nlines", `two\nlines`},
+		{"crlf\r\nline", `crlf\nline`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := escapeICSText(tt.in); got != tt.want {
+				t.Errorf("escapeICSText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldICSLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"short", "SUMMARY:hello"},
+		{"exactly the limit", "X:" + strings.Repeat("a", 73)},
+		{"long ascii", "DESCRIPTION:" + strings.Repeat("abcdefghij", 20)},
+		{"long multibyte", "SUMMARY:" + strings.Repeat("₹ दिल्ली ", 20)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folded := foldICSLine(tt.line)
+			parts := strings.Split(folded, "\r\n")
+			for i, part := range parts {
+				if len(part) > 75 {
+					t.Errorf("line %d is %d octets", i, len(part))
+				}
+				if i > 0 && !strings.HasPrefix(part, " ") {
+					t.Errorf("continuation %d does not start with a space", i)
+				}
+				if !utf8.ValidString(part) {
+					t.Errorf("line %d splits a UTF-8 sequence", i)
+				}
+			}
+			if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != tt.line {
+				t.Errorf("unfolding gives %q, want %q", unfolded, tt.line)
+			}
+		})
+	}
+}
+
+func TestRenderCalendar(t *testing.T) {
+	start := time.Date(2030, 7, 1, 10, 0, 0, 0, time.FixedZone("IST", 5*3600+1800))
+
+	tests := []struct {
+		name       string
+		status     string
+		wantStatus string
+	}{
+		{"confirmed", SessionConfirmed, "STATUS:CONFIRMED"},
+		{"awaiting the counsellor", SessionPending, "STATUS:TENTATIVE"},
+		{"awaiting payment", SessionPendingPayment, "STATUS:TENTATIVE"},
+		{"in progress", SessionInProgress, "STATUS:CONFIRMED"},
+		{"cancelled by user", SessionCancelledByUser, "STATUS:CANCELLED"},
+		{"cancelled by counsellor", SessionCancelledByCounsellor, "STATUS:CANCELLED"},
+		{"legacy cancellation", SessionCancelled, "STATUS:CANCELLED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := Session{
+				ID: 7, SessionDate: start, Duration: 50, Status: tt.status,
+				User:       User{Name: "Asha"},
+				Counsellor: Counsellor{Name: "Dr Rao, PhD", Role: "Psychologist"},
+			}
+			ics := renderCalendar("PUBLISH", []Session{session}, map[uint]int{7: 3})
+
+			for _, want := range []string{
+				"BEGIN:VCALENDAR\r\n",
+				"UID:session-7@lampy.app\r\n",
+				"DTSTART:20300701T043000Z\r\n",
+				"DTEND:20300701T052000Z\r\n",
+				"SEQUENCE:3\r\n",
+				tt.wantStatus + "\r\n",
+				`Dr Rao\, PhD`,
+				"END:VCALENDAR\r\n",
+			} {
+				if !strings.Contains(ics, want) {
+					t.Errorf("calendar is missing %q:\n%s", want, ics)
+				}
+			}
+		})
+	}
+}
+
+func TestServeCalendarFeed(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Feed", nil)
+	db.Model(&user).Update("calendar_token", "secret-token")
+
+	start := time.Now().Add(48 * time.Hour)
+	confirmed := createTestSession(t, user, counsellor, start, SessionConfirmed)
+	cancelled := createTestSession(t, user, counsellor, start.Add(2*time.Hour), SessionCancelledByCounsellor)
+	unpaid := createTestSession(t, user, counsellor, start.Add(4*time.Hour), SessionPendingPayment)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+		has   []uint
+		lacks []uint
+	}{
+		{"valid token", "secret-token.ics", http.StatusOK, []uint{confirmed.ID, cancelled.ID}, []uint{unpaid.ID}},
+		{"unknown token", "guess.ics", http.StatusNotFound, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(serveCalendarFeed, http.MethodGet, "/calendar/:token", "/calendar/"+tt.token, nil, 0, "")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			for _, id := range tt.has {
+				if !strings.Contains(w.Body.String(), fmt.Sprintf("UID:session-%d@", id)) {
+					t.Errorf("feed is missing session %d", id)
+				}
+			}
+			for _, id := range tt.lacks {
+				if strings.Contains(w.Body.String(), fmt.Sprintf("UID:session-%d@", id)) {
+					t.Errorf("feed includes session %d", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Seller details printed on every invoice. Address lines are separated by
+// a literal \n in INVOICE_SELLER_ADDRESS.
+var (
+	invoicePrefix        = getEnv("INVOICE_PREFIX", "LAMPY-")
+	invoiceDir           = getEnv("INVOICE_DIR", "invoices")
+	invoiceSellerName    = getEnv("INVOICE_SELLER_NAME", "LAMPY")
+	invoiceSellerAddress = getEnv("INVOICE_SELLER_ADDRESS", "")
+	invoiceSellerGSTIN   = getEnv("INVOICE_SELLER_GSTIN", "")
+)
+
+// invoiceTaxRates are the taxes included in session prices, configured as
+// INVOICE_TAX_LINES="CGST:9,SGST:9". Rates are in basis points.
+var invoiceTaxRates = parseTaxRates(getEnv("INVOICE_TAX_LINES", "CGST:9,SGST:9"))
+
+type taxRate struct {
+	name        string
+	basisPoints int64
+}
+
+// Invoice is a numbered receipt for one paid session. Party and session
+// details are copied in when it is issued, and refreshed when an admin
+// regenerates it; the number and amounts never change.
+type Invoice struct {
+	ID              uint             `json:"id" gorm:"primaryKey"`
+	Number          string           `json:"number" gorm:"uniqueIndex;not null"`
+	Sequence        int              `json:"-" gorm:"uniqueIndex;not null"`
+	SessionID       uint             `json:"session_id" gorm:"uniqueIndex;not null"`
+	PaymentIntentID uint             `json:"payment_intent_id"`
+	UserID          uint             `json:"user_id" gorm:"index"`
+	CounsellorID    uint             `json:"counsellor_id"`
+	BilledToName    string           `json:"billed_to_name"`
+	BilledToEmail   string           `json:"billed_to_email"`
+	CounsellorName  string           `json:"counsellor_name"`
+	Qualification   string           `json:"qualification"`
+	Registration    string           `json:"registration"` // e.g. "RCI A12345"
+	SessionDate     time.Time        `json:"session_date"`
+	Duration        int              `json:"duration"`
+	Timezone        string           `json:"timezone"`
+	PaymentRef      string           `json:"payment_ref"`
+	Subtotal        int64            `json:"subtotal"` // minor units, before tax
+	TaxLines        []InvoiceTaxLine `json:"tax_lines" gorm:"serializer:json"`
+	Total           int64            `json:"total"`
+	Currency        string           `json:"currency"`
+	IssuedAt        time.Time        `json:"issued_at"`
+	RegeneratedAt   *time.Time       `json:"regenerated_at,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+}
+
+type InvoiceTaxLine struct {
+	Name        string `json:"name"`
+	BasisPoints int64  `json:"basis_points"`
+	Amount      int64  `json:"amount"`
+}
+
+func parseTaxRates(value string) []taxRate {
+	var rates []taxRate
+	for _, part := range strings.Split(value, ",") {
+		name, rate, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			continue
+		}
+		percent, err := strconv.ParseFloat(rate, 64)
+		if err != nil || percent < 0 {
+			log.Printf("ignoring invalid tax line %q", part)
+			continue
+		}
+		rates = append(rates, taxRate{name: name, basisPoints: int64(math.Round(percent * 100))})
+	}
+	return rates
+}
+
+// splitTax works out the tax included in total. The remainder from rounding
+// goes to the last tax line so the lines always add up.
+func splitTax(total int64, rates []taxRate) (int64, []InvoiceTaxLine) {
+	var combined int64
+	for _, r := range rates {
+		combined += r.basisPoints
+	}
+	if combined == 0 {
+		return total, nil
+	}
+
+	subtotal := int64(math.Round(float64(total) * 10000 / float64(10000+combined)))
+	tax := total - subtotal
+
+	lines := make([]InvoiceTaxLine, len(rates))
+	var allocated int64
+	for i, r := range rates {
+		amount := tax * r.basisPoints / combined
+		if i == len(rates)-1 {
+			amount = tax - allocated
+		}
+		allocated += amount
+		lines[i] = InvoiceTaxLine{Name: r.name, BasisPoints: r.basisPoints, Amount: amount}
+	}
+	return subtotal, lines
+}
+
+// issueInvoice numbers and stores the invoice for a paid session. It is
+// called when the payment is captured; a session is invoiced at most once.
+func issueInvoice(tx *gorm.DB, session Session, intent PaymentIntent, amount int64) (*Invoice, error) {
+	var invoice Invoice
+	if err := tx.Where("session_id = ?", session.ID).First(&invoice).Error; err == nil {
+		return &invoice, nil
+	}
+
+	// Writes in this transaction hold SQLite's write lock, so the next
+	// number cannot be taken concurrently.
+	var last int
+	if err := tx.Model(&Invoice{}).Select("COALESCE(MAX(sequence), 0)").Scan(&last).Error; err != nil {
+		return nil, err
+	}
+
+	subtotal, taxLines := splitTax(amount, invoiceTaxRates)
+	invoice = Invoice{
+		Number:          fmt.Sprintf("%s%06d", invoicePrefix, last+1),
+		Sequence:        last + 1,
+		SessionID:       session.ID,
+		PaymentIntentID: intent.ID,
+		UserID:          session.UserID,
+		CounsellorID:    session.CounsellorID,
+		PaymentRef:      intent.ProviderPaymentID,
+		Subtotal:        subtotal,
+		TaxLines:        taxLines,
+		Total:           amount,
+		Currency:        intent.Currency,
+		IssuedAt:        time.Now(),
+	}
+	if err := fillInvoiceDetails(tx, &invoice, session); err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&invoice).Error; err != nil {
+		return nil, err
+	}
+
+	// The PDF can always be rebuilt from the row, so a failed write only
+	// delays it until the first download.
+	if err := writeInvoicePDF(invoice); err != nil {
+		log.Printf("failed to write invoice %s: %v", invoice.Number, err)
+	}
+	return &invoice, nil
+}
+
+// fillInvoiceDetails copies the current user, counsellor and session details
+// into the invoice.
+func fillInvoiceDetails(tx *gorm.DB, invoice *Invoice, session Session) error {
+	var user User
+	if err := tx.First(&user, session.UserID).Error; err != nil {
+		return err
+	}
+	var counsellor Counsellor
+	if err := tx.First(&counsellor, session.CounsellorID).Error; err != nil {
+		return err
+	}
+
+	invoice.BilledToName = user.Name
+	invoice.BilledToEmail = user.Email
+	invoice.CounsellorName = counsellor.Name
+	invoice.Qualification = counsellor.Qualification
+	invoice.Registration = strings.TrimSpace(counsellor.RegistrationBody + " " + counsellor.RegistrationNumber)
+	invoice.SessionDate = session.SessionDate
+	invoice.Duration = session.Duration
+	invoice.Timezone = loadLocation(user.Timezone).String()
+	return nil
+}
+
+func invoicePath(invoice Invoice) string {
+	return filepath.Join(invoiceDir, invoice.Number+".pdf")
+}
+
+func writeInvoicePDF(invoice Invoice) error {
+	if err := os.MkdirAll(invoiceDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(invoicePath(invoice), renderInvoicePDF(invoice), 0644)
+}
+
+// renderInvoicePDF lays out the invoice as a one page tax invoice.
+func renderInvoicePDF(invoice Invoice) []byte {
+	var doc pdfDocument
+	const left, right = 50.0, 545.0
+	money := func(amount int64) string {
+		return Money{Amount: amount, Currency: invoice.Currency}.Statement()
+	}
+
+	y := 790.0
+	doc.text(left, y, pdfBold, 20, "TAX INVOICE")
+	doc.text(360, y, pdfRegular, 10, "Invoice no: "+invoice.Number)
+	doc.text(360, y-14, pdfRegular, 10, "Date: "+invoice.IssuedAt.In(loadLocation(invoice.Timezone)).Format("02 Jan 2006"))
+
+	y -= 30
+	doc.text(left, y, pdfBold, 11, invoiceSellerName)
+	for _, line := range strings.Split(invoiceSellerAddress, "\\n") {
+		if line != "" {
+			y -= 13
+			doc.text(left, y, pdfRegular, 9, line)
+		}
+	}
+	if invoiceSellerGSTIN != "" {
+		y -= 13
+		doc.text(left, y, pdfRegular, 9, "GSTIN: "+invoiceSellerGSTIN)
+	}
+
+	y -= 35
+	doc.text(left, y, pdfBold, 10, "Billed to")
+	doc.text(300, y, pdfBold, 10, "Service provided by")
+	doc.text(left, y-14, pdfRegular, 10, invoice.BilledToName)
+	doc.text(left, y-28, pdfRegular, 10, invoice.BilledToEmail)
+	doc.text(300, y-14, pdfRegular, 10, invoice.CounsellorName)
+	doc.text(300, y-28, pdfRegular, 10, invoice.Qualification)
+	if invoice.Registration != "" {
+		doc.text(300, y-42, pdfRegular, 10, "Registration: "+invoice.Registration)
+	}
+
+	y -= 80
+	doc.text(left, y, pdfBold, 10, "Description")
+	doc.text(470, y, pdfBold, 10, "Amount")
+	doc.line(left, y-6, right, y-6)
+
+	local := invoice.SessionDate.In(loadLocation(invoice.Timezone))
+	y -= 22
+	doc.text(left, y, pdfRegular, 10, fmt.Sprintf("Counselling session with %s", invoice.CounsellorName))
+	doc.textRight(right, y, 10, money(invoice.Subtotal))
+	y -= 13
+	doc.text(left, y, pdfRegular, 9, fmt.Sprintf("%s, %d minutes", local.Format("Mon 02 Jan 2006 15:04 MST"), invoice.Duration))
+
+	y -= 20
+	doc.line(left, y+8, right, y+8)
+	doc.text(300, y-6, pdfRegular, 10, "Taxable value")
+	doc.textRight(right, y-6, 10, money(invoice.Subtotal))
+	for _, tax := range invoice.TaxLines {
+		y -= 16
+		doc.text(300, y-6, pdfRegular, 10, fmt.Sprintf("%s @ %s%%", tax.Name, strconv.FormatFloat(float64(tax.BasisPoints)/100, 'f', -1, 64)))
+		doc.textRight(right, y-6, 10, money(tax.Amount))
+	}
+	y -= 24
+	doc.line(300, y+8, right, y+8)
+	doc.text(300, y-6, pdfBold, 11, "Total paid")
+	doc.textRight(right, y-6, 11, money(invoice.Total))
+
+	y -= 40
+	if invoice.PaymentRef != "" {
+		doc.text(left, y, pdfRegular, 9, "Payment reference: "+invoice.PaymentRef)
+		y -= 13
+	}
+	doc.text(left, y, pdfRegular, 9, "Prices are inclusive of the taxes shown.")
+
+	doc.text(left, 50, pdfRegular, 8, "This is a computer generated invoice and does not require a signature.")
+	if invoice.RegeneratedAt != nil {
+		doc.text(left, 38, pdfRegular, 8, "Reissued on "+invoice.RegeneratedAt.In(loadLocation(invoice.Timezone)).Format("02 Jan 2006")+".")
+	}
+
+	return doc.bytes()
+}
+
+// Session handlers
+func getSessionInvoice(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var invoice Invoice
+	if err := db.Where("session_id = ? AND user_id = ?", c.Param("id"), userID).First(&invoice).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No invoice for this session"})
+		return
+	}
+
+	data, err := os.ReadFile(invoicePath(invoice))
+	if errors.Is(err, os.ErrNotExist) {
+		if err = writeInvoicePDF(invoice); err == nil {
+			data, err = os.ReadFile(invoicePath(invoice))
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoice"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+// Admin handlers
+// regenerateInvoice rebuilds a session's invoice PDF with the current party
+// details, e.g. after a counsellor's registration was corrected. The number
+// and amounts stay as issued.
+func regenerateInvoice(c *gin.Context) {
+	var invoice Invoice
+	if err := db.Where("session_id = ?", c.Param("id")).First(&invoice).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No invoice for this session"})
+		return
+	}
+
+	var session Session
+	if err := db.First(&session, invoice.SessionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := fillInvoiceDetails(db, &invoice, session); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoice details"})
+		return
+	}
+	now := time.Now()
+	invoice.RegeneratedAt = &now
+
+	if err := db.Save(&invoice).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update invoice"})
+		return
+	}
+	if err := writeInvoicePDF(invoice); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write invoice"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invoice)
+}
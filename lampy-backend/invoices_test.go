@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTaxRates(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"CGST:9,SGST:9", "[{CGST 900} {SGST 900}]"},
+		{" IGST:18 ", "[{IGST 1800}]"},
+		{"VAT:12.5", "[{VAT 1250}]"},
+		{"CGST:9,bad,SGST:x,NEG:-1", "[{CGST 900}]"},
+		{"", "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := fmt.Sprint(parseTaxRates(tt.value)); got != tt.want {
+				t.Errorf("parseTaxRates(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTax(t *testing.T) {
+	gst := []taxRate{{"CGST", 900}, {"SGST", 900}}
+
+	tests := []struct {
+		name         string
+		total        int64
+		rates        []taxRate
+		wantSubtotal int64
+		wantLines    []int64
+	}{
+		{"even split", 118000, gst, 100000, []int64{9000, 9000}},
+		{"remainder to the last line", 80000, gst, 67797, []int64{6101, 6102}},
+		{"single rate", 11800, []taxRate{{"IGST", 1800}}, 10000, []int64{1800}},
+		{"no tax", 80000, nil, 80000, nil},
+		{"free", 0, gst, 0, []int64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subtotal, lines := splitTax(tt.total, tt.rates)
+			sum := subtotal
+			var got []int64
+			for _, line := range lines {
+				sum += line.Amount
+				got = append(got, line.Amount)
+			}
+			if sum != tt.total {
+				t.Errorf("subtotal and tax add up to %d, want %d", sum, tt.total)
+			}
+			if subtotal != tt.wantSubtotal || fmt.Sprint(got) != fmt.Sprint(tt.wantLines) {
+				t.Errorf("splitTax(%d) = %d %v, want %d %v", tt.total, subtotal, got, tt.wantSubtotal, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestIssueInvoice(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Invoice", nil)
+	db.Model(&counsellor).Updates(map[string]interface{}{"registration_body": "RCI", "registration_number": "A12345"})
+	intent := PaymentIntent{ID: 7, ProviderPaymentID: "pay_7", Currency: "INR"}
+
+	var numbers []string
+	for i := 0; i < 3; i++ {
+		session := createTestSession(t, user, counsellor, time.Now().Add(time.Duration(i+1)*24*time.Hour), SessionPending)
+		invoice, err := issueInvoice(db, session, intent, 80000)
+		if err != nil {
+			t.Fatalf("issueInvoice() error = %v", err)
+		}
+		again, err := issueInvoice(db, session, intent, 80000)
+		if err != nil || again.ID != invoice.ID {
+			t.Fatalf("second issueInvoice() = %+v, %v; want the same invoice", again, err)
+		}
+		numbers = append(numbers, invoice.Number)
+
+		if invoice.BilledToEmail != user.Email || invoice.Registration != "RCI A12345" || invoice.PaymentRef != "pay_7" || invoice.Total != 80000 {
+			t.Errorf("invoice details = %+v", invoice)
+		}
+		data, err := os.ReadFile(invoicePath(*invoice))
+		if err != nil || !bytes.HasPrefix(data, []byte("%PDF-")) {
+			t.Errorf("invoice PDF not written: %v", err)
+		}
+	}
+
+	if want := fmt.Sprint([]string{invoicePrefix + "000001", invoicePrefix + "000002", invoicePrefix + "000003"}); fmt.Sprint(numbers) != want {
+		t.Errorf("invoice numbers = %v, want %s", numbers, want)
+	}
+}
+
+func TestRenderInvoicePDF(t *testing.T) {
+	invoice := Invoice{
+		Number:         "LAMPY-000042",
+		BilledToName:   "Asha (Client)",
+		CounsellorName: "Dr Rao",
+		SessionDate:    time.Date(2030, 7, 1, 4, 30, 0, 0, time.UTC),
+		Duration:       50,
+		Timezone:       "Asia/Kolkata",
+		Subtotal:       67797,
+		TaxLines:       []InvoiceTaxLine{{"CGST", 900, 6101}, {"SGST", 900, 6102}},
+		Total:          80000,
+		Currency:       "INR",
+		IssuedAt:       time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	pdf := string(renderInvoicePDF(invoice))
+
+	for _, want := range []string{
+		"%PDF-1.4",
+		"Invoice no: LAMPY-000042",
+		`Asha \(Client\)`,
+		"Mon 01 Jul 2030 10:00 IST, 50 minutes",
+		"CGST @ 9%",
+		"INR 800.00",
+		"INR 677.97",
+		"%%EOF",
+	} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("invoice PDF is missing %q", want)
+		}
+	}
+	if strings.Contains(pdf, "Reissued") {
+		t.Error("a first issue is marked as reissued")
+	}
+}
+
+func TestGetSessionInvoice(t *testing.T) {
+	tests := []struct {
+		name       string
+		owner      bool
+		removePDF  bool
+		want       int
+		wantPDFHdr bool
+	}{
+		{"owner", true, false, http.StatusOK, true},
+		{"owner, PDF missing", true, true, http.StatusOK, true},
+		{"another user", false, false, http.StatusNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			stranger := createTestUser(t, "stranger@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Invoice", nil)
+			session := createTestSession(t, user, counsellor, time.Now().Add(24*time.Hour), SessionPending)
+			invoice, _ := issueInvoice(db, session, PaymentIntent{Currency: "INR"}, 80000)
+			if tt.removePDF {
+				os.Remove(invoicePath(*invoice))
+			}
+
+			caller := user
+			if !tt.owner {
+				caller = stranger
+			}
+			w := serveTest(getSessionInvoice, http.MethodGet, "/sessions/:id/invoice", fmt.Sprintf("/sessions/%d/invoice", session.ID), nil, caller.ID, caller.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.wantPDFHdr && (!bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")) ||
+				!strings.Contains(w.Header().Get("Content-Disposition"), invoice.Number+".pdf")) {
+				t.Errorf("response is not the invoice PDF: %s", w.Header())
+			}
+		})
+	}
+}
+
+func TestRegenerateInvoice(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin@example.com", RoleAdmin)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Invoice", nil)
+	session := createTestSession(t, user, counsellor, time.Now().Add(24*time.Hour), SessionPending)
+	issued, _ := issueInvoice(db, session, PaymentIntent{Currency: "INR"}, 80000)
+
+	db.Model(&counsellor).Updates(map[string]interface{}{"name": "Dr Corrected", "registration_body": "RCI", "registration_number": "B999"})
+	w := serveTest(regenerateInvoice, http.MethodPost, "/sessions/:id/invoice", fmt.Sprintf("/sessions/%d/invoice", session.ID), nil, admin.ID, admin.Role)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	var invoice Invoice
+	db.First(&invoice, issued.ID)
+	if invoice.Number != issued.Number || invoice.Total != issued.Total || invoice.Subtotal != issued.Subtotal {
+		t.Errorf("regeneration changed the number or amounts: %+v", invoice)
+	}
+	if invoice.CounsellorName != "Dr Corrected" || invoice.Registration != "RCI B999" || invoice.RegeneratedAt == nil {
+		t.Errorf("regeneration did not refresh the details: %+v", invoice)
+	}
+	data, _ := os.ReadFile(invoicePath(invoice))
+	if !bytes.Contains(data, []byte("Dr Corrected")) || !bytes.Contains(data, []byte("Reissued on")) {
+		t.Error("regenerated PDF does not show the corrected details")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer delivers transactional email. The implementation is chosen at
+// startup from MAILER ("smtp" or "log").
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+func initMailer() {
+	switch getEnv("MAILER", "log") {
+	case "smtp":
+		mailer = &smtpMailer{
+			host:     os.Getenv("SMTP_HOST"),
+			port:     getEnv("SMTP_PORT", "587"),
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     getEnv("MAIL_FROM", "no-reply@lampy.app"),
+		}
+	default:
+		mailer = &logMailer{dir: os.Getenv("MAIL_DIR")}
+	}
+}
+
+// smtpMailer sends mail through a plain SMTP relay.
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(m.host+":"+m.port, auth, m.from, []string{to}, []byte(msg))
+}
+
+// logMailer is the local development mailer. It prints every message to the
+// server log and, when dir is set, also writes it to a file there.
+type logMailer struct {
+	dir string
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+	log.Printf("📧 mail to=%s subject=%q\n%s", to, subject, body)
+
+	if m.dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), strings.ReplaceAll(to, "@", "_at_"))
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", to, subject, body)
+	return os.WriteFile(filepath.Join(m.dir, filename), []byte(content), 0644)
+}
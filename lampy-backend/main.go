@@ -4,12 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -25,58 +26,80 @@ type User struct {
 	Name                    string    `json:"name" gorm:"not null"`
 	Email                   string    `json:"email" gorm:"unique;not null"`
 	Password                string    `json:"-" gorm:"not null"`
+	Role                    string    `json:"role" gorm:"not null;default:user"`
 	IsVerified              bool      `json:"is_verified" gorm:"default:false"`
 	PhotoVerified           bool      `json:"photo_verified" gorm:"default:false"`
 	AgeVerified             bool      `json:"age_verified" gorm:"default:false"`
 	Location                string    `json:"location"`
+	Timezone                string    `json:"timezone" gorm:"not null;default:Asia/Kolkata"`
+	PushToken               string    `json:"-"` // Expo push token of the user's device
+	CalendarToken           string    `json:"-" gorm:"index"`
 	ProfilePhotoURL         string    `json:"profile_photo_url"`
-	VerificationPhotoURL    string    `json:"verification_photo_url"`
-	AgeVerificationPhotoURL string    `json:"age_verification_photo_url"`
+	VerificationPhotoURL    string    `json:"-"` // blob key; only reviewers see it, via VerificationRequest
+	AgeVerificationPhotoURL string    `json:"-"` // blob key; only reviewers see it, via VerificationRequest
 	ConsultationPreferences []string  `json:"consultation_preferences" gorm:"serializer:json"`
 	CreatedAt               time.Time `json:"created_at"`
 	UpdatedAt               time.Time `json:"updated_at"`
 }
 
 type Counsellor struct {
-	ID            uint      `json:"id" gorm:"primaryKey"`
-	Name          string    `json:"name" gorm:"not null"`
-	Role          string    `json:"role" gorm:"not null"`
-	Experience    string    `json:"experience"`
-	Qualification string    `json:"qualification"`
-	Price         string    `json:"price"`
-	Rating        float64   `json:"rating"`
-	TotalRatings  int       `json:"total_ratings"`
-	ImageURL      string    `json:"image_url"`
-	Specialties   []string  `json:"specialties" gorm:"serializer:json"`
-	Available     bool      `json:"available" gorm:"default:true"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID                 uint              `json:"id" gorm:"primaryKey"`
+	UserID             *uint             `json:"user_id" gorm:"index"` // login account, if any
+	Name               string            `json:"name" gorm:"not null"`
+	Role               string            `json:"role" gorm:"not null"`
+	Experience         string            `json:"experience"`
+	Qualification      string            `json:"qualification"`
+	RegistrationBody   string            `json:"registration_body"` // printed on invoices, e.g. "RCI"
+	RegistrationNumber string            `json:"registration_number"`
+	Price              string            `json:"price" gorm:"-"` // display only, e.g. "₹5,000"; see pricing.go
+	Currency           string            `json:"currency" gorm:"size:3;not null;default:INR"`
+	PriceFrom          int64             `json:"price_from"` // lowest session price in minor units
+	Prices             []CounsellorPrice `json:"prices,omitempty" gorm:"foreignKey:CounsellorID"`
+	Rating             float64           `json:"rating"`
+	TotalRatings       int               `json:"total_ratings"`
+	ImageURL           string            `json:"image_url"`
+	Specialties        []string          `json:"specialties" gorm:"serializer:json"`
+	Available          bool              `json:"available" gorm:"default:true"`
+	Timezone           string            `json:"timezone" gorm:"not null;default:Asia/Kolkata"`
+	CreatedAt          time.Time         `json:"created_at"`
+	UpdatedAt          time.Time         `json:"updated_at"`
 }
 
 type Session struct {
-	ID           uint       `json:"id" gorm:"primaryKey"`
-	UserID       uint       `json:"user_id"`
-	CounsellorID uint       `json:"counsellor_id"`
-	SessionDate  time.Time  `json:"session_date"`
-	Duration     int        `json:"duration"` // in minutes
-	Status       string     `json:"status"`   // pending, confirmed, completed, cancelled
-	Notes        string     `json:"notes"`
-	User         User       `json:"user" gorm:"foreignKey:UserID"`
-	Counsellor   Counsellor `json:"counsellor" gorm:"foreignKey:CounsellorID"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	UserID          uint      `json:"user_id"`
+	CounsellorID    uint      `json:"counsellor_id"`
+	SeriesID        *uint     `json:"series_id,omitempty" gorm:"index"`
+	SessionDate     time.Time `json:"session_date"`
+	Duration        int       `json:"duration"` // in minutes
+	Status          string    `json:"status"`   // see session_state.go
+	Notes           string    `json:"notes"`
+	RescheduleCount int       `json:"reschedule_count" gorm:"default:0"`
+
+	// Set when the session is cancelled or marked as a no-show
+	CancelledAt            *time.Time `json:"cancelled_at,omitempty"`
+	CancellationType       string     `json:"cancellation_type,omitempty"` // free, late, no_show, counsellor
+	CancellationFeePercent int        `json:"cancellation_fee_percent"`
+	CancellationReason     string     `json:"cancellation_reason,omitempty"`
+
+	User       User       `json:"user" gorm:"foreignKey:UserID"`
+	Counsellor Counsellor `json:"counsellor" gorm:"foreignKey:CounsellorID"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 type VerificationRequest struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	UserID    uint      `json:"user_id"`
-	Type      string    `json:"type"`   // "photo", "age"
-	Status    string    `json:"status"` // "pending", "approved", "rejected"
-	ImageURL  string    `json:"image_url"`
-	Reason    string    `json:"reason,omitempty"`
-	User      User      `json:"user" gorm:"foreignKey:UserID"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id"`
+	Type       string     `json:"type"`   // "photo", "age"
+	Status     string     `json:"status"` // "pending", "approved", "rejected"
+	ImageURL   string     `json:"image_url"`
+	Reason     string     `json:"reason,omitempty"`
+	ReviewerID *uint      `json:"reviewer_id,omitempty" gorm:"index"` // the reviewer who may see the image
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`              // starts the retention window
+	User       User       `json:"user" gorm:"foreignKey:UserID"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 // Request/Response DTOs
@@ -84,11 +107,21 @@ type RegisterRequest struct {
 	Name     string `json:"name" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
+	Timezone string `json:"timezone"`
 }
 
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding="required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// UpdateProfileRequest lists the profile fields users may change
+// themselves. Fields left out of the request are not changed.
+type UpdateProfileRequest struct {
+	Name     *string `json:"name" binding:"omitempty,min=1"`
+	Email    *string `json:"email" binding:"omitempty,email"`
+	Location *string `json:"location"`
+	Timezone *string `json:"timezone"`
 }
 
 type LocationRequest struct {
@@ -107,13 +140,26 @@ type PreferencesRequest struct {
 type SessionBookingRequest struct {
 	CounsellorID uint   `json:"counsellor_id" binding:"required"`
 	SessionDate  string `json:"session_date" binding:"required"`
-	Duration     int    `json:"duration" binding:"required"`
+	Duration     int    `json:"duration" binding:"required,min=1,max=480"`
 	Notes        string `json:"notes"`
+
+	// Recurrence, when set, books a series instead of a single session
+	Recurrence *RecurrenceRequest `json:"recurrence"`
+
+	// UseCredits set to false pays for the booking even when the wallet has
+	// credits for it
+	UseCredits *bool `json:"use_credits"`
+
+	// PromoCode takes a discount off each session booked. Bookings with a
+	// code are always paid, never taken from the wallet.
+	PromoCode string `json:"promo_code"`
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	User         User   `json:"user"`
 }
 
 // Global variables
@@ -122,16 +168,36 @@ var jwtSecret = []byte("your-secret-key-change-this-in-production")
 
 // JWT Claims
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID   uint   `json:"user_id"`
+	FamilyID string `json:"sid"`
+	Role     string `json:"role"`
 	jwt.RegisteredClaims
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeysCommand(os.Args[2:])
+		return
+	}
+
 	// Initialize database
 	initDB()
 
+	initMailer()
+	initBlobStore()
+	initKeyWrapper()
+	initNotifiers()
+	initPayments()
+
 	// Seed sample data
 	seedData()
+	migrateLegacyPrices()
+	startSessionExpiryJob()
+	startReminderScheduler()
+	startRefundWorker()
+	startCreditExpiryJob()
+	startDocumentPurgeJob()
+	bootstrapSuperadmin()
 
 	// Initialize Gin router
 	r := gin.Default()
@@ -154,6 +220,13 @@ func main() {
 		{
 			auth.POST("/register", register)
 			auth.POST("/login", login)
+			auth.POST("/counsellor-login", counsellorLogin)
+			auth.POST("/refresh", refreshTokens)
+			auth.POST("/logout", logout)
+			auth.POST("/forgot-password", forgotPassword)
+			auth.POST("/reset-password", resetPassword)
+			auth.POST("/verify-email", authMiddleware(), verifyEmail)
+			auth.POST("/resend-verification", authMiddleware(), resendVerificationEmail)
 			auth.POST("/verify-photo", authMiddleware(), verifyPhoto)
 			auth.POST("/verify-age", authMiddleware(), verifyAge)
 		}
@@ -167,6 +240,10 @@ func main() {
 			users.POST("/location", updateLocation)
 			users.POST("/preferences", updatePreferences)
 			users.POST("/upload-photo", uploadPhoto)
+			users.POST("/push-token", updatePushToken)
+			users.GET("/calendar-feed", getCalendarFeed)
+			users.POST("/calendar-feed/rotate", rotateCalendarFeed)
+			users.GET("/wallet", getWallet)
 		}
 
 		// Counsellor routes
@@ -175,6 +252,8 @@ func main() {
 			counsellors.Use(authMiddleware())
 			counsellors.GET("/", getCounsellors)
 			counsellors.GET("/:id", getCounsellor)
+			counsellors.GET("/:id/slots", getCounsellorSlots)
+			counsellors.GET("/:id/cancellation-policy", getCounsellorCancellationPolicy)
 			counsellors.GET("/recommended", getRecommendedCounsellors)
 		}
 
@@ -186,15 +265,102 @@ func main() {
 			sessions.GET("/", getUserSessions)
 			sessions.GET("/:id", getSession)
 			sessions.PUT("/:id/cancel", cancelSession)
+			sessions.GET("/:id/cancellation-preview", previewCancellation)
+			sessions.PUT("/:id/reschedule", rescheduleSession)
+			sessions.GET("/:id/history", getSessionHistory)
+			sessions.GET("/:id/ics", getSessionICS)
+			sessions.GET("/:id/payment", getSessionPayment)
+			sessions.GET("/:id/refunds", getSessionRefunds)
+			sessions.GET("/:id/invoice", getSessionInvoice)
+		}
+
+		// Package routes
+		packages := api.Group("/packages")
+		packages.Use(authMiddleware())
+		{
+			packages.GET("/", getPackages)
+			packages.POST("/:id/purchase", purchasePackage)
+		}
+
+		// File routes
+		files := api.Group("/files")
+		{
+			files.GET("/url", authMiddleware(), getFileURL)
+			files.GET("/raw/*key", serveFile)
 		}
 
-		// Admin routes (for demo purposes)
+		// Promo routes
+		promo := api.Group("/promo")
+		promo.Use(authMiddleware())
+		{
+			promo.POST("/validate", validatePromo)
+		}
+
+		// Recurring session routes
+		series := api.Group("/series")
+		{
+			series.Use(authMiddleware())
+			series.GET("/", getUserSeries)
+			series.GET("/:id", getSeries)
+			series.PUT("/:id/cancel", cancelSeries)
+		}
+
+		// Calendar feed, authenticated by the secret token in the URL
+		api.GET("/calendar/:token", serveCalendarFeed)
+
+		// Payment routes. Webhooks are authenticated by their signature.
+		payments := api.Group("/payments")
+		{
+			payments.POST("/webhook/:provider", handlePaymentWebhook)
+			if fake, ok := paymentProvider.(*fakeGateway); ok && fake.simulate {
+				payments.POST("/fake/:intent/:outcome", authMiddleware(), fake.simulatePayment)
+			}
+		}
+
+		// Counsellor portal routes
+		portal := api.Group("/counsellor")
+		{
+			portal.Use(authMiddleware(), counsellorMiddleware())
+			portal.GET("/sessions", getCounsellorSessions)
+			portal.PUT("/sessions/:id/confirm", confirmCounsellorSession)
+			portal.PUT("/sessions/:id/decline", declineCounsellorSession)
+			portal.PUT("/sessions/:id/start", startCounsellorSession)
+			portal.PUT("/sessions/:id/complete", completeCounsellorSession)
+			portal.PUT("/sessions/:id/no-show", markCounsellorSessionNoShow)
+			portal.GET("/availability", getAvailability)
+			portal.PUT("/availability", updateWeeklyAvailability)
+			portal.POST("/availability/exceptions", createAvailabilityException)
+			portal.DELETE("/availability/exceptions/:id", deleteAvailabilityException)
+			portal.POST("/time-off", createTimeOff)
+			portal.DELETE("/time-off/:id", deleteTimeOff)
+			portal.GET("/cancellation-policy", getOwnCancellationPolicy)
+			portal.PUT("/cancellation-policy", updateOwnCancellationPolicy)
+			portal.GET("/pricing", getOwnPricing)
+			portal.PUT("/pricing", updateOwnPricing)
+		}
+
+		// Admin routes
 		admin := api.Group("/admin")
 		{
-			admin.POST("/counsellors", createCounsellor)
-			admin.GET("/verifications", getVerificationRequests)
-			admin.POST("/verifications/:id/approve", approveVerification)
-			admin.POST("/verifications/:id/reject", rejectVerification)
+			admin.Use(authMiddleware())
+			admin.POST("/counsellors", requirePermission(PermCounsellorManage), createCounsellor)
+			admin.POST("/counsellors/:id/account", requirePermission(PermCounsellorManage), createCounsellorAccount)
+			admin.GET("/verifications", requirePermission(PermVerificationReview), getVerificationRequests)
+			admin.POST("/verifications/:id/approve", requirePermission(PermVerificationReview), approveVerification)
+			admin.POST("/verifications/:id/reject", requirePermission(PermVerificationReview), rejectVerification)
+			admin.POST("/verifications/:id/assign", requirePermission(PermVerificationAssign), assignVerificationReviewer)
+			admin.GET("/verifications/purges", requirePermission(PermReportsView), getDocumentPurges)
+			admin.GET("/reports/summary", requirePermission(PermReportsView), getReportSummary)
+			admin.PUT("/users/:id/role", requirePermission(PermRolesManage), updateUserRole)
+			admin.GET("/sessions/:id/refunds", requirePermission(PermRefundsIssue), getSessionLedger)
+			admin.POST("/sessions/:id/refunds", requirePermission(PermRefundsIssue), issueManualRefund)
+			admin.POST("/sessions/:id/invoice/regenerate", requirePermission(PermInvoicesManage), regenerateInvoice)
+			admin.POST("/packages", requirePermission(PermPackagesManage), createPackage)
+			admin.PUT("/packages/:id", requirePermission(PermPackagesManage), updatePackage)
+			admin.GET("/promos", requirePermission(PermPromosManage), getPromoCodes)
+			admin.POST("/promos", requirePermission(PermPromosManage), createPromoCode)
+			admin.PUT("/promos/:id", requirePermission(PermPromosManage), updatePromoCode)
+			admin.GET("/promos/:id/redemptions", requirePermission(PermPromosManage), getPromoRedemptions)
 		}
 	}
 
@@ -215,20 +381,41 @@ func main() {
 
 func initDB() {
 	var err error
-	db, err = gorm.Open(sqlite.Open("lampy.db"), &gorm.Config{})
+	// Writers wait for each other instead of failing at once, since
+	// bookings hold a lock row for the length of their transaction.
+	db, err = gorm.Open(sqlite.Open("lampy.db?_busy_timeout=5000"), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
 	// Auto migrate schemas
-	err = db.AutoMigrate(&User{}, &Counsellor{}, &Session{}, &VerificationRequest{})
-	if err != nil {
+	if err := migrateSchema(db); err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
 	fmt.Println("✅ Database initialized successfully")
 }
 
+func migrateSchema(conn *gorm.DB) error {
+	seedAvailability := !conn.Migrator().HasTable(&AvailabilityRule{})
+
+	err := conn.AutoMigrate(&User{}, &Counsellor{}, &Session{}, &VerificationRequest{}, &RefreshToken{}, &PasswordResetToken{}, &EmailVerificationCode{},
+		&AvailabilityRule{}, &AvailabilityException{}, &TimeOff{}, &SessionHistory{},
+		&SessionReminder{}, &SessionSeries{}, &CancellationPolicy{},
+		&PaymentIntent{}, &PaymentWebhookEvent{}, &CounsellorPrice{},
+		&LedgerEntry{}, &Refund{}, &Invoice{},
+		&Package{}, &PackagePurchase{}, &CreditLedgerEntry{}, &PromoCode{}, &PromoRedemption{},
+		&DocumentPurge{}, &BookingLock{})
+	if err != nil {
+		return err
+	}
+
+	if seedAvailability {
+		return seedDefaultAvailability(conn)
+	}
+	return nil
+}
+
 func seedData() {
 	// Check if counsellors already exist
 	var count int64
@@ -241,49 +428,62 @@ func seedData() {
 	counsellors := []Counsellor{
 		{
 			Name: "John Smith", Role: "Clinical Psychologist", Experience: "40 Yrs",
-			Qualification: "M.Phil, M.A, PH.D", Price: "₹5000", Rating: 4.8, TotalRatings: 143,
+			Qualification: "M.Phil, M.A, PH.D", Prices: inrPrices(3000, 5000, 8500), Rating: 4.8, TotalRatings: 143,
 			ImageURL:    "/images/counsellor1.jpg",
 			Specialties: []string{"Stress Management", "Mental Health Concerns", "Career Guidance"},
 		},
 		{
 			Name: "Sarah Johnson", Role: "Counselling Psychologist", Experience: "3 Yrs",
-			Qualification: "B.A, M.Sc", Price: "₹800", Rating: 4.7, TotalRatings: 22,
+			Qualification: "B.A, M.Sc", Prices: inrPrices(500, 800, 1400), Rating: 4.7, TotalRatings: 22,
 			ImageURL:    "/images/counsellor2.jpg",
 			Specialties: []string{"Relationship Issues", "Personal Growth", "Stress Management"},
 		},
 		{
 			Name: "Michael Lee", Role: "Counselling Psychologist", Experience: "3 Yrs",
-			Qualification: "MA, MBA", Price: "₹1000", Rating: 4.7, TotalRatings: 92,
+			Qualification: "MA, MBA", Prices: inrPrices(600, 1000, 1700), Rating: 4.7, TotalRatings: 92,
 			ImageURL:    "/images/counsellor3.jpg",
 			Specialties: []string{"Career Guidance", "Decision-Making Support", "Mental Health Concerns"},
 		},
 		{
 			Name: "Emily Davis", Role: "Psychotherapist", Experience: "25 Yrs",
-			Qualification: "MA, M.Phil, Ph.D", Price: "₹3400", Rating: 4.9, TotalRatings: 14,
+			Qualification: "MA, M.Phil, Ph.D", Prices: inrPrices(2000, 3400, 5800), Rating: 4.9, TotalRatings: 14,
 			ImageURL:    "/images/counsellor4.jpg",
 			Specialties: []string{"Grief or Loss", "Mental Health Concerns", "Personal Growth"},
 		},
 		{
 			Name: "Daniel Brown", Role: "Psychiatrist", Experience: "5 Yrs",
-			Qualification: "MBBS, MD", Price: "₹1000", Rating: 4.7, TotalRatings: 6,
+			Qualification: "MBBS, MD", Prices: inrPrices(600, 1000, 1700), Rating: 4.7, TotalRatings: 6,
 			ImageURL:    "/images/counsellor5.jpg",
 			Specialties: []string{"Mental Health Concerns", "Stress Management"},
 		},
 		{
 			Name: "Sophia Wilson", Role: "Psychologist", Experience: "35 Yrs",
-			Qualification: "B.A, M.Phil, M.A, PG Diploma", Price: "₹1200", Rating: 4.7, TotalRatings: 190,
+			Qualification: "B.A, M.Phil, M.A, PG Diploma", Prices: inrPrices(750, 1200, 2000), Rating: 4.7, TotalRatings: 190,
 			ImageURL:    "/images/counsellor6.jpg",
 			Specialties: []string{"Relationship Issues", "Personal Growth", "Grief or Loss", "Stress Management"},
 		},
 	}
 
 	for _, counsellor := range counsellors {
+		prices := counsellor.Prices
+		counsellor.Prices = nil
 		db.Create(&counsellor)
+		setCounsellorPrices(db, &counsellor, "INR", prices)
+		seedCounsellorAvailability(db, counsellor.ID)
 	}
 
 	fmt.Println("✅ Sample data seeded successfully")
 }
 
+// inrPrices builds 30, 50 and 90 minute prices from whole rupee amounts.
+func inrPrices(short, standard, long int64) []CounsellorPrice {
+	return []CounsellorPrice{
+		{Duration: 30, Amount: short * 100},
+		{Duration: 50, Amount: standard * 100},
+		{Duration: 90, Amount: long * 100},
+	}
+}
+
 // Middleware
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -308,7 +508,15 @@ func authMiddleware() gin.HandlerFunc {
 		}
 
 		claims := token.Claims.(*Claims)
+		if claims.FamilyID == "" || isTokenFamilyRevoked(claims.FamilyID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			c.Abort()
+			return
+		}
+
 		c.Set("user_id", claims.UserID)
+		c.Set("token_family", claims.FamilyID)
+		c.Set("role", claims.Role)
 		c.Next()
 	}
 }
@@ -340,6 +548,16 @@ func register(c *gin.Context) {
 		Name:     req.Name,
 		Email:    req.Email,
 		Password: string(hashedPassword),
+		Role:     RoleUser,
+		Timezone: defaultTimezone,
+	}
+
+	if req.Timezone != "" {
+		if !isValidTimezone(req.Timezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+			return
+		}
+		user.Timezone = req.Timezone
 	}
 
 	if err := db.Create(&user).Error; err != nil {
@@ -347,14 +565,17 @@ func register(c *gin.Context) {
 		return
 	}
 
+	// Delivery failures are logged; the user can ask for a resend.
+	sendEmailVerificationCode(user)
+
 	// Generate JWT token
-	token, err := generateJWT(user.ID)
+	pair, err := issueTokenPair(user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, AuthResponse{Token: token, User: user})
+	c.JSON(http.StatusCreated, AuthResponse{Token: pair.AccessToken, RefreshToken: pair.RefreshToken, ExpiresIn: pair.ExpiresIn, User: user})
 }
 
 func login(c *gin.Context) {
@@ -378,43 +599,20 @@ func login(c *gin.Context) {
 	}
 
 	// Generate JWT token
-	token, err := generateJWT(user.ID)
+	pair, err := issueTokenPair(user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, AuthResponse{Token: token, User: user})
+	c.JSON(http.StatusOK, AuthResponse{Token: pair.AccessToken, RefreshToken: pair.RefreshToken, ExpiresIn: pair.ExpiresIn, User: user})
 }
 
 func verifyPhoto(c *gin.Context) {
 	userID := c.MustGet("user_id").(uint)
 
-	// Handle file upload
-	file, header, err := c.Request.FormFile("photo")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo upload required"})
-		return
-	}
-	defer file.Close()
-
-	// Save file (in production, use cloud storage like AWS S3)
-	filename := fmt.Sprintf("verification_%d_%d_%s", userID, time.Now().Unix(), header.Filename)
-	filepath := fmt.Sprintf("uploads/verification/%s", filename)
-
-	// Create directories if they don't exist
-	os.MkdirAll("uploads/verification", 0755)
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
+	key, ok := receiveUpload(c, verificationPhotoUpload)
+	if !ok {
 		return
 	}
 
@@ -423,13 +621,13 @@ func verifyPhoto(c *gin.Context) {
 		UserID:   userID,
 		Type:     "photo",
 		Status:   "pending",
-		ImageURL: filepath,
+		ImageURL: key,
 	}
 
 	db.Create(&verificationReq)
 
 	// Update user
-	db.Model(&User{}).Where("id = ?", userID).Update("verification_photo_url", filepath)
+	db.Model(&User{}).Where("id = ?", userID).Update("verification_photo_url", key)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Photo uploaded successfully for verification",
@@ -439,30 +637,8 @@ func verifyPhoto(c *gin.Context) {
 func verifyAge(c *gin.Context) {
 	userID := c.MustGet("user_id").(uint)
 
-	// Handle file upload
-	file, header, err := c.Request.FormFile("id_document")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "ID document upload required"})
-		return
-	}
-	defer file.Close()
-
-	// Save file
-	filename := fmt.Sprintf("age_verification_%d_%d_%s", userID, time.Now().Unix(), header.Filename)
-	filepath := fmt.Sprintf("uploads/age_verification/%s", filename)
-
-	os.MkdirAll("uploads/age_verification", 0755)
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document"})
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document"})
+	key, ok := receiveUpload(c, idDocumentUpload)
+	if !ok {
 		return
 	}
 
@@ -471,13 +647,13 @@ func verifyAge(c *gin.Context) {
 		UserID:   userID,
 		Type:     "age",
 		Status:   "pending",
-		ImageURL: filepath,
+		ImageURL: key,
 	}
 
 	db.Create(&verificationReq)
 
 	// Update user
-	db.Model(&User{}).Where("id = ?", userID).Update("age_verification_photo_url", filepath)
+	db.Model(&User{}).Where("id = ?", userID).Update("age_verification_photo_url", key)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "ID document uploaded successfully for age verification",
@@ -500,17 +676,63 @@ func getProfile(c *gin.Context) {
 func updateProfile(c *gin.Context) {
 	userID := c.MustGet("user_id").(uint)
 
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Only the fields in UpdateProfileRequest are ever written, so users
+	// cannot grant themselves roles or verification.
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+
+	// A new address has to be verified again before the user can book.
+	emailChanged := req.Email != nil && *req.Email != user.Email
+	if emailChanged {
+		var taken int64
+		db.Model(&User{}).Where("email = ? AND id <> ?", *req.Email, userID).Count(&taken)
+		if taken > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already in use"})
+			return
+		}
+		updates["email"] = *req.Email
+		updates["is_verified"] = false
+	}
+	if req.Location != nil {
+		updates["location"] = *req.Location
+	}
+	if req.Timezone != nil {
+		if !isValidTimezone(*req.Timezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+			return
+		}
+		updates["timezone"] = *req.Timezone
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully"})
+		return
+	}
+
 	if err := db.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
 		return
 	}
 
+	if emailChanged {
+		user.Email = *req.Email
+		// Delivery failures are logged; the user can ask for a resend.
+		sendEmailVerificationCode(user)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully"})
 }
 
@@ -551,41 +773,20 @@ func updatePreferences(c *gin.Context) {
 func uploadPhoto(c *gin.Context) {
 	userID := c.MustGet("user_id").(uint)
 
-	file, header, err := c.Request.FormFile("photo")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo upload required"})
-		return
-	}
-	defer file.Close()
-
-	// Save file
-	filename := fmt.Sprintf("profile_%d_%d_%s", userID, time.Now().Unix(), header.Filename)
-	filepath := fmt.Sprintf("uploads/profiles/%s", filename)
-
-	os.MkdirAll("uploads/profiles", 0755)
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
-		return
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
+	key, ok := receiveUpload(c, profilePhotoUpload)
+	if !ok {
 		return
 	}
 
 	// Update user profile photo
-	if err := db.Model(&User{}).Where("id = ?", userID).Update("profile_photo_url", filepath).Error; err != nil {
+	if err := db.Model(&User{}).Where("id = ?", userID).Update("profile_photo_url", key).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile photo"})
 		return
 	}
 
 	c.JSON(http.StatusOK, PhotoUploadResponse{
-		UploadURL: filepath,
-		ImageURL:  fmt.Sprintf("/uploads/profiles/%s", filename),
+		UploadURL: key,
+		ImageURL:  signFileURL(key, time.Now()).URL,
 	})
 }
 
@@ -603,7 +804,54 @@ func getCounsellors(c *gin.Context) {
 		}
 	}
 
-	if err := query.Find(&counsellors).Error; err != nil {
+	// Filter and sort by price. Amounts are in minor units; without a
+	// duration the lowest price the counsellor offers is used. Counsellors
+	// without prices cannot be booked, so they match no price filter and
+	// sort after everyone else.
+	priceColumn := "counsellors.price_from"
+	pricedFirst := counsellorHasPrices + " DESC"
+	if duration := c.Query("duration"); duration != "" {
+		minutes, err := strconv.Atoi(duration)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+			return
+		}
+		query = query.Joins("JOIN counsellor_prices ON counsellor_prices.counsellor_id = counsellors.id AND counsellor_prices.duration = ?", minutes)
+		priceColumn = "counsellor_prices.amount"
+		pricedFirst = ""
+	}
+
+	if currency := c.Query("currency"); currency != "" {
+		query = query.Where("counsellors.currency = ?", strings.ToUpper(currency))
+	}
+
+	for param, op := range map[string]string{"min_price": ">=", "max_price": "<="} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		amount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || amount < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+			return
+		}
+		query = query.Where(priceColumn+" "+op+" ?", amount).Where(counsellorHasPrices)
+	}
+
+	switch c.Query("sort") {
+	case "":
+	case "price_asc":
+		query = query.Order(pricedFirst).Order(priceColumn + " ASC")
+	case "price_desc":
+		query = query.Order(pricedFirst).Order(priceColumn + " DESC")
+	case "rating":
+		query = query.Order("counsellors.rating DESC")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be price_asc, price_desc or rating"})
+		return
+	}
+
+	if err := query.Preload("Prices", orderPrices).Find(&counsellors).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch counsellors"})
 		return
 	}
@@ -615,7 +863,7 @@ func getCounsellor(c *gin.Context) {
 	id := c.Param("id")
 
 	var counsellor Counsellor
-	if err := db.First(&counsellor, id).Error; err != nil {
+	if err := db.Preload("Prices", orderPrices).First(&counsellor, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
 		return
 	}
@@ -643,7 +891,7 @@ func getRecommendedCounsellors(c *gin.Context) {
 		}
 	}
 
-	if err := query.Order("rating DESC").Limit(10).Find(&counsellors).Error; err != nil {
+	if err := query.Order("rating DESC").Limit(10).Preload("Prices", orderPrices).Find(&counsellors).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recommended counsellors"})
 		return
 	}
@@ -662,11 +910,27 @@ func bookSession(c *gin.Context) {
 	}
 
 	// Parse session date
-	sessionDate, err := time.Parse("2006-01-02T15:04:05Z", req.SessionDate)
+	sessionDate, err := parseSessionDate(req.SessionDate)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session date format"})
 		return
 	}
+	if !sessionDate.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Session date must be in the future"})
+		return
+	}
+
+	// Only verified accounts may book
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !user.IsVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address must be verified before booking"})
+		return
+	}
 
 	// Check if counsellor exists and is available
 	var counsellor Counsellor
@@ -680,25 +944,115 @@ func bookSession(c *gin.Context) {
 		return
 	}
 
-	// Create session
+	price, err := sessionPrice(counsellor, req.Duration)
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+
+	var promo *PromoQuote
+	if req.PromoCode != "" {
+		quote, err := quotePromo(db, req.PromoCode, userID, counsellor, price)
+		if respondPromoError(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check promo code"})
+			return
+		}
+		promo = &quote
+		price.Amount = quote.Total
+	}
+
+	if req.Recurrence != nil {
+		bookSeries(c, user, counsellor, req, sessionDate, price, promo)
+		return
+	}
+
+	// Check the requested time against the counsellor's schedule
+	withinHours, err := isWithinAvailability(db, counsellor, sessionDate, time.Duration(req.Duration)*time.Minute)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check availability"})
+		return
+	}
+
+	if !withinHours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested time is outside the counsellor's availability"})
+		return
+	}
+
+	// Create session. Paid sessions hold the slot until payment is captured.
 	session := Session{
 		UserID:       userID,
 		CounsellorID: req.CounsellorID,
 		SessionDate:  sessionDate,
 		Duration:     req.Duration,
-		Status:       "pending",
+		Status:       initialSessionStatus(price.Amount),
 		Notes:        req.Notes,
 	}
 
-	if err := db.Create(&session).Error; err != nil {
+	// Paid sessions come out of the wallet when the user has a credit that
+	// fits, unless they ask to pay instead.
+	useCredits := price.Amount > 0 && promo == nil && (req.UseCredits == nil || *req.UseCredits)
+	var credit *CreditLedgerEntry
+	var redemption *PromoRedemption
+	err = reserveSession(&session, 0, func(tx *gorm.DB) error {
+		if useCredits {
+			available, err := availableCredits(tx, userID, counsellor.ID, req.Duration, price)
+			if err != nil {
+				return err
+			}
+			if available > 0 {
+				session.Status = SessionPending
+			}
+		}
+
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+
+		if promo != nil {
+			var err error
+			redemption, err = redeemPromo(tx, *promo, PromoRedemption{UserID: userID, SessionID: &session.ID, Discount: promo.Discount})
+			return err
+		}
+		if useCredits && session.Status == SessionPending {
+			var err error
+			credit, err = consumeCredit(tx, session, price)
+			return err
+		}
+		return nil
+	})
+	if respondBookingConflict(c, err, counsellor, userID, sessionDate, req.Duration) {
+		return
+	}
+	if respondPromoError(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to book session"})
 		return
 	}
 
+	var intent *PaymentIntent
+	if credit == nil && price.Amount > 0 {
+		intent, err = createPaymentIntent(PaymentIntent{UserID: userID, SessionID: &session.ID}, price)
+		if err != nil {
+			log.Printf("failed to create payment for session %d: %v", session.ID, err)
+			abandonUnpaidSessions([]Session{session})
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start payment"})
+			return
+		}
+	}
+
 	// Load relationships
 	db.Preload("User").Preload("Counsellor").First(&session, session.ID)
 
-	c.JSON(http.StatusCreated, session)
+	response := presentSession(session)
+	response.Payment = intent
+	response.Credit = credit
+	response.Promo = redemption
+	c.JSON(http.StatusCreated, response)
 }
 
 func getUserSessions(c *gin.Context) {
@@ -706,6 +1060,7 @@ func getUserSessions(c *gin.Context) {
 
 	var sessions []Session
 	if err := db.Where("user_id = ?", userID).
+		Preload("User").
 		Preload("Counsellor").
 		Order("session_date DESC").
 		Find(&sessions).Error; err != nil {
@@ -713,7 +1068,7 @@ func getUserSessions(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, sessions)
+	c.JSON(http.StatusOK, presentSessions(sessions))
 }
 
 func getSession(c *gin.Context) {
@@ -729,21 +1084,42 @@ func getSession(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, session)
+	c.JSON(http.StatusOK, presentSession(session))
 }
 
 func cancelSession(c *gin.Context) {
 	userID := c.MustGet("user_id").(uint)
 	sessionID := c.Param("id")
 
-	if err := db.Model(&Session{}).
-		Where("id = ? AND user_id = ?", sessionID, userID).
-		Update("status", "cancelled").Error; err != nil {
+	// The body is optional
+	var req CancelSessionRequest
+	c.ShouldBindJSON(&req)
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	var outcome CancellationOutcome
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionSession(tx, &session, SessionCancelledByUser, userID, req.Reason); err != nil {
+			return err
+		}
+
+		var err error
+		outcome, err = applyCancellationPolicy(tx, &session, SessionCancelledByUser, req.Reason)
+		return err
+	})
+	if respondSessionTransitionError(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel session"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Session cancelled successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Session cancelled successfully", "cancellation": outcome})
 }
 
 // Admin handlers
@@ -754,10 +1130,50 @@ func createCounsellor(c *gin.Context) {
 		return
 	}
 
-	if err := db.Create(&counsellor).Error; err != nil {
+	if counsellor.Timezone != "" && !isValidTimezone(counsellor.Timezone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+		return
+	}
+
+	// Prices may still be sent as a single display string, which is taken
+	// as the standard session price.
+	prices := counsellor.Prices
+	if len(prices) == 0 && counsellor.Price != "" {
+		legacy, err := parseMoney(counsellor.Price)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		counsellor.Currency = legacy.Currency
+		prices = []CounsellorPrice{{Duration: defaultSlotDuration, Amount: legacy.Amount}}
+	}
+
+	if counsellor.Currency == "" {
+		counsellor.Currency = defaultCurrency
+	}
+	if !isValidCurrency(counsellor.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return
+	}
+	if err := validatePrices(prices); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	counsellor.Prices = nil
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&counsellor).Error; err != nil {
+			return err
+		}
+		if err := seedCounsellorAvailability(tx, counsellor.ID); err != nil {
+			return err
+		}
+		return setCounsellorPrices(tx, &counsellor, counsellor.Currency, prices)
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create counsellor"})
 		return
 	}
+	counsellor.AfterFind(db)
 
 	c.JSON(http.StatusCreated, counsellor)
 }
@@ -772,20 +1188,59 @@ func getVerificationRequests(c *gin.Context) {
 	c.JSON(http.StatusOK, requests)
 }
 
-func approveVerification(c *gin.Context) {
-	id := c.Param("id")
+// loadVerificationForDecision loads the request a reviewer is approving or
+// rejecting. Only its assigned reviewer, or someone who may assign
+// reviewers, can decide it, and only while it is pending. It writes the
+// error response and returns false otherwise.
+func loadVerificationForDecision(c *gin.Context) (VerificationRequest, bool) {
+	userID := c.MustGet("user_id").(uint)
 
 	var request VerificationRequest
-	if err := db.First(&request, id).Error; err != nil {
+	if err := db.First(&request, c.Param("id")).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Verification request not found"})
+		return request, false
+	}
+
+	if !hasPermission(c.GetString("role"), PermVerificationAssign) &&
+		(request.ReviewerID == nil || *request.ReviewerID != userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Verification request is not assigned to you"})
+		return request, false
+	}
+
+	if request.Status != "pending" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Verification request has already been reviewed"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// decideVerification records a decision on a pending request. It reports
+// false if the request was decided since it was loaded.
+func decideVerification(request VerificationRequest, updates map[string]interface{}) (bool, error) {
+	updates["reviewed_at"] = time.Now()
+	result := db.Model(&VerificationRequest{}).
+		Where("id = ? AND status = ?", request.ID, "pending").
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+func approveVerification(c *gin.Context) {
+	request, ok := loadVerificationForDecision(c)
+	if !ok {
 		return
 	}
 
 	// Update verification request status
-	if err := db.Model(&request).Update("status", "approved").Error; err != nil {
+	decided, err := decideVerification(request, map[string]interface{}{"status": "approved"})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve verification"})
 		return
 	}
+	if !decided {
+		c.JSON(http.StatusConflict, gin.H{"error": "Verification request has already been reviewed"})
+		return
+	}
 
 	// Update user verification status
 	if request.Type == "photo" {
@@ -798,11 +1253,8 @@ func approveVerification(c *gin.Context) {
 }
 
 func rejectVerification(c *gin.Context) {
-	id := c.Param("id")
-
-	var request VerificationRequest
-	if err := db.First(&request, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Verification request not found"})
+	request, ok := loadVerificationForDecision(c)
+	if !ok {
 		return
 	}
 
@@ -820,25 +1272,30 @@ func rejectVerification(c *gin.Context) {
 	}
 
 	// Update verification request
-	updates := map[string]interface{}{
+	decided, err := decideVerification(request, map[string]interface{}{
 		"status": "rejected",
 		"reason": reason,
-	}
-
-	if err := db.Model(&request).Updates(updates).Error; err != nil {
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject verification"})
 		return
 	}
+	if !decided {
+		c.JSON(http.StatusConflict, gin.H{"error": "Verification request has already been reviewed"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Verification rejected successfully"})
 }
 
 // Utility functions
-func generateJWT(userID uint) (string, error) {
+func generateJWT(user User, familyID string) (string, error) {
 	claims := Claims{
-		UserID: userID,
+		UserID:   user.ID,
+		FamilyID: familyID,
+		Role:     user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -847,6 +1304,30 @@ func generateJWT(userID uint) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// parseSessionDate accepts any RFC 3339 timestamp, including offsets, and
+// normalises it to UTC for storage.
+func parseSessionDate(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
 func generateRandomString(length int) string {
 	bytes := make([]byte, length)
 	rand.Read(bytes)
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// setupTestDB points the package globals at a fresh database, blob store,
+// invoice directory, mailer and fake payment gateway for one test.
+func setupTestDB(t *testing.T) *testMailer {
+	t.Helper()
+
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000&_sync=OFF&_journal_mode=MEMORY"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := migrateSchema(conn); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	db = conn
+	blobStore = newMemoryBlobStore()
+	invoiceDir = filepath.Join(t.TempDir(), "invoices")
+	m := &testMailer{}
+	mailer = m
+
+	gateway := newFakeGateway()
+	gateway.webhookSecret = "test-webhook-secret"
+	paymentProvider, refundGateway = gateway, gateway
+	return m
+}
+
+// testMailer records the messages it is asked to send.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testMail
+}
+
+type testMail struct {
+	To, Subject, Body string
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, testMail{to, subject, body})
+	return nil
+}
+
+func (m *testMailer) last() testMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return testMail{}
+	}
+	return m.sent[len(m.sent)-1]
+}
+
+func createTestUser(t *testing.T, email, role string) User {
+	t.Helper()
+	user := User{Name: "Test User", Email: email, Password: "x", Role: role, Timezone: defaultTimezone, IsVerified: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+// newTestRequest builds a request with body, if any, encoded as JSON.
+func newTestRequest(method, target string, body any) *http.Request {
+	var encoded []byte
+	if body != nil {
+		encoded, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// serveTest runs handler for one request as the given user, the way it runs
+// behind authMiddleware. route is the gin pattern, e.g. "/sessions/:id".
+func serveTest(handler gin.HandlerFunc, method, route, target string, body any, userID uint, role string) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(method, route, func(c *gin.Context) {
+		if userID != 0 {
+			c.Set("user_id", userID)
+			c.Set("role", role)
+		}
+		c.Next()
+	}, handler)
+
+	req := newTestRequest(method, target, body)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createTestCounsellor adds a priced counsellor, linked to a login account
+// when user is non-nil.
+func createTestCounsellor(t *testing.T, name string, user *User) Counsellor {
+	t.Helper()
+	counsellor := Counsellor{Name: name, Role: "Counselling Psychologist", Prices: inrPrices(500, 800, 1400), Timezone: defaultTimezone}
+	if user != nil {
+		counsellor.UserID = &user.ID
+	}
+	if err := db.Create(&counsellor).Error; err != nil {
+		t.Fatalf("create counsellor: %v", err)
+	}
+	return counsellor
+}
+
+func createTestSession(t *testing.T, user User, counsellor Counsellor, start time.Time, status string) Session {
+	t.Helper()
+	session := Session{UserID: user.ID, CounsellorID: counsellor.ID, SessionDate: start.UTC(), Duration: 50, Status: status}
+	if err := db.Create(&session).Error; err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return session
+}
+
+// openAllWeek makes the counsellor available around the clock.
+func openAllWeek(t *testing.T, counsellor Counsellor) {
+	t.Helper()
+	for weekday := 0; weekday < 7; weekday++ {
+		if err := db.Create(&AvailabilityRule{CounsellorID: counsellor.ID, Weekday: weekday, StartTime: "00:00", EndTime: "24:00"}).Error; err != nil {
+			t.Fatalf("create availability: %v", err)
+		}
+	}
+}
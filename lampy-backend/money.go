@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyInfo describes an ISO 4217 currency: the number of digits in its
+// minor unit and the symbol used when formatting amounts.
+type currencyInfo struct {
+	exponent int
+	symbol   string
+}
+
+// currencies are the ISO 4217 currencies prices may be set in.
+var currencies = map[string]currencyInfo{
+	"INR": {2, "₹"},
+	"USD": {2, "$"},
+	"EUR": {2, "€"},
+	"GBP": {2, "£"},
+	"AUD": {2, "A$"},
+	"CAD": {2, "C$"},
+	"SGD": {2, "S$"},
+	"AED": {2, "AED "},
+	"JPY": {0, "¥"},
+}
+
+const defaultCurrency = "INR"
+
+// Money is an amount in the minor unit of its currency, e.g. paise for INR.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func isValidCurrency(code string) bool {
+	_, ok := currencies[code]
+	return ok
+}
+
+// String formats the amount for display, e.g. "₹5,000" or "$12.50".
+// Fractions are shown only when non-zero.
+func (m Money) String() string {
+	return m.format(currencySymbol(m.Currency), false)
+}
+
+// Statement formats the amount for financial documents, with the ISO code
+// and every minor digit, e.g. "INR 5,000.00".
+func (m Money) Statement() string {
+	return m.format(m.Currency+" ", true)
+}
+
+func currencySymbol(code string) string {
+	if info, ok := currencies[code]; ok {
+		return info.symbol
+	}
+	return code + " "
+}
+
+func (m Money) format(prefix string, fullFraction bool) string {
+	exponent := 2
+	if info, ok := currencies[m.Currency]; ok {
+		exponent = info.exponent
+	}
+
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	unit := int64(1)
+	for i := 0; i < exponent; i++ {
+		unit *= 10
+	}
+
+	whole := strconv.FormatInt(amount/unit, 10)
+	var grouped strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(r)
+	}
+
+	s := sign + prefix + grouped.String()
+	if fraction := amount % unit; exponent > 0 && (fraction != 0 || fullFraction) {
+		s += fmt.Sprintf(".%0*d", exponent, fraction)
+	}
+	return s
+}
+
+// parseMoney reads a display amount such as "₹5000", "₹1,200.50" or
+// "USD 40" into minor units. Amounts without a recognised symbol or code
+// are taken to be in the default currency.
+func parseMoney(value string) (Money, error) {
+	value = strings.TrimSpace(value)
+	currency := defaultCurrency
+
+	// The currency is given by a leading ISO code or symbol.
+	best := ""
+	for code, info := range currencies {
+		for _, prefix := range []string{code, strings.TrimSpace(info.symbol)} {
+			if strings.HasPrefix(value, prefix) && len(prefix) > len(best) {
+				best = prefix
+				currency = code
+			}
+		}
+	}
+	value = strings.TrimSpace(strings.TrimPrefix(value, best))
+	value = strings.ReplaceAll(value, ",", "")
+
+	info := currencies[currency]
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" || len(fraction) > info.exponent {
+		return Money{}, errors.New("invalid amount " + strconv.Quote(value))
+	}
+	fraction += strings.Repeat("0", info.exponent-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || amount < 0 {
+		return Money{}, errors.New("invalid amount " + strconv.Quote(value))
+	}
+
+	return Money{Amount: amount, Currency: currency}, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Money
+		wantErr bool
+	}{
+		{value: "₹5000", want: Money{500000, "INR"}},
+		{value: "₹1,200.50", want: Money{120050, "INR"}},
+		{value: " ₹ 800 ", want: Money{80000, "INR"}},
+		{value: "5000", want: Money{500000, "INR"}},
+		{value: "USD 40", want: Money{4000, "USD"}},
+		{value: "$12.5", want: Money{1250, "USD"}},
+		{value: "A$10", want: Money{1000, "AUD"}},
+		{value: "AED 99.99", want: Money{9999, "AED"}},
+		{value: "¥500", want: Money{500, "JPY"}},
+		{value: "¥5.5", wantErr: true},
+		{value: "₹1.234", wantErr: true},
+		{value: "-5", wantErr: true},
+		{value: "Free", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseMoney(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMoney(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMoney(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	tests := []struct {
+		money         Money
+		wantString    string
+		wantStatement string
+	}{
+		{Money{500000, "INR"}, "₹5,000", "INR 5,000.00"},
+		{Money{1250, "USD"}, "$12.50", "USD 12.50"},
+		{Money{5, "EUR"}, "€0.05", "EUR 0.05"},
+		{Money{123456789, "INR"}, "₹1,234,567.89", "INR 1,234,567.89"},
+		{Money{-5000, "INR"}, "-₹50", "-INR 50.00"},
+		{Money{500, "JPY"}, "¥500", "JPY 500"},
+		{Money{100, "XYZ"}, "XYZ 1", "XYZ 1.00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantStatement, func(t *testing.T) {
+			if got := tt.money.String(); got != tt.wantString {
+				t.Errorf("String() = %q, want %q", got, tt.wantString)
+			}
+			if got := tt.money.Statement(); got != tt.wantStatement {
+				t.Errorf("Statement() = %q, want %q", got, tt.wantStatement)
+			}
+		})
+	}
+}
+
+func TestMoneyRoundTrip(t *testing.T) {
+	for _, m := range []Money{{0, "INR"}, {99, "INR"}, {120050, "INR"}, {4000, "USD"}, {500, "JPY"}} {
+		got, err := parseMoney(m.String())
+		if err != nil || got != m {
+			t.Errorf("parseMoney(%q) = %+v, %v; want %+v", m.String(), got, err, m)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Recipient is the contact details a notifier may use to reach someone.
+type Recipient struct {
+	UserID    uint
+	Name      string
+	Email     string
+	PushToken string
+}
+
+// Notification is a channel-agnostic message.
+type Notification struct {
+	Title string
+	Body  string
+	Data  map[string]interface{}
+}
+
+// Notifier delivers notifications over one channel. Notify returns
+// errNoAddress when the recipient cannot be reached on that channel.
+type Notifier interface {
+	Channel() string
+	Notify(to Recipient, n Notification) error
+}
+
+var errNoAddress = errors.New("recipient has no address for this channel")
+
+var notifiers []Notifier
+
+// initNotifiers builds the enabled channels from NOTIFIERS, a comma
+// separated list of "email", "push" and "log".
+func initNotifiers() {
+	notifiers = nil
+	for _, name := range strings.Split(getEnv("NOTIFIERS", "log"), ",") {
+		switch strings.TrimSpace(name) {
+		case "email":
+			notifiers = append(notifiers, &emailNotifier{})
+		case "push":
+			notifiers = append(notifiers, &expoPushNotifier{
+				endpoint: getEnv("EXPO_PUSH_URL", "https://exp.host/--/api/v2/push/send"),
+				token:    os.Getenv("EXPO_ACCESS_TOKEN"),
+				client:   &http.Client{Timeout: 10 * time.Second},
+			})
+		case "log":
+			notifiers = append(notifiers, &logNotifier{dir: os.Getenv("NOTIFY_DIR")})
+		}
+	}
+}
+
+// emailNotifier sends notifications through the configured mailer.
+type emailNotifier struct{}
+
+func (n *emailNotifier) Channel() string { return "email" }
+
+func (n *emailNotifier) Notify(to Recipient, msg Notification) error {
+	if to.Email == "" {
+		return errNoAddress
+	}
+	return mailer.Send(to.Email, msg.Title, "Hi "+to.Name+",\n\n"+msg.Body)
+}
+
+// expoPushNotifier sends push notifications through the Expo push service
+// used by the mobile app.
+type expoPushNotifier struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func (n *expoPushNotifier) Channel() string { return "push" }
+
+func (n *expoPushNotifier) Notify(to Recipient, msg Notification) error {
+	if to.PushToken == "" {
+		return errNoAddress
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"to":    to.PushToken,
+		"title": msg.Title,
+		"body":  msg.Body,
+		"data":  msg.Data,
+		"sound": "default",
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Expo reports per-message failures inside a 200 response.
+	var result struct {
+		Data struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"data"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expo push returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Data.Status == "error" {
+		return fmt.Errorf("expo push rejected message: %s", result.Data.Message)
+	}
+	return nil
+}
+
+// logNotifier is the local stand-in. It logs every notification and, when
+// dir is set, appends it to a JSON lines file there.
+type logNotifier struct {
+	dir string
+}
+
+func (n *logNotifier) Channel() string { return "log" }
+
+func (n *logNotifier) Notify(to Recipient, msg Notification) error {
+	log.Printf("🔔 notify user=%d title=%q body=%q", to.UserID, msg.Title, msg.Body)
+
+	if n.dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(n.dir, 0755); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"user_id": to.UserID,
+		"title":   msg.Title,
+		"body":    msg.Body,
+		"data":    msg.Data,
+		"sent_at": time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(n.dir, "notifications.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Package purchase statuses
+const (
+	PurchasePendingPayment = "pending_payment"
+	PurchaseActive         = "active"
+	PurchaseExpired        = "expired"
+)
+
+// Credit ledger entry types
+const (
+	CreditGrant   = "grant"
+	CreditConsume = "consume"
+	CreditRestore = "restore"
+	CreditExpire  = "expire"
+)
+
+var creditExpiryInterval = time.Hour
+
+// Package is a bundle of session credits sold at a set price. Credits are
+// for sessions of one length, either with one counsellor or, when
+// CounsellorID is nil, with any counsellor in a price tier: those whose
+// price for the length, in the package currency, is at most MaxSessionPrice.
+type Package struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	Name            string    `json:"name" gorm:"not null"`
+	CounsellorID    *uint     `json:"counsellor_id,omitempty" gorm:"index"`
+	MaxSessionPrice int64     `json:"max_session_price,omitempty"` // minor units; tier packages only
+	Duration        int       `json:"duration" gorm:"not null"`
+	Sessions        int       `json:"sessions" gorm:"not null"`
+	Price           int64     `json:"price"` // minor units, for the whole package
+	Currency        string    `json:"currency"`
+	ValidityDays    int       `json:"validity_days"`
+	Active          bool      `json:"active" gorm:"default:true"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// PackagePurchase is one bought package: a lot of credits in the user's
+// wallet. The package terms are copied so later edits to the package do not
+// change what was bought.
+type PackagePurchase struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	UserID          uint       `json:"user_id" gorm:"index;not null"`
+	PackageID       uint       `json:"package_id" gorm:"index;not null"`
+	Name            string     `json:"name"`
+	CounsellorID    *uint      `json:"counsellor_id,omitempty"`
+	MaxSessionPrice int64      `json:"max_session_price,omitempty"`
+	Duration        int        `json:"duration"`
+	Credits         int        `json:"credits"`
+	Price           int64      `json:"price"`
+	Currency        string     `json:"currency"`
+	ValidityDays    int        `json:"-"`
+	Status          string     `json:"status" gorm:"index"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"` // set when the purchase is paid for
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// CreditLedgerEntry is an append-only record of credits moving in or out of
+// a purchase. A purchase's balance is the sum of its entries.
+type CreditLedgerEntry struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"user_id" gorm:"index;not null"`
+	PurchaseID uint      `json:"purchase_id" gorm:"index;not null"`
+	SessionID  *uint     `json:"session_id,omitempty" gorm:"index"`
+	Type       string    `json:"type"`
+	Credits    int       `json:"credits"` // negative when credits are used or expire
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type PackageRequest struct {
+	Name            string `json:"name" binding:"required"`
+	CounsellorID    *uint  `json:"counsellor_id"`
+	MaxSessionPrice int64  `json:"max_session_price" binding:"min=0"` // required without a counsellor
+	Duration        int    `json:"duration" binding:"required"`
+	Sessions        int    `json:"sessions" binding:"required,min=1,max=100"`
+	Price           int64  `json:"price" binding:"min=0"`
+	Currency        string `json:"currency"`
+	ValidityDays    int    `json:"validity_days" binding:"required,min=1,max=1095"`
+	Active          *bool  `json:"active"`
+}
+
+// PackageOffer is a package as listed to users. For counsellor packages it
+// includes what the sessions would cost individually.
+type PackageOffer struct {
+	Package
+	RegularPrice    int64 `json:"regular_price,omitempty"`
+	DiscountPercent int   `json:"discount_percent,omitempty"`
+}
+
+// WalletLot is a purchase with the credits left on it.
+type WalletLot struct {
+	PackagePurchase
+	Remaining int `json:"remaining"`
+}
+
+// creditBalance is a subquery for the credits left on each purchase.
+const creditBalance = "(SELECT COALESCE(SUM(credits), 0) FROM credit_ledger_entries WHERE credit_ledger_entries.purchase_id = package_purchases.id)"
+
+// usableLots returns the query for purchases that can pay for a session with
+// the counsellor of the given length and price, soonest to expire first.
+// Tier purchases only cover counsellors priced within the tier.
+func usableLots(tx *gorm.DB, userID, counsellorID uint, duration int, price Money) *gorm.DB {
+	return tx.Model(&PackagePurchase{}).
+		Where("user_id = ? AND status = ? AND expires_at > ?", userID, PurchaseActive, time.Now()).
+		Where("counsellor_id = ? OR (counsellor_id IS NULL AND max_session_price >= ?)", counsellorID, price.Amount).
+		Where("duration = ? AND currency = ?", duration, price.Currency).
+		Where(creditBalance + " > 0").
+		Order("expires_at, id")
+}
+
+// availableCredits counts the credits that could pay for sessions with the
+// counsellor of the given length and price.
+func availableCredits(tx *gorm.DB, userID, counsellorID uint, duration int, price Money) (int, error) {
+	var total int
+	err := usableLots(tx, userID, counsellorID, duration, price).Select("COALESCE(SUM(" + creditBalance + "), 0)").Scan(&total).Error
+	return total, err
+}
+
+// consumeCredit pays for session, which would cost price, with a credit from
+// the wallet, if the user has one that fits, and returns the ledger entry.
+// It returns nil when no credit fits.
+func consumeCredit(tx *gorm.DB, session Session, price Money) (*CreditLedgerEntry, error) {
+	var lot PackagePurchase
+	err := usableLots(tx, session.UserID, session.CounsellorID, session.Duration, price).First(&lot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := CreditLedgerEntry{
+		UserID:     session.UserID,
+		PurchaseID: lot.ID,
+		SessionID:  &session.ID,
+		Type:       CreditConsume,
+		Credits:    -1,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// restoreCredit returns the credit a session was paid with to the purchase
+// it came from. It reports whether there was one to return.
+func restoreCredit(tx *gorm.DB, session Session, note string) (bool, error) {
+	var entries []CreditLedgerEntry
+	if err := tx.Where("session_id = ?", session.ID).Find(&entries).Error; err != nil {
+		return false, err
+	}
+
+	net := 0
+	for _, e := range entries {
+		net += e.Credits
+	}
+	if len(entries) == 0 || net >= 0 {
+		return false, nil
+	}
+
+	return true, tx.Create(&CreditLedgerEntry{
+		UserID:     session.UserID,
+		PurchaseID: entries[0].PurchaseID,
+		SessionID:  &session.ID,
+		Type:       CreditRestore,
+		Credits:    -net,
+		Note:       note,
+	}).Error
+}
+
+// paidWithCredit reports whether session is currently paid for by a credit.
+func paidWithCredit(tx *gorm.DB, sessionID uint) bool {
+	var net int
+	tx.Model(&CreditLedgerEntry{}).Select("COALESCE(SUM(credits), 0)").Where("session_id = ?", sessionID).Scan(&net)
+	return net < 0
+}
+
+// activatePackagePurchase puts a paid purchase's credits in the wallet.
+func activatePackagePurchase(tx *gorm.DB, purchaseID uint) error {
+	var purchase PackagePurchase
+	if err := tx.First(&purchase, purchaseID).Error; err != nil {
+		return err
+	}
+	if purchase.Status != PurchasePendingPayment {
+		return nil
+	}
+
+	expiresAt := time.Now().AddDate(0, 0, purchase.ValidityDays)
+	if err := tx.Model(&purchase).Updates(map[string]interface{}{
+		"status":     PurchaseActive,
+		"expires_at": expiresAt,
+	}).Error; err != nil {
+		return err
+	}
+
+	return tx.Create(&CreditLedgerEntry{
+		UserID:     purchase.UserID,
+		PurchaseID: purchase.ID,
+		Type:       CreditGrant,
+		Credits:    purchase.Credits,
+	}).Error
+}
+
+// expireCredits writes off the credits left on purchases past their expiry.
+func expireCredits() {
+	var lots []WalletLot
+	if err := db.Model(&PackagePurchase{}).
+		Select("package_purchases.*, "+creditBalance+" AS remaining").
+		Where("status IN ? AND expires_at <= ?", []string{PurchaseActive, PurchaseExpired}, time.Now()).
+		Where(creditBalance + " > 0").
+		Scan(&lots).Error; err != nil {
+		log.Printf("failed to look up expired credits: %v", err)
+		return
+	}
+
+	for _, lot := range lots {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&CreditLedgerEntry{
+				UserID:     lot.UserID,
+				PurchaseID: lot.ID,
+				Type:       CreditExpire,
+				Credits:    -lot.Remaining,
+			}).Error; err != nil {
+				return err
+			}
+			return tx.Model(&PackagePurchase{}).Where("id = ?", lot.ID).Update("status", PurchaseExpired).Error
+		})
+		if err != nil {
+			log.Printf("failed to expire credits of purchase %d: %v", lot.ID, err)
+		}
+	}
+}
+
+func startCreditExpiryJob() {
+	go func() {
+		ticker := time.NewTicker(creditExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			expireCredits()
+			<-ticker.C
+		}
+	}()
+}
+
+// Package handlers
+func getPackages(c *gin.Context) {
+	query := db.Where("active = ?", true)
+	var forCounsellor *Counsellor
+	if counsellorID := c.Query("counsellor_id"); counsellorID != "" {
+		var counsellor Counsellor
+		if err := db.First(&counsellor, counsellorID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+			return
+		}
+		forCounsellor = &counsellor
+		query = query.Where("counsellor_id IS NULL OR counsellor_id = ?", counsellor.ID)
+	}
+
+	var packages []Package
+	if err := query.Order("counsellor_id, duration, sessions").Find(&packages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch packages"})
+		return
+	}
+
+	offers := make([]PackageOffer, 0, len(packages))
+	for _, p := range packages {
+		// Tier packages are only listed for counsellors inside the tier
+		if forCounsellor != nil && p.CounsellorID == nil {
+			price, err := sessionPrice(*forCounsellor, p.Duration)
+			if err != nil || price.Currency != p.Currency || price.Amount > p.MaxSessionPrice {
+				continue
+			}
+		}
+
+		offer := PackageOffer{Package: p}
+		var counsellor Counsellor
+		if p.CounsellorID != nil && db.First(&counsellor, *p.CounsellorID).Error == nil {
+			price, err := sessionPrice(counsellor, p.Duration)
+			if err == nil && price.Amount > 0 && price.Currency == p.Currency {
+				offer.RegularPrice = price.Amount * int64(p.Sessions)
+				offer.DiscountPercent = int(100 - p.Price*100/offer.RegularPrice)
+			}
+		}
+		offers = append(offers, offer)
+	}
+
+	c.JSON(http.StatusOK, offers)
+}
+
+func purchasePackage(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var pkg Package
+	if err := db.Where("id = ? AND active = ?", c.Param("id"), true).First(&pkg).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
+		return
+	}
+
+	purchase := PackagePurchase{
+		UserID:          userID,
+		PackageID:       pkg.ID,
+		Name:            pkg.Name,
+		CounsellorID:    pkg.CounsellorID,
+		MaxSessionPrice: pkg.MaxSessionPrice,
+		Duration:        pkg.Duration,
+		Credits:         pkg.Sessions,
+		Price:           pkg.Price,
+		Currency:        pkg.Currency,
+		ValidityDays:    pkg.ValidityDays,
+		Status:          PurchasePendingPayment,
+	}
+	if err := db.Create(&purchase).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create purchase"})
+		return
+	}
+
+	var intent *PaymentIntent
+	if pkg.Price > 0 {
+		var err error
+		intent, err = createPaymentIntent(PaymentIntent{UserID: userID, PackagePurchaseID: &purchase.ID}, Money{Amount: pkg.Price, Currency: pkg.Currency})
+		if err != nil {
+			log.Printf("failed to create payment for package purchase %d: %v", purchase.ID, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start payment"})
+			return
+		}
+	} else if err := db.Transaction(func(tx *gorm.DB) error {
+		return activatePackagePurchase(tx, purchase.ID)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate package"})
+		return
+	}
+
+	db.First(&purchase, purchase.ID)
+	c.JSON(http.StatusCreated, gin.H{"purchase": purchase, "payment": intent})
+}
+
+// User handlers
+func getWallet(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var lots []WalletLot
+	if err := db.Model(&PackagePurchase{}).
+		Select("package_purchases.*, "+creditBalance+" AS remaining").
+		Where("user_id = ? AND status <> ?", userID, PurchasePendingPayment).
+		Order("expires_at").
+		Scan(&lots).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wallet"})
+		return
+	}
+
+	total := 0
+	for _, lot := range lots {
+		if lot.Status == PurchaseActive {
+			total += lot.Remaining
+		}
+	}
+
+	var ledger []CreditLedgerEntry
+	db.Where("user_id = ?", userID).Order("id DESC").Limit(50).Find(&ledger)
+
+	c.JSON(http.StatusOK, gin.H{
+		"credits": total,
+		"lots":    lots,
+		"ledger":  ledger,
+	})
+}
+
+// Admin handlers
+func createPackage(c *gin.Context) {
+	var req PackageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pkg := Package{Active: true}
+	if !applyPackageRequest(c, &pkg, req) {
+		return
+	}
+
+	if err := db.Create(&pkg).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create package"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, pkg)
+}
+
+// updatePackage changes a package for future purchases. Credits already
+// bought keep the terms they were bought on.
+func updatePackage(c *gin.Context) {
+	var pkg Package
+	if err := db.First(&pkg, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Package not found"})
+		return
+	}
+
+	var req PackageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !applyPackageRequest(c, &pkg, req) {
+		return
+	}
+
+	if err := db.Save(&pkg).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update package"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg)
+}
+
+// applyPackageRequest validates req and copies it onto pkg, writing a 400
+// and returning false if it is invalid.
+func applyPackageRequest(c *gin.Context, pkg *Package, req PackageRequest) bool {
+	if validatePrices([]CounsellorPrice{{Duration: req.Duration}}) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Duration must be one of the priced session lengths", "durations": pricedDurations})
+		return false
+	}
+
+	if req.CounsellorID == nil && req.MaxSessionPrice <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Packages without a counsellor need a max_session_price for their tier"})
+		return false
+	}
+
+	currency := req.Currency
+	if req.CounsellorID != nil {
+		var counsellor Counsellor
+		if err := db.First(&counsellor, *req.CounsellorID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+			return false
+		}
+		if currency == "" {
+			currency = counsellor.Currency
+		}
+	}
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if !isValidCurrency(currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return false
+	}
+
+	pkg.Name = req.Name
+	pkg.CounsellorID = req.CounsellorID
+	pkg.MaxSessionPrice = 0
+	if req.CounsellorID == nil {
+		pkg.MaxSessionPrice = req.MaxSessionPrice
+	}
+	pkg.Duration = req.Duration
+	pkg.Sessions = req.Sessions
+	pkg.Price = req.Price
+	pkg.Currency = currency
+	pkg.ValidityDays = req.ValidityDays
+	if req.Active != nil {
+		pkg.Active = *req.Active
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// buyPackage puts a paid purchase with the given terms in the user's wallet.
+func buyPackage(t *testing.T, purchase PackagePurchase) PackagePurchase {
+	t.Helper()
+	purchase.Status = PurchasePendingPayment
+	if purchase.ValidityDays == 0 {
+		purchase.ValidityDays = 90
+	}
+	if purchase.Currency == "" {
+		purchase.Currency = "INR"
+	}
+	if err := db.Create(&purchase).Error; err != nil {
+		t.Fatalf("create purchase: %v", err)
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error { return activatePackagePurchase(tx, purchase.ID) }); err != nil {
+		t.Fatalf("activate purchase: %v", err)
+	}
+	db.First(&purchase, purchase.ID)
+	return purchase
+}
+
+func creditsLeft(purchaseID uint) int {
+	var left int
+	db.Model(&CreditLedgerEntry{}).Select("COALESCE(SUM(credits), 0)").Where("purchase_id = ?", purchaseID).Scan(&left)
+	return left
+}
+
+func TestAvailableCredits(t *testing.T) {
+	price := Money{Amount: 80000, Currency: "INR"}
+	own, other := uint(1), uint(2)
+
+	tests := []struct {
+		name     string
+		purchase PackagePurchase
+		prepare  func(p *PackagePurchase)
+		want     int
+	}{
+		{name: "counsellor package", purchase: PackagePurchase{CounsellorID: &own, Duration: 50, Credits: 3}, want: 3},
+		{name: "another counsellor's package", purchase: PackagePurchase{CounsellorID: &other, Duration: 50, Credits: 3}, want: 0},
+		{name: "tier above the price", purchase: PackagePurchase{MaxSessionPrice: 100000, Duration: 50, Credits: 2}, want: 2},
+		{name: "tier at the price", purchase: PackagePurchase{MaxSessionPrice: 80000, Duration: 50, Credits: 2}, want: 2},
+		{name: "tier below the price", purchase: PackagePurchase{MaxSessionPrice: 79999, Duration: 50, Credits: 2}, want: 0},
+		{name: "tier without a price", purchase: PackagePurchase{Duration: 50, Credits: 2}, want: 0},
+		{name: "other length", purchase: PackagePurchase{CounsellorID: &own, Duration: 90, Credits: 3}, want: 0},
+		{name: "other currency", purchase: PackagePurchase{MaxSessionPrice: 100000, Duration: 50, Credits: 2, Currency: "USD"}, want: 0},
+		{
+			name:     "expired",
+			purchase: PackagePurchase{CounsellorID: &own, Duration: 50, Credits: 3},
+			prepare:  func(p *PackagePurchase) { db.Model(p).Update("expires_at", time.Now().Add(-time.Minute)) },
+			want:     0,
+		},
+		{
+			name:     "unpaid",
+			purchase: PackagePurchase{CounsellorID: &own, Duration: 50, Credits: 3},
+			prepare:  func(p *PackagePurchase) { db.Model(p).Update("status", PurchasePendingPayment) },
+			want:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			purchase := tt.purchase
+			purchase.UserID = 1
+			purchase = buyPackage(t, purchase)
+			if tt.prepare != nil {
+				tt.prepare(&purchase)
+			}
+
+			got, err := availableCredits(db, 1, own, 50, price)
+			if err != nil || got != tt.want {
+				t.Errorf("availableCredits() = %d, %v; want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsumeAndRestoreCredits(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Wallet", nil)
+	price := Money{Amount: 80000, Currency: "INR"}
+
+	later := buyPackage(t, PackagePurchase{UserID: user.ID, CounsellorID: &counsellor.ID, Duration: 50, Credits: 1, ValidityDays: 60})
+	sooner := buyPackage(t, PackagePurchase{UserID: user.ID, MaxSessionPrice: 100000, Duration: 50, Credits: 1, ValidityDays: 30})
+
+	var sessions []Session
+	for i := 0; i < 3; i++ {
+		sessions = append(sessions, createTestSession(t, user, counsellor, time.Now().Add(time.Duration(i+1)*24*time.Hour), SessionPending))
+	}
+
+	steps := []struct {
+		name       string
+		run        func() (bool, error)
+		wantOK     bool
+		wantSooner int
+		wantLater  int
+	}{
+		{"first credit comes from the lot expiring sooner", func() (bool, error) {
+			entry, err := consumeCredit(db, sessions[0], price)
+			return entry != nil && entry.PurchaseID == sooner.ID, err
+		}, true, 0, 1},
+		{"second credit from the other lot", func() (bool, error) {
+			entry, err := consumeCredit(db, sessions[1], price)
+			return entry != nil && entry.PurchaseID == later.ID, err
+		}, true, 0, 0},
+		{"wallet empty", func() (bool, error) {
+			entry, err := consumeCredit(db, sessions[2], price)
+			return entry != nil, err
+		}, false, 0, 0},
+		{"restore returns the credit to its lot", func() (bool, error) {
+			return restoreCredit(db, sessions[0], "cancelled")
+		}, true, 1, 0},
+		{"restoring twice does nothing", func() (bool, error) {
+			return restoreCredit(db, sessions[0], "cancelled")
+		}, false, 1, 0},
+		{"session paid otherwise has nothing to restore", func() (bool, error) {
+			return restoreCredit(db, sessions[2], "cancelled")
+		}, false, 1, 0},
+	}
+
+	for _, step := range steps {
+		ok, err := step.run()
+		if err != nil || ok != step.wantOK {
+			t.Fatalf("%s: got %v, %v; want %v", step.name, ok, err, step.wantOK)
+		}
+		if s, l := creditsLeft(sooner.ID), creditsLeft(later.ID); s != step.wantSooner || l != step.wantLater {
+			t.Fatalf("%s: balances %d and %d, want %d and %d", step.name, s, l, step.wantSooner, step.wantLater)
+		}
+	}
+
+	if paidWithCredit(db, sessions[0].ID) || !paidWithCredit(db, sessions[1].ID) || paidWithCredit(db, sessions[2].ID) {
+		t.Error("paidWithCredit does not match the ledger")
+	}
+}
+
+func TestExpireCredits(t *testing.T) {
+	setupTestDB(t)
+	live := buyPackage(t, PackagePurchase{UserID: 1, MaxSessionPrice: 1, Duration: 50, Credits: 2})
+	lapsed := buyPackage(t, PackagePurchase{UserID: 1, MaxSessionPrice: 1, Duration: 50, Credits: 3})
+	db.Model(&lapsed).Update("expires_at", time.Now().Add(-time.Hour))
+
+	expireCredits()
+	expireCredits()
+
+	db.First(&lapsed, lapsed.ID)
+	db.First(&live, live.ID)
+	if creditsLeft(lapsed.ID) != 0 || lapsed.Status != PurchaseExpired {
+		t.Errorf("lapsed purchase has %d credits and status %q", creditsLeft(lapsed.ID), lapsed.Status)
+	}
+	if creditsLeft(live.ID) != 2 || live.Status != PurchaseActive {
+		t.Errorf("live purchase has %d credits and status %q", creditsLeft(live.ID), live.Status)
+	}
+	var writeOffs int64
+	db.Model(&CreditLedgerEntry{}).Where("type = ?", CreditExpire).Count(&writeOffs)
+	if writeOffs != 1 {
+		t.Errorf("%d write-offs recorded, want 1", writeOffs)
+	}
+}
+
+func TestBookSessionWithCredit(t *testing.T) {
+	tests := []struct {
+		name        string
+		credits     int
+		useCredits  *bool
+		wantStatus  string
+		wantPayment bool
+		wantLeft    int
+	}{
+		{"credit used", 2, nil, SessionPending, false, 1},
+		{"asked to pay instead", 2, new(bool), SessionPendingPayment, true, 2},
+		{"no credit", 0, nil, SessionPendingPayment, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Wallet", nil)
+			openAllWeek(t, counsellor)
+			var lot PackagePurchase
+			if tt.credits > 0 {
+				lot = buyPackage(t, PackagePurchase{UserID: user.ID, CounsellorID: &counsellor.ID, Duration: 50, Credits: tt.credits})
+			}
+
+			start := time.Now().Add(72 * time.Hour).Truncate(time.Hour)
+			req := SessionBookingRequest{CounsellorID: counsellor.ID, SessionDate: start.Format(time.RFC3339), Duration: 50, UseCredits: tt.useCredits}
+			w := serveTest(bookSession, http.MethodPost, "/book", "/book", req, user.ID, user.Role)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			var session Session
+			db.Where("user_id = ?", user.ID).First(&session)
+			var payments int64
+			db.Model(&PaymentIntent{}).Where("session_id = ?", session.ID).Count(&payments)
+			if session.Status != tt.wantStatus || (payments == 1) != tt.wantPayment {
+				t.Errorf("session %q with %d payments; want %q, payment %v", session.Status, payments, tt.wantStatus, tt.wantPayment)
+			}
+			if tt.credits > 0 && creditsLeft(lot.ID) != tt.wantLeft {
+				t.Errorf("%d credits left, want %d", creditsLeft(lot.ID), tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestGetPackagesForCounsellor(t *testing.T) {
+	setupTestDB(t)
+	counsellor := createTestCounsellor(t, "Dr Wallet", nil) // 50 minutes at 80000 INR
+	other := createTestCounsellor(t, "Dr Other", nil)
+
+	packages := map[string]Package{
+		"own":            {CounsellorID: &counsellor.ID, Duration: 50, Sessions: 5, Price: 360000, Currency: "INR"},
+		"other's":        {CounsellorID: &other.ID, Duration: 50, Sessions: 5, Price: 360000, Currency: "INR"},
+		"tier covering":  {MaxSessionPrice: 100000, Duration: 50, Sessions: 4, Price: 300000, Currency: "INR"},
+		"tier too cheap": {MaxSessionPrice: 50000, Duration: 50, Sessions: 4, Price: 180000, Currency: "INR"},
+		"tier in USD":    {MaxSessionPrice: 100000, Duration: 50, Sessions: 4, Price: 30000, Currency: "USD"},
+		"tier unpriced":  {MaxSessionPrice: 100000, Duration: 45, Sessions: 4, Price: 300000, Currency: "INR"},
+		"inactive":       {CounsellorID: &counsellor.ID, Duration: 50, Sessions: 3, Price: 200000, Currency: "INR"},
+	}
+	for name, p := range packages {
+		p.Name = name
+		db.Create(&p)
+		if name == "inactive" {
+			db.Model(&p).Update("active", false)
+		}
+	}
+
+	w := serveTest(getPackages, http.MethodGet, "/packages", fmt.Sprintf("/packages?counsellor_id=%d", counsellor.ID), nil, 0, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var offers []PackageOffer
+	json.Unmarshal(w.Body.Bytes(), &offers)
+
+	listed := map[string]PackageOffer{}
+	for _, o := range offers {
+		listed[o.Name] = o
+	}
+	if len(listed) != 2 {
+		t.Errorf("listed %v, want own and tier covering", listed)
+	}
+	if own, ok := listed["own"]; !ok || own.RegularPrice != 400000 || own.DiscountPercent != 10 {
+		t.Errorf("own package offer = %+v, want 10%% off 400000", own)
+	}
+	if _, ok := listed["tier covering"]; !ok {
+		t.Error("tier package covering the counsellor is not listed")
+	}
+}
+
+func TestCreatePackage(t *testing.T) {
+	counsellorID := uint(1)
+
+	tests := []struct {
+		name         string
+		body         PackageRequest
+		want         int
+		wantCurrency string
+	}{
+		{"counsellor package", PackageRequest{Name: "Five", CounsellorID: &counsellorID, Duration: 50, Sessions: 5, Price: 360000, ValidityDays: 90}, http.StatusCreated, "INR"},
+		{"tier package", PackageRequest{Name: "Tier", MaxSessionPrice: 100000, Duration: 50, Sessions: 5, Price: 300000, Currency: "USD", ValidityDays: 90}, http.StatusCreated, "USD"},
+		{"tier without a price", PackageRequest{Name: "Tier", Duration: 50, Sessions: 5, ValidityDays: 90}, http.StatusBadRequest, ""},
+		{"unpriced length", PackageRequest{Name: "Odd", CounsellorID: &counsellorID, Duration: 45, Sessions: 5, ValidityDays: 90}, http.StatusBadRequest, ""},
+		{"unknown counsellor", PackageRequest{Name: "Ghost", CounsellorID: new(uint), Duration: 50, Sessions: 5, ValidityDays: 90}, http.StatusNotFound, ""},
+		{"unsupported currency", PackageRequest{Name: "Odd", MaxSessionPrice: 1, Duration: 50, Sessions: 5, Currency: "XYZ", ValidityDays: 90}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "admin@example.com", RoleAdmin)
+			createTestCounsellor(t, "Dr Wallet", nil)
+
+			w := serveTest(createPackage, http.MethodPost, "/packages", "/packages", tt.body, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			var count int64
+			db.Model(&Package{}).Count(&count)
+			if (count == 1) != (tt.want == http.StatusCreated) {
+				t.Fatalf("%d packages stored", count)
+			}
+			if tt.want == http.StatusCreated {
+				var pkg Package
+				db.First(&pkg)
+				if pkg.Currency != tt.wantCurrency {
+					t.Errorf("currency = %q, want %q", pkg.Currency, tt.wantCurrency)
+				}
+			}
+		})
+	}
+}
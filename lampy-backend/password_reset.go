@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var passwordResetTTL = time.Hour
+
+// PasswordResetToken is a single-use password reset link. Only the SHA-256
+// hash of the token sent to the user is stored.
+type PasswordResetToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+var errResetTokenInvalid = errors.New("invalid or expired reset token")
+
+// Auth handlers
+func forgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Always answer the same way so the endpoint cannot be used to probe
+	// which emails are registered.
+	response := gin.H{"message": "If an account exists for that email, a reset link has been sent"}
+
+	var user User
+	if err := db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	raw := generateRandomString(48)
+	token := PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(raw),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+
+	if err := db.Create(&token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+
+	link := getEnv("APP_BASE_URL", "http://localhost:8080") + "/reset-password?token=" + raw
+	body := "Hi " + user.Name + ",\n\nUse the link below to reset your LAMPY password. It expires in one hour.\n\n" +
+		link + "\n\nIf you did not ask for this, you can ignore this email."
+
+	if err := mailer.Send(user.Email, "Reset your LAMPY password", body); err != nil {
+		log.Printf("failed to send password reset email to user %d: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func resetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var token PasswordResetToken
+		if err := tx.Where("token_hash = ?", hashToken(req.Token)).First(&token).Error; err != nil {
+			return errResetTokenInvalid
+		}
+
+		if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+			return errResetTokenInvalid
+		}
+
+		// Burn this token and any other outstanding ones for the user.
+		now := time.Now()
+		result := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errResetTokenInvalid
+		}
+
+		if err := tx.Model(&User{}).Where("id = ?", token.UserID).Update("password", string(hashedPassword)).Error; err != nil {
+			return err
+		}
+
+		return revokeUserTokens(tx, token.UserID)
+	})
+
+	if errors.Is(err, errResetTokenInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// requestPasswordReset runs forgot-password for email and returns the token
+// from the mailed link.
+func requestPasswordReset(t *testing.T, mails *testMailer, email string) string {
+	t.Helper()
+	w := serveTest(forgotPassword, http.MethodPost, "/forgot", "/forgot", ForgotPasswordRequest{Email: email}, 0, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("forgot-password status = %d, body %s", w.Code, w.Body)
+	}
+	_, raw, found := strings.Cut(mails.last().Body, "token=")
+	if !found {
+		t.Fatalf("no reset link mailed: %q", mails.last().Body)
+	}
+	return strings.Fields(raw)[0]
+}
+
+func TestForgotPasswordDoesNotRevealAccounts(t *testing.T) {
+	tests := []struct {
+		email    string
+		wantMail bool
+	}{
+		{"user@example.com", true},
+		{"nobody@example.com", false},
+	}
+
+	var bodies []string
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			mails := setupTestDB(t)
+			createTestUser(t, "user@example.com", RoleUser)
+
+			w := serveTest(forgotPassword, http.MethodPost, "/forgot", "/forgot", ForgotPasswordRequest{Email: tt.email}, 0, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			bodies = append(bodies, w.Body.String())
+
+			if sent := len(mails.sent) > 0; sent != tt.wantMail {
+				t.Errorf("mail sent = %v, want %v", sent, tt.wantMail)
+			}
+		})
+	}
+
+	if len(bodies) == 2 && bodies[0] != bodies[1] {
+		t.Errorf("responses differ for known and unknown emails: %q vs %q", bodies[0], bodies[1])
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, mails *testMailer) string
+		want    int
+	}{
+		{
+			name: "valid token",
+			prepare: func(t *testing.T, mails *testMailer) string {
+				return requestPasswordReset(t, mails, "user@example.com")
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "unknown token",
+			prepare: func(t *testing.T, mails *testMailer) string {
+				return "bogus"
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "expired token",
+			prepare: func(t *testing.T, mails *testMailer) string {
+				raw := requestPasswordReset(t, mails, "user@example.com")
+				db.Model(&PasswordResetToken{}).Where("token_hash = ?", hashToken(raw)).
+					Update("expires_at", time.Now().Add(-time.Second))
+				return raw
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "token already used",
+			prepare: func(t *testing.T, mails *testMailer) string {
+				raw := requestPasswordReset(t, mails, "user@example.com")
+				serveTest(resetPassword, http.MethodPost, "/reset", "/reset", ResetPasswordRequest{Token: raw, Password: "first-pass"}, 0, "")
+				return raw
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "older token burned by a newer reset",
+			prepare: func(t *testing.T, mails *testMailer) string {
+				older := requestPasswordReset(t, mails, "user@example.com")
+				newer := requestPasswordReset(t, mails, "user@example.com")
+				serveTest(resetPassword, http.MethodPost, "/reset", "/reset", ResetPasswordRequest{Token: newer, Password: "first-pass"}, 0, "")
+				return older
+			},
+			want: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mails := setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			session, _ := issueTokenPair(user)
+			raw := tt.prepare(t, mails)
+
+			w := serveTest(resetPassword, http.MethodPost, "/reset", "/reset", ResetPasswordRequest{Token: raw, Password: "new-password"}, 0, "")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&user, user.ID)
+			changed := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("new-password")) == nil
+			if changed != (tt.want == http.StatusOK) {
+				t.Errorf("password changed = %v", changed)
+			}
+
+			if tt.want == http.StatusOK {
+				if _, err := rotateRefreshToken(session.RefreshToken); !errors.Is(err, errRefreshInvalid) {
+					t.Errorf("existing session survived the reset, error = %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeGateway is an in-process stand-in for a real gateway, for local
+// development and testing. Payments are settled by calling the simulate
+// endpoint, which delivers a signed webhook to this server just as a real
+// gateway would. The endpoint is only mounted when FAKE_GATEWAY_SIMULATE is
+// "true", and the fake gateway is refused altogether in release mode.
+type fakeGateway struct {
+	webhookSecret string
+	webhookURL    string
+	client        *http.Client
+	simulate      bool
+
+	// Refunds settle refundDelay after they are created, or fail if
+	// failRefunds is set.
+	refundDelay time.Duration
+	failRefunds bool
+	mu          sync.Mutex
+	refunds     map[string]time.Time
+	references  map[string]string // refund reference to refund ID
+}
+
+type fakeWebhookPayload struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	IntentID  string `json:"intent_id"`
+	PaymentID string `json:"payment_id"`
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+func newFakeGateway() *fakeGateway {
+	return &fakeGateway{
+		webhookSecret: getEnv("FAKE_GATEWAY_SECRET", ""),
+		webhookURL:    getEnv("API_BASE_URL", "http://localhost:8080") + "/api/v1/payments/webhook/fake",
+		client:        &http.Client{Timeout: 10 * time.Second},
+		simulate:      getEnv("FAKE_GATEWAY_SIMULATE", "") == "true",
+		refundDelay:   time.Duration(getEnvInt("FAKE_REFUND_DELAY_SECONDS", 30)) * time.Second,
+		failRefunds:   getEnv("FAKE_REFUND_FAIL", "") == "true",
+		refunds:       make(map[string]time.Time),
+		references:    make(map[string]string),
+	}
+}
+
+func (g *fakeGateway) Name() string { return "fake" }
+
+func (g *fakeGateway) CreateIntent(req IntentRequest) (ProviderIntent, error) {
+	return ProviderIntent{
+		ID:           "fake_pi_" + generateRandomString(16),
+		ClientSecret: "fake_secret_" + generateRandomString(24),
+	}, nil
+}
+
+// CreateRefund is idempotent on the reference, as real gateways are on
+// their idempotency keys.
+func (g *fakeGateway) CreateRefund(req RefundRequest) (ProviderRefund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id, ok := g.references[req.Reference]; ok {
+		return ProviderRefund{ID: id, Status: RefundProcessing}, nil
+	}
+
+	id := "fake_rfnd_" + generateRandomString(16)
+	g.refunds[id] = time.Now()
+	g.references[req.Reference] = id
+	return ProviderRefund{ID: id, Status: RefundProcessing}, nil
+}
+
+func (g *fakeGateway) FindRefund(paymentID, reference string) (ProviderRefund, bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id, ok := g.references[reference]
+	if !ok {
+		return ProviderRefund{}, false, nil
+	}
+	return ProviderRefund{ID: id, Status: RefundProcessing}, true, nil
+}
+
+func (g *fakeGateway) RefundStatus(refundID string) (string, error) {
+	if g.failRefunds {
+		return RefundFailed, nil
+	}
+
+	g.mu.Lock()
+	created, ok := g.refunds[refundID]
+	g.mu.Unlock()
+
+	// Refunds created before a restart are treated as settled.
+	if !ok || time.Since(created) >= g.refundDelay {
+		return RefundSucceeded, nil
+	}
+	return RefundProcessing, nil
+}
+
+// ParseWebhook checks X-Fake-Signature, a hex HMAC-SHA256 of the body.
+func (g *fakeGateway) ParseWebhook(body []byte, header http.Header) (PaymentEvent, error) {
+	if !validHMAC(body, header.Get("X-Fake-Signature"), g.webhookSecret) {
+		return PaymentEvent{}, errInvalidSignature
+	}
+
+	var payload fakeWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ID == "" {
+		return PaymentEvent{}, errors.New("malformed webhook payload")
+	}
+
+	return PaymentEvent(payload), nil
+}
+
+// Payment handlers
+// simulatePayment settles a fake intent as the user paying (outcome
+// "capture") or the payment being declined ("fail"). Set redeliver=true to
+// send the previous event again, as gateways do after a timeout.
+func (g *fakeGateway) simulatePayment(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var intent PaymentIntent
+	if err := db.Where("provider_intent_id = ? AND user_id = ?", c.Param("intent"), userID).First(&intent).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	eventType := EventPaymentCaptured
+	switch c.Param("outcome") {
+	case "capture":
+	case "fail":
+		eventType = EventPaymentFailed
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Outcome must be capture or fail"})
+		return
+	}
+
+	eventID := "fake_evt_" + generateRandomString(16)
+	if c.Query("redeliver") == "true" {
+		var last PaymentWebhookEvent
+		if err := db.Where("provider = ? AND intent_id = ? AND type = ?", g.Name(), intent.ProviderIntentID, eventType).
+			Order("created_at DESC").First(&last).Error; err == nil {
+			eventID = last.EventID
+		}
+	}
+
+	body, _ := json.Marshal(fakeWebhookPayload{
+		ID:        eventID,
+		Type:      eventType,
+		IntentID:  intent.ProviderIntentID,
+		PaymentID: "fake_pay_" + strings.TrimPrefix(intent.ProviderIntentID, "fake_pi_"),
+		Amount:    intent.Amount,
+		Currency:  intent.Currency,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, g.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build webhook"})
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fake-Signature", signHMAC(body, g.webhookSecret))
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to deliver webhook: " + err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	response, _ := io.ReadAll(resp.Body)
+
+	c.JSON(http.StatusOK, gin.H{
+		"event_id":         eventID,
+		"type":             eventType,
+		"webhook_status":   resp.StatusCode,
+		"webhook_response": json.RawMessage(response),
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Payment intent statuses
+const (
+	PaymentRequiresPayment = "requires_payment"
+	PaymentCaptured        = "captured"
+	PaymentFailed          = "failed"
+)
+
+// Webhook event types understood by the payment subsystem. Providers map
+// their own event names onto these.
+const (
+	EventPaymentCaptured = "payment.captured"
+	EventPaymentFailed   = "payment.failed"
+)
+
+// paymentHoldTTL is how long an unpaid booking holds its slot.
+var paymentHoldTTL = time.Duration(getEnvInt("PAYMENT_HOLD_MINUTES", 15)) * time.Minute
+
+// PaymentProvider is a payment gateway. The implementation is chosen at
+// startup from PAYMENT_PROVIDER ("razorpay" or "fake"), which must be set.
+type PaymentProvider interface {
+	Name() string
+	// CreateIntent registers a payment with the gateway and returns what the
+	// app needs to complete it.
+	CreateIntent(req IntentRequest) (ProviderIntent, error)
+	// ParseWebhook verifies the webhook signature and decodes the event.
+	ParseWebhook(body []byte, header http.Header) (PaymentEvent, error)
+}
+
+type IntentRequest struct {
+	Amount    int64 // minor units
+	Currency  string
+	Reference string
+	Notes     map[string]string
+}
+
+type ProviderIntent struct {
+	ID           string
+	ClientSecret string
+}
+
+// PaymentEvent is a verified webhook event in provider-neutral form.
+type PaymentEvent struct {
+	ID        string
+	Type      string
+	IntentID  string
+	PaymentID string
+	Amount    int64 // minor units
+	Currency  string
+}
+
+// RefundGateway returns money for captured payments. Refunds settle
+// asynchronously, so their status is polled until it is final.
+type RefundGateway interface {
+	Name() string
+	CreateRefund(req RefundRequest) (ProviderRefund, error)
+	// FindRefund looks up a refund of the payment by the reference it was
+	// created with, so a retry after a timeout does not refund twice.
+	FindRefund(paymentID, reference string) (ProviderRefund, bool, error)
+	RefundStatus(refundID string) (string, error)
+}
+
+type RefundRequest struct {
+	PaymentID string // the gateway's ID for the captured payment
+	Amount    int64  // minor units
+	Currency  string
+	Reference string // unique per Refund; used as the idempotency key
+}
+
+// ProviderRefund is a refund as reported by the gateway. Status is one of
+// the Refund* statuses.
+type ProviderRefund struct {
+	ID     string
+	Status string
+}
+
+var (
+	errInvalidSignature = errors.New("invalid webhook signature")
+	errPaymentMismatch  = errors.New("captured amount does not match the payment")
+)
+
+var (
+	paymentProvider PaymentProvider
+	refundGateway   RefundGateway
+)
+
+// initPayments sets up the configured gateway. There is no default: a
+// deployment that forgot to configure payments must not quietly accept fake
+// ones.
+func initPayments() {
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case "razorpay":
+		razorpay := newRazorpayProvider()
+		if razorpay.keyID == "" || razorpay.keySecret == "" || razorpay.webhookSecret == "" {
+			log.Fatal("RAZORPAY_KEY_ID, RAZORPAY_KEY_SECRET and RAZORPAY_WEBHOOK_SECRET must be set")
+		}
+		paymentProvider, refundGateway = razorpay, razorpay
+	case "fake":
+		if gin.Mode() == gin.ReleaseMode {
+			log.Fatal("The fake payment provider cannot be used with GIN_MODE=release")
+		}
+		gateway := newFakeGateway()
+		if gateway.webhookSecret == "" {
+			log.Fatal("FAKE_GATEWAY_SECRET must be set to use the fake payment provider")
+		}
+		paymentProvider, refundGateway = gateway, gateway
+	default:
+		log.Fatalf("PAYMENT_PROVIDER must be razorpay or fake, got %q", provider)
+	}
+}
+
+// PaymentIntent tracks the payment for a booking: a single session, or
+// every occurrence of a series. Package purchases are paid the same way.
+type PaymentIntent struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	UserID            uint       `json:"user_id" gorm:"index;not null"`
+	SessionID         *uint      `json:"session_id,omitempty" gorm:"index"`
+	SeriesID          *uint      `json:"series_id,omitempty" gorm:"index"`
+	PackagePurchaseID *uint      `json:"package_purchase_id,omitempty" gorm:"index"`
+	Provider          string     `json:"provider"`
+	ProviderIntentID  string     `json:"provider_intent_id" gorm:"uniqueIndex"`
+	ProviderPaymentID string     `json:"provider_payment_id,omitempty"` // set on capture; refunds are issued against it
+	ClientSecret      string     `json:"client_secret,omitempty"`
+	Amount            int64      `json:"amount"` // minor units
+	Currency          string     `json:"currency"`
+	Status            string     `json:"status"`
+	CapturedAt        *time.Time `json:"captured_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// PaymentWebhookEvent records every processed webhook so redelivered events
+// are acknowledged without being applied twice.
+type PaymentWebhookEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Provider  string    `json:"provider" gorm:"uniqueIndex:idx_provider_event;not null"`
+	EventID   string    `json:"event_id" gorm:"uniqueIndex:idx_provider_event;not null"`
+	Type      string    `json:"type"`
+	IntentID  string    `json:"intent_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// initialSessionStatus is the status a new booking starts in: unpaid
+// bookings wait for payment before the counsellor is asked to confirm.
+func initialSessionStatus(amount int64) string {
+	if amount > 0 {
+		return SessionPendingPayment
+	}
+	return SessionPending
+}
+
+// createPaymentIntent opens a payment with the provider for what intent
+// points at: a session, a series or a package purchase.
+func createPaymentIntent(intent PaymentIntent, price Money) (*PaymentIntent, error) {
+	var reference string
+	switch {
+	case intent.PackagePurchaseID != nil:
+		reference = "lampy_package_" + strconv.Itoa(int(*intent.PackagePurchaseID))
+	case intent.SeriesID != nil:
+		reference = "lampy_series_" + strconv.Itoa(int(*intent.SeriesID))
+	case intent.SessionID != nil:
+		reference = "lampy_session_" + strconv.Itoa(int(*intent.SessionID))
+	}
+
+	providerIntent, err := paymentProvider.CreateIntent(IntentRequest{
+		Amount:    price.Amount,
+		Currency:  price.Currency,
+		Reference: reference,
+		Notes:     map[string]string{"user_id": strconv.Itoa(int(intent.UserID))},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	intent.Provider = paymentProvider.Name()
+	intent.ProviderIntentID = providerIntent.ID
+	intent.ClientSecret = providerIntent.ClientSecret
+	intent.Amount = price.Amount
+	intent.Currency = price.Currency
+	intent.Status = PaymentRequiresPayment
+	if err := db.Create(&intent).Error; err != nil {
+		return nil, err
+	}
+
+	return &intent, nil
+}
+
+// abandonUnpaidSessions expires the sessions of a booking whose payment
+// could not be started, releasing the slot.
+func abandonUnpaidSessions(sessions []Session) {
+	for i := range sessions {
+		db.Transaction(func(tx *gorm.DB) error {
+			return transitionSession(tx, &sessions[i], SessionExpired, 0, "payment could not be started")
+		})
+	}
+}
+
+// Payment handlers
+func handlePaymentWebhook(c *gin.Context) {
+	if c.Param("provider") != paymentProvider.Name() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment provider"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body"})
+		return
+	}
+
+	event, err := paymentProvider.ParseWebhook(body, c.Request.Header)
+	if errors.Is(err, errInvalidSignature) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	duplicate, err := processPaymentEvent(paymentProvider.Name(), event)
+	if err != nil {
+		// A 5xx makes the gateway redeliver the event later.
+		log.Printf("failed to process payment event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+		return
+	}
+
+	if duplicate {
+		c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "processed"})
+}
+
+// processPaymentEvent applies a verified event exactly once. The event row
+// and its effects are written in one transaction, so a failure leaves the
+// event unrecorded and a redelivery retries it.
+func processPaymentEvent(provider string, event PaymentEvent) (bool, error) {
+	duplicate := false
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var seen int64
+		tx.Model(&PaymentWebhookEvent{}).Where("provider = ? AND event_id = ?", provider, event.ID).Count(&seen)
+		if seen > 0 {
+			duplicate = true
+			return nil
+		}
+
+		if err := tx.Create(&PaymentWebhookEvent{
+			Provider: provider,
+			EventID:  event.ID,
+			Type:     event.Type,
+			IntentID: event.IntentID,
+		}).Error; err != nil {
+			return err
+		}
+
+		var intent PaymentIntent
+		if err := tx.Where("provider = ? AND provider_intent_id = ?", provider, event.IntentID).First(&intent).Error; err != nil {
+			// Not ours, e.g. a payment made outside the app. Record and ignore.
+			return nil
+		}
+
+		switch event.Type {
+		case EventPaymentCaptured:
+			err := capturePaymentIntent(tx, &intent, event)
+			if errors.Is(err, errPaymentMismatch) {
+				// Redelivery would not change the amount, so the event is
+				// recorded and the booking left unpaid for an admin to check.
+				log.Printf("payment event %s for intent %d: %v (got %d %s, want %d %s)",
+					event.ID, intent.ID, err, event.Amount, event.Currency, intent.Amount, intent.Currency)
+				return nil
+			}
+			return err
+		case EventPaymentFailed:
+			if intent.Status == PaymentRequiresPayment {
+				return tx.Model(&intent).Update("status", PaymentFailed).Error
+			}
+		}
+		return nil
+	})
+
+	return duplicate, err
+}
+
+// capturePaymentIntent marks the intent paid, records what was paid for
+// each of its sessions, invoices them and releases them to the counsellor
+// for confirmation. Sessions that stopped waiting for payment, e.g. because the
+// hold expired first, are refunded in full. Package purchases are activated
+// instead. A capture for a different amount or currency than the intent
+// was opened for is rejected with errPaymentMismatch.
+func capturePaymentIntent(tx *gorm.DB, intent *PaymentIntent, event PaymentEvent) error {
+	if intent.Status == PaymentCaptured {
+		return nil
+	}
+	if event.Amount != intent.Amount || !strings.EqualFold(event.Currency, intent.Currency) {
+		return errPaymentMismatch
+	}
+	paymentID := event.PaymentID
+
+	now := time.Now()
+	if err := tx.Model(&PaymentIntent{}).Where("id = ?", intent.ID).Updates(map[string]interface{}{
+		"status":              PaymentCaptured,
+		"captured_at":         now,
+		"provider_payment_id": paymentID,
+	}).Error; err != nil {
+		return err
+	}
+	intent.Status = PaymentCaptured
+	intent.CapturedAt = &now
+	intent.ProviderPaymentID = paymentID
+
+	if intent.PackagePurchaseID != nil {
+		return activatePackagePurchase(tx, *intent.PackagePurchaseID)
+	}
+
+	var sessions []Session
+	query := tx.Order("session_date")
+	if intent.SeriesID != nil {
+		query = query.Where("series_id = ?", *intent.SeriesID)
+	} else {
+		query = query.Where("id = ?", intent.SessionID)
+	}
+	if err := query.Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	shares := splitAmount(intent.Amount, len(sessions))
+	for i := range sessions {
+		if err := tx.Create(&LedgerEntry{
+			SessionID:       sessions[i].ID,
+			PaymentIntentID: intent.ID,
+			Type:            LedgerPayment,
+			Amount:          shares[i],
+			Currency:        intent.Currency,
+		}).Error; err != nil {
+			return err
+		}
+
+		if sessions[i].Status != SessionPendingPayment {
+			log.Printf("payment intent %d captured after session %d became %s; refunding", intent.ID, sessions[i].ID, sessions[i].Status)
+			if _, err := queueRefund(tx, sessions[i], shares[i], RefundAutomatic, "payment arrived after the booking was released", 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := transitionSession(tx, &sessions[i], SessionPending, 0, "payment captured"); err != nil {
+			return err
+		}
+		if _, err := issueInvoice(tx, sessions[i], *intent, shares[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitAmount divides amount into n shares that add up to it exactly. The
+// first shares absorb the remainder.
+func splitAmount(amount int64, n int) []int64 {
+	shares := make([]int64, n)
+	for i := range shares {
+		shares[i] = amount / int64(n)
+		if int64(i) < amount%int64(n) {
+			shares[i]++
+		}
+	}
+	return shares
+}
+
+// Session handlers
+func getSessionPayment(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	query := db.Where("session_id = ?", session.ID)
+	if session.SeriesID != nil {
+		query = db.Where("session_id = ? OR series_id = ?", session.ID, *session.SeriesID)
+	}
+
+	var intent PaymentIntent
+	if err := query.Order("created_at DESC").First(&intent).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No payment for this session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, intent)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deliverWebhook posts payload to the fake provider's webhook, signed with
+// secret.
+func deliverWebhook(payload fakeWebhookPayload, secret string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	req := httptest.NewRequest(http.MethodPost, "/webhook/fake", bytes.NewReader(body))
+	req.Header.Set("X-Fake-Signature", signHMAC(body, secret))
+
+	r := gin.New()
+	r.POST("/webhook/:provider", handlePaymentWebhook)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createUnpaidBooking creates a session waiting for a payment of 800 INR.
+func createUnpaidBooking(t *testing.T) (Session, PaymentIntent) {
+	t.Helper()
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Paid", nil)
+	session := createTestSession(t, user, counsellor, time.Now().Add(48*time.Hour), SessionPendingPayment)
+
+	intent := PaymentIntent{
+		UserID:           user.ID,
+		SessionID:        &session.ID,
+		Provider:         "fake",
+		ProviderIntentID: "fake_pi_test",
+		Amount:           80000,
+		Currency:         "INR",
+		Status:           PaymentRequiresPayment,
+	}
+	if err := db.Create(&intent).Error; err != nil {
+		t.Fatalf("failed to create payment intent: %v", err)
+	}
+	return session, intent
+}
+
+func TestHandlePaymentWebhook(t *testing.T) {
+	captured := fakeWebhookPayload{ID: "evt_1", Type: EventPaymentCaptured, IntentID: "fake_pi_test", PaymentID: "fake_pay_1", Amount: 80000, Currency: "INR"}
+	with := func(change func(p *fakeWebhookPayload)) fakeWebhookPayload {
+		p := captured
+		change(&p)
+		return p
+	}
+
+	tests := []struct {
+		name         string
+		payload      fakeWebhookPayload
+		secret       string
+		want         int
+		wantIntent   string
+		wantSession  string
+		wantRecorded bool
+	}{
+		{"captured", captured, "test-webhook-secret", http.StatusOK, PaymentCaptured, SessionPending, true},
+		{"bad signature", captured, "wrong-secret", http.StatusUnauthorized, PaymentRequiresPayment, SessionPendingPayment, false},
+		{"amount mismatch", with(func(p *fakeWebhookPayload) { p.Amount = 100 }), "test-webhook-secret", http.StatusOK, PaymentRequiresPayment, SessionPendingPayment, true},
+		{"currency mismatch", with(func(p *fakeWebhookPayload) { p.Currency = "USD" }), "test-webhook-secret", http.StatusOK, PaymentRequiresPayment, SessionPendingPayment, true},
+		{"lower-case currency", with(func(p *fakeWebhookPayload) { p.Currency = "inr" }), "test-webhook-secret", http.StatusOK, PaymentCaptured, SessionPending, true},
+		{"failed", with(func(p *fakeWebhookPayload) { p.Type = EventPaymentFailed }), "test-webhook-secret", http.StatusOK, PaymentFailed, SessionPendingPayment, true},
+		{"unknown intent", with(func(p *fakeWebhookPayload) { p.IntentID = "fake_pi_other" }), "test-webhook-secret", http.StatusOK, PaymentRequiresPayment, SessionPendingPayment, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			session, intent := createUnpaidBooking(t)
+
+			w := deliverWebhook(tt.payload, tt.secret)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&intent, intent.ID)
+			db.First(&session, session.ID)
+			if intent.Status != tt.wantIntent || session.Status != tt.wantSession {
+				t.Errorf("intent %q, session %q; want %q, %q", intent.Status, session.Status, tt.wantIntent, tt.wantSession)
+			}
+
+			var recorded int64
+			db.Model(&PaymentWebhookEvent{}).Where("event_id = ?", tt.payload.ID).Count(&recorded)
+			if (recorded == 1) != tt.wantRecorded {
+				t.Errorf("event recorded %d times, want recorded = %v", recorded, tt.wantRecorded)
+			}
+
+			var payments int64
+			db.Model(&LedgerEntry{}).Where("session_id = ? AND type = ?", session.ID, LedgerPayment).Count(&payments)
+			if wantPayments := tt.wantIntent == PaymentCaptured; (payments == 1) != wantPayments {
+				t.Errorf("%d payment ledger entries", payments)
+			}
+		})
+	}
+}
+
+func TestHandlePaymentWebhookDuplicate(t *testing.T) {
+	setupTestDB(t)
+	session, _ := createUnpaidBooking(t)
+	payload := fakeWebhookPayload{ID: "evt_1", Type: EventPaymentCaptured, IntentID: "fake_pi_test", PaymentID: "fake_pay_1", Amount: 80000, Currency: "INR"}
+
+	for i, want := range []string{"processed", "duplicate", "duplicate"} {
+		w := deliverWebhook(payload, "test-webhook-secret")
+		var body struct{ Status string }
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusOK || body.Status != want {
+			t.Fatalf("delivery %d: status %d %q, want %q", i+1, w.Code, body.Status, want)
+		}
+	}
+
+	var payments, invoices int64
+	db.Model(&LedgerEntry{}).Where("session_id = ? AND type = ?", session.ID, LedgerPayment).Count(&payments)
+	db.Model(&Invoice{}).Where("session_id = ?", session.ID).Count(&invoices)
+	if payments != 1 || invoices != 1 {
+		t.Errorf("%d payments and %d invoices recorded, want one each", payments, invoices)
+	}
+}
+
+func TestCaptureAfterHoldExpiredRefunds(t *testing.T) {
+	setupTestDB(t)
+	session, _ := createUnpaidBooking(t)
+	db.Model(&session).Update("status", SessionExpired)
+
+	w := deliverWebhook(fakeWebhookPayload{ID: "evt_1", Type: EventPaymentCaptured, IntentID: "fake_pi_test", PaymentID: "fake_pay_1", Amount: 80000, Currency: "INR"}, "test-webhook-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	var refund Refund
+	if err := db.Where("session_id = ?", session.ID).First(&refund).Error; err != nil {
+		t.Fatalf("no refund queued: %v", err)
+	}
+	if refund.Amount != 80000 {
+		t.Errorf("refund = %d, want the full 80000", refund.Amount)
+	}
+	db.First(&session, session.ID)
+	if session.Status != SessionExpired {
+		t.Errorf("session status = %q, want it left expired", session.Status)
+	}
+}
+
+func TestRazorpayParseWebhook(t *testing.T) {
+	provider := &razorpayProvider{webhookSecret: "rzp-secret"}
+	body := []byte(`{"event":"payment.captured","payload":{"payment":{"entity":{"id":"pay_1","order_id":"order_1","amount":80000,"currency":"INR"}}}}`)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		sign    string
+		eventID string
+		wantErr error
+		wantID  string
+	}{
+		{name: "event id header", body: body, sign: "rzp-secret", eventID: "evt_1", wantID: "evt_1"},
+		{name: "no event id header", body: body, sign: "rzp-secret", wantID: "payment.captured:pay_1"},
+		{name: "wrong secret", body: body, sign: "other", wantErr: errInvalidSignature},
+		{name: "malformed", body: []byte("{"), sign: "rzp-secret", wantErr: errors.New("malformed webhook payload")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("X-Razorpay-Signature", signHMAC(tt.body, tt.sign))
+			if tt.eventID != "" {
+				header.Set("X-Razorpay-Event-Id", tt.eventID)
+			}
+
+			event, err := provider.ParseWebhook(tt.body, header)
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Fatalf("ParseWebhook() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWebhook() error = %v", err)
+			}
+			want := PaymentEvent{ID: tt.wantID, Type: EventPaymentCaptured, IntentID: "order_1", PaymentID: "pay_1", Amount: 80000, Currency: "INR"}
+			if event != want {
+				t.Errorf("ParseWebhook() = %+v, want %+v", event, want)
+			}
+		})
+	}
+}
+
+func TestSplitAmount(t *testing.T) {
+	tests := []struct {
+		amount int64
+		n      int
+		want   []int64
+	}{
+		{80000, 1, []int64{80000}},
+		{90000, 3, []int64{30000, 30000, 30000}},
+		{100, 3, []int64{34, 33, 33}},
+		{5, 4, []int64{2, 1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		got := splitAmount(tt.amount, tt.n)
+		var sum int64
+		for _, share := range got {
+			sum += share
+		}
+		if len(got) != len(tt.want) || sum != tt.amount {
+			t.Fatalf("splitAmount(%d, %d) = %v", tt.amount, tt.n, got)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitAmount(%d, %d) = %v, want %v", tt.amount, tt.n, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{`a (b) \c`, `a \(b\) \\c`},
+		{"9–5 — daily", "9-5 - daily"},
+		{"café", "caf\xe9"},
+		{"₹800", "?800"},
+		{"tab\there", "tab?here"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := pdfEscape(tt.in); got != tt.want {
+				t.Errorf("pdfEscape(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPDFDocumentCrossReferences(t *testing.T) {
+	var doc pdfDocument
+	doc.text(50, 790, pdfBold, 20, "TAX INVOICE")
+	doc.textRight(545, 700, 10, "INR 800.00")
+	doc.line(50, 690, 545, 690)
+	out := doc.bytes()
+
+	// Every xref entry must point at the start of its object.
+	xrefAt := bytes.LastIndex(out, []byte("startxref\n"))
+	offset, err := strconv.Atoi(strings.Fields(string(out[xrefAt+len("startxref\n"):]))[0])
+	if err != nil || !bytes.HasPrefix(out[offset:], []byte("xref\n")) {
+		t.Fatalf("startxref does not point at the xref table")
+	}
+	entries := strings.Split(string(out[offset:]), "\n")[3:10]
+	for i, entry := range entries {
+		at, _ := strconv.Atoi(strings.Fields(entry)[0])
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(out[at:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, out[at:at+10])
+		}
+	}
+}
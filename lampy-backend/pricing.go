@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pricedDurations are the session lengths, in minutes, a counsellor can set
+// prices for. Sessions are booked at one of these lengths, and counsellors
+// cannot be booked at all until they have set a price.
+var pricedDurations = []int{30, 50, 90}
+
+// CounsellorPrice is what a session of one length costs with a counsellor,
+// in minor units of the counsellor's currency.
+type CounsellorPrice struct {
+	ID           uint  `json:"-" gorm:"primaryKey"`
+	CounsellorID uint  `json:"-" gorm:"uniqueIndex:idx_counsellor_duration;not null"`
+	Duration     int   `json:"duration" gorm:"uniqueIndex:idx_counsellor_duration;not null"`
+	Amount       int64 `json:"amount" gorm:"not null"`
+}
+
+type PricingRequest struct {
+	Currency string            `json:"currency" binding:"required"`
+	Prices   []CounsellorPrice `json:"prices"`
+}
+
+// UnpricedDurationError is returned when a session length is booked that the
+// counsellor does not offer.
+type UnpricedDurationError struct {
+	Duration int
+	Offered  []int
+}
+
+func (e *UnpricedDurationError) Error() string {
+	return fmt.Sprintf("counsellor does not offer %d minute sessions", e.Duration)
+}
+
+// errCounsellorUnpriced is returned for a counsellor with no prices, e.g.
+// one whose legacy price could not be migrated. Treating them as free would
+// let anyone book them at no cost.
+var errCounsellorUnpriced = errors.New("counsellor has no prices set")
+
+// AfterFind fills in the display price, which the app shows as "Session
+// starting at ...". It is left empty for counsellors without prices, who
+// cannot be booked.
+func (c *Counsellor) AfterFind(tx *gorm.DB) error {
+	if c.PriceFrom > 0 {
+		c.Price = Money{Amount: c.PriceFrom, Currency: c.Currency}.String()
+	}
+	return nil
+}
+
+// counsellorHasPrices is a SQL condition matching counsellors with at least
+// one price set.
+const counsellorHasPrices = "EXISTS (SELECT 1 FROM counsellor_prices WHERE counsellor_prices.counsellor_id = counsellors.id)"
+
+func orderPrices(tx *gorm.DB) *gorm.DB {
+	return tx.Order("duration")
+}
+
+// sessionPrice returns the price of a session of duration minutes with the
+// counsellor. Sessions are free only where a price of 0 has been set.
+func sessionPrice(counsellor Counsellor, duration int) (Money, error) {
+	var prices []CounsellorPrice
+	if err := db.Where("counsellor_id = ?", counsellor.ID).Scopes(orderPrices).Find(&prices).Error; err != nil {
+		return Money{}, err
+	}
+
+	if len(prices) == 0 {
+		return Money{}, errCounsellorUnpriced
+	}
+
+	price := Money{Currency: counsellor.Currency}
+	offered := make([]int, 0, len(prices))
+	for _, p := range prices {
+		if p.Duration == duration {
+			price.Amount = p.Amount
+			return price, nil
+		}
+		offered = append(offered, p.Duration)
+	}
+	return Money{}, &UnpricedDurationError{Duration: duration, Offered: offered}
+}
+
+// respondPriceError writes the response for a sessionPrice error.
+func respondPriceError(c *gin.Context, err error) {
+	var unpriced *UnpricedDurationError
+	if errors.As(err, &unpriced) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             fmt.Sprintf("Counsellor does not offer %d minute sessions", unpriced.Duration),
+			"offered_durations": unpriced.Offered,
+		})
+		return
+	}
+	if errors.Is(err, errCounsellorUnpriced) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Counsellor has not set their prices yet and cannot be booked"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up price"})
+}
+
+func validatePrices(prices []CounsellorPrice) error {
+	seen := make(map[int]bool)
+	for _, p := range prices {
+		allowed := false
+		for _, d := range pricedDurations {
+			if p.Duration == d {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("duration must be one of %v", pricedDurations)
+		}
+		if seen[p.Duration] {
+			return fmt.Errorf("duplicate price for %d minutes", p.Duration)
+		}
+		if p.Amount < 0 {
+			return errors.New("amount must not be negative")
+		}
+		seen[p.Duration] = true
+	}
+	return nil
+}
+
+// setCounsellorPrices replaces the counsellor's prices and updates the
+// cached lowest price used for sorting and filtering.
+func setCounsellorPrices(tx *gorm.DB, counsellor *Counsellor, currency string, prices []CounsellorPrice) error {
+	if err := tx.Where("counsellor_id = ?", counsellor.ID).Delete(&CounsellorPrice{}).Error; err != nil {
+		return err
+	}
+
+	var from int64
+	for i := range prices {
+		prices[i].ID = 0
+		prices[i].CounsellorID = counsellor.ID
+		if i == 0 || prices[i].Amount < from {
+			from = prices[i].Amount
+		}
+	}
+	if len(prices) > 0 {
+		if err := tx.Create(&prices).Error; err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Duration < prices[j].Duration })
+	counsellor.Currency = currency
+	counsellor.PriceFrom = from
+	counsellor.Prices = prices
+
+	return tx.Model(&Counsellor{}).Where("id = ?", counsellor.ID).Updates(map[string]interface{}{
+		"currency":   currency,
+		"price_from": from,
+	}).Error
+}
+
+// migrateLegacyPrices converts the display strings stored in the old price
+// column into 50 minute prices. The old value is cleared once converted.
+func migrateLegacyPrices() {
+	if !db.Migrator().HasColumn(&Counsellor{}, "price") {
+		return
+	}
+
+	var rows []struct {
+		ID    uint
+		Price string
+	}
+	db.Table("counsellors").Select("id, price").Where("price IS NOT NULL AND price <> ''").Scan(&rows)
+
+	for _, row := range rows {
+		price, err := parseMoney(row.Price)
+		if err != nil {
+			log.Printf("cannot migrate price %q of counsellor %d, who cannot be booked until a price is set: %v", row.Price, row.ID, err)
+			continue
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			counsellor := Counsellor{ID: row.ID}
+			prices := []CounsellorPrice{{Duration: defaultSlotDuration, Amount: price.Amount}}
+			if err := setCounsellorPrices(tx, &counsellor, price.Currency, prices); err != nil {
+				return err
+			}
+			return tx.Table("counsellors").Where("id = ?", row.ID).Update("price", "").Error
+		})
+		if err != nil {
+			log.Printf("failed to migrate price of counsellor %d: %v", row.ID, err)
+		}
+	}
+}
+
+// Counsellor portal handlers
+func getOwnPricing(c *gin.Context) {
+	var counsellor Counsellor
+	if err := db.Preload("Prices", orderPrices).
+		First(&counsellor, c.MustGet("counsellor_id").(uint)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency":  counsellor.Currency,
+		"prices":    counsellor.Prices,
+		"durations": pricedDurations,
+	})
+}
+
+// updateOwnPricing replaces the counsellor's prices. Existing bookings keep
+// the price they were booked at.
+func updateOwnPricing(c *gin.Context) {
+	var req PricingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !isValidCurrency(req.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return
+	}
+	if err := validatePrices(req.Prices); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	counsellor := Counsellor{ID: c.MustGet("counsellor_id").(uint)}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return setCounsellorPrices(tx, &counsellor, req.Currency, req.Prices)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update pricing"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency":  counsellor.Currency,
+		"prices":    counsellor.Prices,
+		"durations": pricedDurations,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionPrice(t *testing.T) {
+	tests := []struct {
+		name        string
+		prices      []CounsellorPrice
+		duration    int
+		want        int64
+		wantErr     error
+		wantOffered []int
+	}{
+		{name: "standard", prices: inrPrices(500, 800, 1400), duration: 50, want: 80000},
+		{name: "long", prices: inrPrices(500, 800, 1400), duration: 90, want: 140000},
+		{name: "set free", prices: []CounsellorPrice{{Duration: 50, Amount: 0}}, duration: 50, want: 0},
+		{name: "length not offered", prices: []CounsellorPrice{{Duration: 90, Amount: 1}, {Duration: 30, Amount: 1}}, duration: 50, wantOffered: []int{30, 90}},
+		{name: "no prices", duration: 50, wantErr: errCounsellorUnpriced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			counsellor := Counsellor{Name: "Dr Price", Role: "Psychologist", Currency: "INR", Prices: tt.prices}
+			db.Create(&counsellor)
+
+			got, err := sessionPrice(counsellor, tt.duration)
+			var unpriced *UnpricedDurationError
+			switch {
+			case tt.wantOffered != nil:
+				if !errors.As(err, &unpriced) || fmt.Sprint(unpriced.Offered) != fmt.Sprint(tt.wantOffered) {
+					t.Fatalf("sessionPrice() error = %v, want offered %v", err, tt.wantOffered)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("sessionPrice() error = %v, want %v", err, tt.wantErr)
+			case err == nil && (got.Amount != tt.want || got.Currency != "INR"):
+				t.Errorf("sessionPrice() = %+v, want %d INR", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePrices(t *testing.T) {
+	tests := []struct {
+		name    string
+		prices  []CounsellorPrice
+		wantErr bool
+	}{
+		{"all lengths", inrPrices(500, 800, 1400), false},
+		{"one length", []CounsellorPrice{{Duration: 50, Amount: 80000}}, false},
+		{"none", nil, false},
+		{"free", []CounsellorPrice{{Duration: 30, Amount: 0}}, false},
+		{"unsupported length", []CounsellorPrice{{Duration: 45, Amount: 80000}}, true},
+		{"duplicate length", []CounsellorPrice{{Duration: 50, Amount: 1}, {Duration: 50, Amount: 2}}, true},
+		{"negative", []CounsellorPrice{{Duration: 50, Amount: -1}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePrices(tt.prices); (err != nil) != tt.wantErr {
+				t.Errorf("validatePrices() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdateOwnPricing(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         PricingRequest
+		want         int
+		wantFrom     int64
+		wantCurrency string
+	}{
+		{"replace prices", PricingRequest{Currency: "USD", Prices: []CounsellorPrice{{Duration: 90, Amount: 9000}, {Duration: 30, Amount: 4000}}}, http.StatusOK, 4000, "USD"},
+		{"unsupported currency", PricingRequest{Currency: "XYZ", Prices: inrPrices(1, 2, 3)}, http.StatusBadRequest, 0, "INR"},
+		{"invalid price", PricingRequest{Currency: "INR", Prices: []CounsellorPrice{{Duration: 45, Amount: 1}}}, http.StatusBadRequest, 0, "INR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			account := createTestUser(t, "counsellor@example.com", RoleCounsellor)
+			counsellor := createTestCounsellor(t, "Dr Price", &account)
+
+			w := servePortal(updateOwnPricing, http.MethodPut, "/pricing", "/pricing", tt.body, account)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&counsellor, counsellor.ID)
+			var prices int64
+			db.Model(&CounsellorPrice{}).Where("counsellor_id = ?", counsellor.ID).Count(&prices)
+			if tt.want != http.StatusOK {
+				if prices != 3 || counsellor.Currency != tt.wantCurrency {
+					t.Errorf("rejected update changed prices: %d prices in %s", prices, counsellor.Currency)
+				}
+				return
+			}
+			if int(prices) != len(tt.body.Prices) || counsellor.PriceFrom != tt.wantFrom || counsellor.Currency != tt.wantCurrency {
+				t.Errorf("%d prices from %d %s, want %d from %d %s",
+					prices, counsellor.PriceFrom, counsellor.Currency, len(tt.body.Prices), tt.wantFrom, tt.wantCurrency)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyPrices(t *testing.T) {
+	tests := []struct {
+		legacy       string
+		wantPrices   int
+		wantAmount   int64
+		wantCurrency string
+		wantLeft     string
+	}{
+		{"₹5,000", 1, 500000, "INR", ""},
+		{"USD 40", 1, 4000, "USD", ""},
+		{"Ask us", 0, 0, "INR", "Ask us"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.legacy, func(t *testing.T) {
+			setupTestDB(t)
+			db.Exec("ALTER TABLE counsellors ADD COLUMN price text")
+			counsellor := Counsellor{Name: "Dr Legacy", Role: "Psychologist"}
+			db.Create(&counsellor)
+			db.Table("counsellors").Where("id = ?", counsellor.ID).Update("price", tt.legacy)
+
+			migrateLegacyPrices()
+
+			var prices []CounsellorPrice
+			db.Where("counsellor_id = ?", counsellor.ID).Find(&prices)
+			var left string
+			db.Table("counsellors").Select("price").Where("id = ?", counsellor.ID).Scan(&left)
+			db.First(&counsellor, counsellor.ID)
+			if len(prices) != tt.wantPrices || counsellor.Currency != tt.wantCurrency || left != tt.wantLeft {
+				t.Fatalf("migrated to %+v in %s, legacy column %q", prices, counsellor.Currency, left)
+			}
+			if tt.wantPrices == 1 && (prices[0].Duration != defaultSlotDuration || prices[0].Amount != tt.wantAmount) {
+				t.Errorf("migrated price %+v, want %d for %d minutes", prices[0], tt.wantAmount, defaultSlotDuration)
+			}
+		})
+	}
+}
+
+func TestBookingRequiresPrice(t *testing.T) {
+	tests := []struct {
+		name     string
+		prices   []CounsellorPrice
+		duration int
+		want     int
+	}{
+		{"priced", inrPrices(500, 800, 1400), 50, http.StatusCreated},
+		{"unpriced counsellor", nil, 50, http.StatusConflict},
+		{"length not offered", []CounsellorPrice{{Duration: 90, Amount: 140000}}, 50, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := Counsellor{Name: "Dr Price", Role: "Psychologist", Currency: "INR", Timezone: defaultTimezone, Prices: tt.prices}
+			db.Create(&counsellor)
+			openAllWeek(t, counsellor)
+
+			start := time.Now().Add(72 * time.Hour).Truncate(time.Hour)
+			req := SessionBookingRequest{CounsellorID: counsellor.ID, SessionDate: start.Format(time.RFC3339), Duration: tt.duration}
+			w := serveTest(bookSession, http.MethodPost, "/book", "/book", req, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var booked int64
+			db.Model(&Session{}).Where("user_id = ?", user.ID).Count(&booked)
+			if wantBooked := tt.want == http.StatusCreated; (booked == 1) != wantBooked {
+				t.Errorf("%d sessions booked", booked)
+			}
+		})
+	}
+}
+
+func TestCounsellorDisplayPrice(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []CounsellorPrice
+		want   string
+	}{
+		{"priced", inrPrices(500, 800, 1400), "₹500"},
+		{"unpriced", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			counsellor := Counsellor{Name: "Dr Display", Role: "Psychologist", Timezone: defaultTimezone}
+			db.Create(&counsellor)
+			if err := setCounsellorPrices(db, &counsellor, "INR", tt.prices); err != nil {
+				t.Fatalf("setCounsellorPrices() error = %v", err)
+			}
+
+			var loaded Counsellor
+			db.First(&loaded, counsellor.ID)
+			if loaded.Price != tt.want {
+				t.Errorf("Price = %q, want %q", loaded.Price, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCounsellorsByPrice(t *testing.T) {
+	setupTestDB(t)
+	for _, c := range []struct {
+		name   string
+		prices []CounsellorPrice
+	}{
+		{"Dr Unpriced", nil},
+		{"Dr Dear", inrPrices(900, 1200, 2000)},
+		{"Dr Cheap", inrPrices(300, 500, 900)},
+	} {
+		counsellor := Counsellor{Name: c.name, Role: "Psychologist", Timezone: defaultTimezone, Available: true}
+		db.Create(&counsellor)
+		setCounsellorPrices(db, &counsellor, "INR", c.prices)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?sort=price_asc", []string{"Dr Cheap", "Dr Dear", "Dr Unpriced"}},
+		{"?sort=price_desc", []string{"Dr Dear", "Dr Cheap", "Dr Unpriced"}},
+		{"?max_price=100000&sort=price_asc", []string{"Dr Cheap", "Dr Dear"}},
+		{"?duration=50&sort=price_asc", []string{"Dr Cheap", "Dr Dear"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := serveTest(getCounsellors, http.MethodGet, "/counsellors", "/counsellors"+tt.query, nil, 0, "")
+			var counsellors []Counsellor
+			json.Unmarshal(w.Body.Bytes(), &counsellors)
+			var got []string
+			for _, c := range counsellors {
+				got = append(got, c.Name)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("counsellors = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
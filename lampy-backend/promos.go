@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Promo discount types
+const (
+	PromoPercent = "percent"
+	PromoFixed   = "fixed"
+)
+
+// PromoCode is a discount marketing can hand out. Percent codes take a share
+// off the price; fixed codes take a set amount off in their currency. Empty
+// restriction lists mean the code applies to every counsellor.
+type PromoCode struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Code           string     `json:"code" gorm:"uniqueIndex;not null"` // stored upper case
+	Description    string     `json:"description"`
+	DiscountType   string     `json:"discount_type" gorm:"not null"`
+	PercentOff     int        `json:"percent_off,omitempty"`
+	AmountOff      int64      `json:"amount_off,omitempty"` // minor units
+	Currency       string     `json:"currency,omitempty"`
+	StartsAt       *time.Time `json:"starts_at,omitempty"`
+	EndsAt         *time.Time `json:"ends_at,omitempty"`
+	MaxRedemptions int        `json:"max_redemptions"` // 0 for no limit
+	Redemptions    int        `json:"redemptions"`
+	MaxPerUser     int        `json:"max_per_user"` // 0 for no limit
+	CounsellorIDs  []uint     `json:"counsellor_ids" gorm:"serializer:json"`
+	Specialties    []string   `json:"specialties" gorm:"serializer:json"`
+	Active         bool       `json:"active" gorm:"default:true"`
+	CreatedBy      uint       `json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// PromoRedemption records a code used on a booking. Redemptions on bookings
+// that are never paid for are released so the use counts again.
+type PromoRedemption struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	PromoCodeID uint       `json:"promo_code_id" gorm:"index;not null"`
+	Code        string     `json:"code"`
+	UserID      uint       `json:"user_id" gorm:"index;not null"`
+	SessionID   *uint      `json:"session_id,omitempty" gorm:"index"`
+	SeriesID    *uint      `json:"series_id,omitempty" gorm:"index"`
+	Discount    int64      `json:"discount"` // minor units, for the whole booking
+	Currency    string     `json:"currency"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type PromoCodeRequest struct {
+	Code           string     `json:"code" binding:"required,min=3,max=32,alphanum"`
+	Description    string     `json:"description"`
+	DiscountType   string     `json:"discount_type" binding:"required,oneof=percent fixed"`
+	PercentOff     int        `json:"percent_off" binding:"min=0,max=100"`
+	AmountOff      int64      `json:"amount_off" binding:"min=0"`
+	Currency       string     `json:"currency"`
+	StartsAt       *time.Time `json:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at"`
+	MaxRedemptions int        `json:"max_redemptions" binding:"min=0"`
+	MaxPerUser     *int       `json:"max_per_user" binding:"omitempty,min=0"`
+	CounsellorIDs  []uint     `json:"counsellor_ids"`
+	Specialties    []string   `json:"specialties"`
+	Active         *bool      `json:"active"`
+}
+
+// promoEditableColumns are the PromoCode columns a PromoCodeRequest sets.
+var promoEditableColumns = []string{
+	"description", "discount_type", "percent_off", "amount_off", "currency", "starts_at", "ends_at",
+	"max_redemptions", "max_per_user", "counsellor_ids", "specialties", "active",
+}
+
+type PromoValidateRequest struct {
+	Code         string `json:"code" binding:"required"`
+	CounsellorID uint   `json:"counsellor_id" binding:"required"`
+	Duration     int    `json:"duration" binding:"required"`
+}
+
+// PromoQuote is the price of one session after a code is applied.
+type PromoQuote struct {
+	Code     string `json:"code"`
+	Price    int64  `json:"price"`
+	Discount int64  `json:"discount"`
+	Total    int64  `json:"total"`
+	Currency string `json:"currency"`
+
+	promo PromoCode
+}
+
+// PromoError explains why a code cannot be used. Reason is a stable key
+// clients can match on; Message is shown to the user.
+type PromoError struct {
+	Reason  string
+	Message string
+}
+
+func (e *PromoError) Error() string { return e.Message }
+
+// quotePromo checks that code can be used by the user on a session with the
+// counsellor at price, and works out the discount.
+func quotePromo(tx *gorm.DB, code string, userID uint, counsellor Counsellor, price Money) (PromoQuote, error) {
+	var promo PromoCode
+	err := tx.Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&promo).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !promo.Active) {
+		return PromoQuote{}, &PromoError{"not_found", "Promo code not found"}
+	}
+	if err != nil {
+		return PromoQuote{}, err
+	}
+
+	now := time.Now()
+	if promo.StartsAt != nil && now.Before(*promo.StartsAt) {
+		return PromoQuote{}, &PromoError{"not_started", "Promo code is not valid yet"}
+	}
+	if promo.EndsAt != nil && !now.Before(*promo.EndsAt) {
+		return PromoQuote{}, &PromoError{"expired", "Promo code has expired"}
+	}
+	if promo.MaxRedemptions > 0 && promo.Redemptions >= promo.MaxRedemptions {
+		return PromoQuote{}, &PromoError{"exhausted", "Promo code has been fully redeemed"}
+	}
+	if err := checkPromoUserLimit(tx, promo, userID); err != nil {
+		return PromoQuote{}, err
+	}
+	if !promoCoversCounsellor(promo, counsellor) {
+		return PromoQuote{}, &PromoError{"not_applicable", "Promo code does not apply to this counsellor"}
+	}
+	if price.Amount == 0 {
+		return PromoQuote{}, &PromoError{"not_applicable", "Promo code cannot be used on a free session"}
+	}
+
+	discount := price.Amount * int64(promo.PercentOff) / 100
+	if promo.DiscountType == PromoFixed {
+		if promo.Currency != price.Currency {
+			return PromoQuote{}, &PromoError{"currency_mismatch", fmt.Sprintf("Promo code only applies to prices in %s", promo.Currency)}
+		}
+		discount = promo.AmountOff
+		if discount > price.Amount {
+			discount = price.Amount
+		}
+	}
+
+	return PromoQuote{
+		Code:     promo.Code,
+		Price:    price.Amount,
+		Discount: discount,
+		Total:    price.Amount - discount,
+		Currency: price.Currency,
+		promo:    promo,
+	}, nil
+}
+
+func checkPromoUserLimit(tx *gorm.DB, promo PromoCode, userID uint) error {
+	if promo.MaxPerUser == 0 {
+		return nil
+	}
+	var used int64
+	if err := tx.Model(&PromoRedemption{}).
+		Where("promo_code_id = ? AND user_id = ? AND released_at IS NULL", promo.ID, userID).
+		Count(&used).Error; err != nil {
+		return err
+	}
+	if used >= int64(promo.MaxPerUser) {
+		return &PromoError{"user_limit", "You have already used this promo code"}
+	}
+	return nil
+}
+
+func promoCoversCounsellor(promo PromoCode, counsellor Counsellor) bool {
+	if len(promo.CounsellorIDs) > 0 {
+		listed := false
+		for _, id := range promo.CounsellorIDs {
+			if id == counsellor.ID {
+				listed = true
+			}
+		}
+		if !listed {
+			return false
+		}
+	}
+
+	if len(promo.Specialties) == 0 {
+		return true
+	}
+	for _, want := range promo.Specialties {
+		for _, has := range counsellor.Specialties {
+			if strings.EqualFold(want, has) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redeemPromo records the use of a quoted code in the booking transaction.
+// The caps are checked again here: the global cap with a conditional
+// increment, so two bookings cannot both take the last use.
+func redeemPromo(tx *gorm.DB, quote PromoQuote, redemption PromoRedemption) (*PromoRedemption, error) {
+	if err := checkPromoUserLimit(tx, quote.promo, redemption.UserID); err != nil {
+		return nil, err
+	}
+
+	result := tx.Model(&PromoCode{}).
+		Where("id = ? AND (max_redemptions = 0 OR redemptions < max_redemptions)", quote.promo.ID).
+		UpdateColumn("redemptions", gorm.Expr("redemptions + 1"))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, &PromoError{"exhausted", "Promo code has been fully redeemed"}
+	}
+
+	redemption.PromoCodeID = quote.promo.ID
+	redemption.Code = quote.promo.Code
+	redemption.Currency = quote.Currency
+	if err := tx.Create(&redemption).Error; err != nil {
+		return nil, err
+	}
+	return &redemption, nil
+}
+
+// releasePromo gives back the code used on a booking that was never paid
+// for. A series shares one redemption, which is only released once every
+// occurrence has stopped waiting for a payment that never came.
+func releasePromo(tx *gorm.DB, session Session) error {
+	query := tx.Where("session_id = ?", session.ID)
+	if session.SeriesID != nil {
+		var unsettled int64
+		if err := tx.Model(&Session{}).
+			Where("series_id = ? AND status = ?", *session.SeriesID, SessionPendingPayment).
+			Count(&unsettled).Error; err != nil {
+			return err
+		}
+		var paid int64
+		if err := tx.Model(&PaymentIntent{}).
+			Where("series_id = ? AND status = ?", *session.SeriesID, PaymentCaptured).
+			Count(&paid).Error; err != nil {
+			return err
+		}
+		if unsettled > 0 || paid > 0 {
+			return nil
+		}
+		query = tx.Where("series_id = ?", *session.SeriesID)
+	}
+
+	var redemption PromoRedemption
+	err := query.Where("released_at IS NULL").First(&redemption).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&redemption).Update("released_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return tx.Model(&PromoCode{}).Where("id = ?", redemption.PromoCodeID).
+		UpdateColumn("redemptions", gorm.Expr("redemptions - 1")).Error
+}
+
+// respondPromoError writes a 422 for a code that cannot be used and reports
+// whether err was one.
+func respondPromoError(c *gin.Context, err error) bool {
+	var promoErr *PromoError
+	if !errors.As(err, &promoErr) {
+		return false
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": promoErr.Message, "reason": promoErr.Reason})
+	return true
+}
+
+// Promo handlers
+// validatePromo previews a code against a session before the user books,
+// so the discounted price can be shown ahead of payment.
+func validatePromo(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var req PromoValidateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var counsellor Counsellor
+	if err := db.First(&counsellor, req.CounsellorID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	price, err := sessionPrice(counsellor, req.Duration)
+	if err != nil {
+		respondPriceError(c, err)
+		return
+	}
+
+	quote, err := quotePromo(db, req.Code, userID, counsellor, price)
+	if respondPromoError(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check promo code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quote)
+}
+
+// Admin handlers
+func getPromoCodes(c *gin.Context) {
+	var promos []PromoCode
+	if err := db.Order("created_at DESC").Find(&promos).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch promo codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, promos)
+}
+
+func createPromoCode(c *gin.Context) {
+	adminID := c.MustGet("user_id").(uint)
+
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promo := PromoCode{Active: true, MaxPerUser: 1, CreatedBy: adminID}
+	if !applyPromoCodeRequest(c, &promo, req) {
+		return
+	}
+
+	var existing int64
+	db.Model(&PromoCode{}).Where("code = ?", promo.Code).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Promo code already exists"})
+		return
+	}
+
+	if err := db.Create(&promo).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create promo code"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, promo)
+}
+
+// updatePromoCode changes a code for future bookings. The code itself cannot
+// be renamed once issued.
+func updatePromoCode(c *gin.Context) {
+	var promo PromoCode
+	if err := db.First(&promo, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promo code not found"})
+		return
+	}
+
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !strings.EqualFold(req.Code, promo.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Promo codes cannot be renamed"})
+		return
+	}
+
+	if !applyPromoCodeRequest(c, &promo, req) {
+		return
+	}
+
+	// Redemptions move while the code is in use, so only the fields an admin
+	// edits are written back.
+	if err := db.Model(&promo).Select(promoEditableColumns).Updates(&promo).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update promo code"})
+		return
+	}
+
+	db.First(&promo, promo.ID)
+	c.JSON(http.StatusOK, promo)
+}
+
+func getPromoRedemptions(c *gin.Context) {
+	var redemptions []PromoRedemption
+	if err := db.Where("promo_code_id = ?", c.Param("id")).Order("created_at DESC").Find(&redemptions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch redemptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redemptions)
+}
+
+// applyPromoCodeRequest validates req and copies it onto promo, writing a
+// 400 and returning false if it is invalid.
+func applyPromoCodeRequest(c *gin.Context, promo *PromoCode, req PromoCodeRequest) bool {
+	switch req.DiscountType {
+	case PromoPercent:
+		if req.PercentOff < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "percent_off must be between 1 and 100"})
+			return false
+		}
+		req.AmountOff, req.Currency = 0, ""
+	case PromoFixed:
+		if req.AmountOff < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount_off must be positive"})
+			return false
+		}
+		if req.Currency == "" {
+			req.Currency = defaultCurrency
+		}
+		if !isValidCurrency(req.Currency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+			return false
+		}
+		req.PercentOff = 0
+	}
+
+	if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+		return false
+	}
+
+	if len(req.CounsellorIDs) > 0 {
+		var found int64
+		db.Model(&Counsellor{}).Where("id IN ?", req.CounsellorIDs).Count(&found)
+		if int(found) != len(req.CounsellorIDs) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown counsellor in counsellor_ids"})
+			return false
+		}
+	}
+
+	promo.Code = strings.ToUpper(req.Code)
+	promo.Description = req.Description
+	promo.DiscountType = req.DiscountType
+	promo.PercentOff = req.PercentOff
+	promo.AmountOff = req.AmountOff
+	promo.Currency = req.Currency
+	promo.StartsAt = req.StartsAt
+	promo.EndsAt = req.EndsAt
+	promo.MaxRedemptions = req.MaxRedemptions
+	if req.MaxPerUser != nil {
+		promo.MaxPerUser = *req.MaxPerUser
+	}
+	promo.CounsellorIDs = req.CounsellorIDs
+	promo.Specialties = req.Specialties
+	if req.Active != nil {
+		promo.Active = *req.Active
+	}
+	return true
+}
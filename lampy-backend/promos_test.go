@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestQuotePromo(t *testing.T) {
+	price := Money{Amount: 80000, Currency: "INR"}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		promo      PromoCode
+		code       string
+		used       int  // earlier redemptions by the user
+		released   bool // whether those were released
+		inactive   bool
+		free       bool
+		wantReason string
+		wantTotal  int64
+	}{
+		{name: "percent", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20}, wantTotal: 64000},
+		{name: "code is case and space insensitive", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20}, code: "  welcome ", wantTotal: 64000},
+		{name: "fixed", promo: PromoCode{DiscountType: PromoFixed, AmountOff: 50000, Currency: "INR"}, wantTotal: 30000},
+		{name: "fixed above the price", promo: PromoCode{DiscountType: PromoFixed, AmountOff: 100000, Currency: "INR"}, wantTotal: 0},
+		{name: "fixed in another currency", promo: PromoCode{DiscountType: PromoFixed, AmountOff: 500, Currency: "USD"}, wantReason: "currency_mismatch"},
+		{name: "unknown", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20}, code: "OTHER", wantReason: "not_found"},
+		{name: "inactive", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20}, inactive: true, wantReason: "not_found"},
+		{name: "not started", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, StartsAt: &future}, wantReason: "not_started"},
+		{name: "ended", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, EndsAt: &past}, wantReason: "expired"},
+		{name: "fully redeemed", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, MaxRedemptions: 5, Redemptions: 5}, wantReason: "exhausted"},
+		{name: "used by the user", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, MaxPerUser: 1}, used: 1, wantReason: "user_limit"},
+		{name: "used once of two", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, MaxPerUser: 2}, used: 1, wantTotal: 64000},
+		{name: "earlier use released", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, MaxPerUser: 1}, used: 1, released: true, wantTotal: 64000},
+		{name: "other counsellor", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, CounsellorIDs: []uint{99}}, wantReason: "not_applicable"},
+		{name: "matching specialty", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, Specialties: []string{"ANXIETY"}}, wantTotal: 64000},
+		{name: "other specialty", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20, Specialties: []string{"Grief"}}, wantReason: "not_applicable"},
+		{name: "free session", promo: PromoCode{DiscountType: PromoPercent, PercentOff: 20}, free: true, wantReason: "not_applicable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			counsellor := Counsellor{Name: "Dr Promo", Role: "Psychologist", Specialties: []string{"Anxiety", "Stress"}}
+			db.Create(&counsellor)
+
+			promo := tt.promo
+			promo.Code = "WELCOME"
+			db.Create(&promo)
+			db.Model(&promo).Update("active", !tt.inactive)
+			for i := 0; i < tt.used; i++ {
+				redemption := PromoRedemption{PromoCodeID: promo.ID, UserID: 1}
+				if tt.released {
+					redemption.ReleasedAt = &past
+				}
+				db.Create(&redemption)
+			}
+
+			code, amount := tt.code, price
+			if code == "" {
+				code = "WELCOME"
+			}
+			if tt.free {
+				amount.Amount = 0
+			}
+			quote, err := quotePromo(db, code, 1, counsellor, amount)
+
+			var promoErr *PromoError
+			if tt.wantReason != "" {
+				if !errors.As(err, &promoErr) || promoErr.Reason != tt.wantReason {
+					t.Fatalf("quotePromo() error = %v, want reason %q", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("quotePromo() error = %v", err)
+			}
+			if quote.Total != tt.wantTotal || quote.Discount != price.Amount-tt.wantTotal || quote.Code != "WELCOME" {
+				t.Errorf("quote = %+v, want total %d", quote, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestRedeemPromoTakesTheLastUseOnce(t *testing.T) {
+	setupTestDB(t)
+	counsellor := createTestCounsellor(t, "Dr Promo", nil)
+	promo := PromoCode{Code: "LAST", DiscountType: PromoPercent, PercentOff: 10, MaxRedemptions: 1, Active: true}
+	db.Create(&promo)
+
+	// Every user gets a quote while the use is still free.
+	const users = 8
+	quotes := make([]PromoQuote, users)
+	for i := range quotes {
+		quote, err := quotePromo(db, "LAST", uint(i+1), counsellor, Money{Amount: 80000, Currency: "INR"})
+		if err != nil {
+			t.Fatalf("quotePromo() error = %v", err)
+		}
+		quotes[i] = quote
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, users)
+	for i := range quotes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Transaction(func(tx *gorm.DB) error {
+				_, err := redeemPromo(tx, quotes[i], PromoRedemption{UserID: uint(i + 1), Discount: quotes[i].Discount})
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	redeemed := 0
+	for _, err := range errs {
+		var promoErr *PromoError
+		switch {
+		case err == nil:
+			redeemed++
+		case !errors.As(err, &promoErr) || promoErr.Reason != "exhausted":
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	var stored int64
+	db.Model(&PromoRedemption{}).Count(&stored)
+	db.First(&promo, promo.ID)
+	if redeemed != 1 || stored != 1 || promo.Redemptions != 1 {
+		t.Errorf("%d redeemed, %d stored, counter %d; want 1 each", redeemed, stored, promo.Redemptions)
+	}
+}
+
+func TestBookSessionWithPromo(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Promo", nil)
+	openAllWeek(t, counsellor)
+	promo := PromoCode{Code: "WELCOME", DiscountType: PromoPercent, PercentOff: 20, MaxPerUser: 1, Active: true}
+	db.Create(&promo)
+
+	book := func(start time.Time) int {
+		req := SessionBookingRequest{CounsellorID: counsellor.ID, SessionDate: start.Format(time.RFC3339), Duration: 50, PromoCode: "welcome"}
+		return serveTest(bookSession, http.MethodPost, "/book", "/book", req, user.ID, user.Role).Code
+	}
+
+	start := time.Now().Add(72 * time.Hour).Truncate(time.Hour)
+	if code := book(start); code != http.StatusCreated {
+		t.Fatalf("booking status = %d", code)
+	}
+	var session Session
+	db.Where("user_id = ?", user.ID).First(&session)
+	var intent PaymentIntent
+	db.Where("session_id = ?", session.ID).First(&intent)
+	if intent.Amount != 64000 {
+		t.Errorf("payment = %d, want 64000 after the discount", intent.Amount)
+	}
+
+	if code := book(start.Add(24 * time.Hour)); code != http.StatusUnprocessableEntity {
+		t.Errorf("second use status = %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	// The unpaid booking lapses, which gives the use back.
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return transitionSession(tx, &session, SessionExpired, 0, "payment hold expired")
+	}); err != nil {
+		t.Fatalf("expire session: %v", err)
+	}
+	db.First(&promo, promo.ID)
+	if promo.Redemptions != 0 {
+		t.Errorf("redemptions = %d after the booking lapsed, want 0", promo.Redemptions)
+	}
+	if code := book(start.Add(24 * time.Hour)); code != http.StatusCreated {
+		t.Errorf("rebooking status = %d, want %d", code, http.StatusCreated)
+	}
+}
+
+func TestReleasePromoForSeries(t *testing.T) {
+	tests := []struct {
+		name         string
+		lapse        int  // occurrences that expire unpaid
+		paid         bool // whether the series payment was captured
+		wantReleased bool
+	}{
+		{"every occurrence lapsed", 3, false, true},
+		{"some still awaiting payment", 2, false, false},
+		{"series was paid", 3, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Promo", nil)
+			promo := PromoCode{Code: "SERIES", DiscountType: PromoPercent, PercentOff: 10, Redemptions: 1, Active: true}
+			db.Create(&promo)
+			series := SessionSeries{UserID: user.ID, CounsellorID: counsellor.ID, Frequency: "weekly", Count: 3, Status: SeriesActive}
+			db.Create(&series)
+			db.Create(&PromoRedemption{PromoCodeID: promo.ID, Code: promo.Code, UserID: user.ID, SeriesID: &series.ID, Discount: 24000})
+			if tt.paid {
+				db.Create(&PaymentIntent{UserID: user.ID, SeriesID: &series.ID, ProviderIntentID: "fake_pi_series", Status: PaymentCaptured})
+			}
+
+			var sessions []Session
+			for i := 0; i < 3; i++ {
+				s := createTestSession(t, user, counsellor, time.Now().AddDate(0, 0, 7*(i+1)), SessionPendingPayment)
+				db.Model(&s).Update("series_id", series.ID)
+				sessions = append(sessions, s)
+			}
+			for i := 0; i < tt.lapse; i++ {
+				if err := db.Transaction(func(tx *gorm.DB) error {
+					return transitionSession(tx, &sessions[i], SessionExpired, 0, "payment hold expired")
+				}); err != nil {
+					t.Fatalf("expire occurrence %d: %v", i, err)
+				}
+			}
+
+			var redemption PromoRedemption
+			db.Where("series_id = ?", series.ID).First(&redemption)
+			db.First(&promo, promo.ID)
+			if released := redemption.ReleasedAt != nil; released != tt.wantReleased {
+				t.Errorf("released = %v, want %v", released, tt.wantReleased)
+			}
+			if want := map[bool]int{true: 0, false: 1}[tt.wantReleased]; promo.Redemptions != want {
+				t.Errorf("redemptions = %d, want %d", promo.Redemptions, want)
+			}
+		})
+	}
+}
+
+func TestCreatePromoCode(t *testing.T) {
+	counsellorIDs := func(ids ...uint) []uint { return ids }
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		body PromoCodeRequest
+		want int
+	}{
+		{"percent", PromoCodeRequest{Code: "spring20", DiscountType: PromoPercent, PercentOff: 20}, http.StatusCreated},
+		{"fixed defaults to INR", PromoCodeRequest{Code: "FLAT500", DiscountType: PromoFixed, AmountOff: 50000}, http.StatusCreated},
+		{"duplicate code", PromoCodeRequest{Code: "existing", DiscountType: PromoPercent, PercentOff: 20}, http.StatusConflict},
+		{"zero percent", PromoCodeRequest{Code: "ZERO", DiscountType: PromoPercent}, http.StatusBadRequest},
+		{"over 100 percent", PromoCodeRequest{Code: "MORE", DiscountType: PromoPercent, PercentOff: 101}, http.StatusBadRequest},
+		{"fixed without an amount", PromoCodeRequest{Code: "NONE", DiscountType: PromoFixed}, http.StatusBadRequest},
+		{"unsupported currency", PromoCodeRequest{Code: "ODD", DiscountType: PromoFixed, AmountOff: 1, Currency: "XYZ"}, http.StatusBadRequest},
+		{"ends before it starts", PromoCodeRequest{Code: "BACK", DiscountType: PromoPercent, PercentOff: 5, StartsAt: &later, EndsAt: &now}, http.StatusBadRequest},
+		{"unknown counsellor", PromoCodeRequest{Code: "WHO", DiscountType: PromoPercent, PercentOff: 5, CounsellorIDs: counsellorIDs(1, 99)}, http.StatusBadRequest},
+		{"not alphanumeric", PromoCodeRequest{Code: "NO-DASH", DiscountType: PromoPercent, PercentOff: 5}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "admin@example.com", RoleAdmin)
+			createTestCounsellor(t, "Dr Promo", nil)
+			db.Create(&PromoCode{Code: "EXISTING", DiscountType: PromoPercent, PercentOff: 10, Active: true})
+
+			w := serveTest(createPromoCode, http.MethodPost, "/promos", "/promos", tt.body, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusCreated {
+				return
+			}
+
+			var promo PromoCode
+			db.Where("code = ?", strings.ToUpper(tt.body.Code)).First(&promo)
+			if promo.ID == 0 || promo.MaxPerUser != 1 || promo.CreatedBy != admin.ID {
+				t.Errorf("stored promo = %+v, want it upper-cased, one use per user, created by %d", promo, admin.ID)
+			}
+			if tt.body.DiscountType == PromoFixed && promo.Currency != defaultCurrency {
+				t.Errorf("currency = %q, want %q", promo.Currency, defaultCurrency)
+			}
+		})
+	}
+}
+
+func TestUpdatePromoCode(t *testing.T) {
+	tests := []struct {
+		name string
+		body PromoCodeRequest
+		want int
+	}{
+		{"raise the cap", PromoCodeRequest{Code: "spring20", DiscountType: PromoPercent, PercentOff: 25, MaxRedemptions: 10}, http.StatusOK},
+		{"rename", PromoCodeRequest{Code: "SUMMER20", DiscountType: PromoPercent, PercentOff: 20, MaxRedemptions: 10}, http.StatusBadRequest},
+		{"invalid discount", PromoCodeRequest{Code: "SPRING20", DiscountType: PromoPercent, MaxRedemptions: 10}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "admin@example.com", RoleAdmin)
+			promo := PromoCode{Code: "SPRING20", DiscountType: PromoPercent, PercentOff: 20, MaxRedemptions: 5, Redemptions: 2, Active: true}
+			db.Create(&promo)
+
+			// A booking redeems the code after the handler has loaded it.
+			redeemed := false
+			db.Callback().Update().Before("gorm:update").Register("test:redeem", func(tx *gorm.DB) {
+				if redeemed || tx.Statement.Table != "promo_codes" {
+					return
+				}
+				redeemed = true
+				tx.Session(&gorm.Session{NewDB: true}).Model(&PromoCode{}).Where("id = ?", promo.ID).
+					UpdateColumn("redemptions", gorm.Expr("redemptions + 1"))
+			})
+
+			w := serveTest(updatePromoCode, http.MethodPut, "/promos/:id", fmt.Sprintf("/promos/%d", promo.ID), tt.body, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var stored PromoCode
+			db.First(&stored, promo.ID)
+			if tt.want != http.StatusOK {
+				if stored.PercentOff != 20 || stored.MaxRedemptions != 5 {
+					t.Errorf("rejected update changed the code: %+v", stored)
+				}
+				return
+			}
+			if stored.PercentOff != 25 || stored.MaxRedemptions != 10 || stored.Redemptions != 3 {
+				t.Errorf("stored promo = %+v, want the edit applied and 3 redemptions kept", stored)
+			}
+			var resp PromoCode
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Redemptions != 3 {
+				t.Errorf("response redemptions = %d, want 3", resp.Redemptions)
+			}
+		})
+	}
+}
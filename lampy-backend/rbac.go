@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles
+const (
+	RoleUser       = "user"
+	RoleCounsellor = "counsellor"
+	RoleReviewer   = "reviewer"
+	RoleAdmin      = "admin"
+	RoleSuperadmin = "superadmin"
+)
+
+// Permission is a single grant checked by requirePermission.
+type Permission string
+
+const (
+	PermVerificationReview Permission = "verifications:review"
+	PermVerificationAssign Permission = "verifications:assign"
+	PermCounsellorManage   Permission = "counsellors:manage"
+	PermReportsView        Permission = "reports:view"
+	PermRolesManage        Permission = "roles:manage"
+	PermRefundsIssue       Permission = "refunds:issue"
+	PermInvoicesManage     Permission = "invoices:manage"
+	PermPackagesManage     Permission = "packages:manage"
+	PermPromosManage       Permission = "promos:manage"
+)
+
+// rolePermissions lists the grants held by each role. Roles are not
+// hierarchical; every grant a role needs is listed explicitly.
+var rolePermissions = map[string][]Permission{
+	RoleUser:       {},
+	RoleCounsellor: {},
+	RoleReviewer:   {PermVerificationReview},
+	RoleAdmin:      {PermVerificationReview, PermVerificationAssign, PermCounsellorManage, PermReportsView, PermRefundsIssue, PermInvoicesManage, PermPackagesManage, PermPromosManage},
+	RoleSuperadmin: {PermVerificationReview, PermVerificationAssign, PermCounsellorManage, PermReportsView, PermRolesManage, PermRefundsIssue, PermInvoicesManage, PermPackagesManage, PermPromosManage},
+}
+
+type RoleUpdateRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func hasPermission(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware
+// requirePermission must run after authMiddleware, which puts the caller's
+// role into the context.
+func requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		if !hasPermission(role, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Admin handlers
+func updateUserRole(c *gin.Context) {
+	id := c.Param("id")
+
+	var req RoleUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !isValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := db.Model(&user).Update("role", req.Role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	// Force re-login so the new role is reflected in the user's tokens.
+	revokeUserTokens(db, user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully"})
+}
+
+func getReportSummary(c *gin.Context) {
+	var users, counsellors, sessions, pendingVerifications int64
+	db.Model(&User{}).Count(&users)
+	db.Model(&Counsellor{}).Count(&counsellors)
+	db.Model(&Session{}).Count(&sessions)
+	db.Model(&VerificationRequest{}).Where("status = ?", "pending").Count(&pendingVerifications)
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":                 users,
+		"counsellors":           counsellors,
+		"sessions":              sessions,
+		"pending_verifications": pendingVerifications,
+	})
+}
+
+// bootstrapSuperadmin promotes the account named by LAMPY_SUPERADMIN_EMAIL so
+// that a fresh install has someone able to hand out the other roles.
+func bootstrapSuperadmin() {
+	email := os.Getenv("LAMPY_SUPERADMIN_EMAIL")
+	if email == "" {
+		return
+	}
+
+	result := db.Model(&User{}).Where("email = ?", email).Update("role", RoleSuperadmin)
+	if result.Error == nil && result.RowsAffected > 0 {
+		fmt.Printf("✅ Granted superadmin to %s\n", email)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		role string
+		perm Permission
+		want bool
+	}{
+		{RoleUser, PermVerificationReview, false},
+		{RoleCounsellor, PermReportsView, false},
+		{RoleReviewer, PermVerificationReview, true},
+		{RoleReviewer, PermVerificationAssign, false},
+		{RoleReviewer, PermRefundsIssue, false},
+		{RoleAdmin, PermVerificationAssign, true},
+		{RoleAdmin, PermRefundsIssue, true},
+		{RoleAdmin, PermRolesManage, false},
+		{RoleSuperadmin, PermRolesManage, true},
+		{"", PermVerificationReview, false},
+		{"root", PermRolesManage, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.role, tt.perm), func(t *testing.T) {
+			if got := hasPermission(tt.role, tt.perm); got != tt.want {
+				t.Errorf("hasPermission(%q, %q) = %v, want %v", tt.role, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		role string
+		want int
+	}{
+		{RoleUser, http.StatusForbidden},
+		{RoleReviewer, http.StatusForbidden},
+		{RoleAdmin, http.StatusForbidden},
+		{RoleSuperadmin, http.StatusOK},
+		{"", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				c.Set("role", tt.role)
+			}, requirePermission(PermRolesManage), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		want     int
+		wantRole string
+	}{
+		{"promote to reviewer", RoleReviewer, http.StatusOK, RoleReviewer},
+		{"unknown role", "owner", http.StatusBadRequest, RoleUser},
+		{"empty role", "", http.StatusBadRequest, RoleUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "root@example.com", RoleSuperadmin)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			pair, _ := issueTokenPair(user)
+
+			target := fmt.Sprintf("/users/%d/role", user.ID)
+			w := serveTest(updateUserRole, http.MethodPut, "/users/:id/role", target, RoleUpdateRequest{Role: tt.role}, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&user, user.ID)
+			if user.Role != tt.wantRole {
+				t.Errorf("role = %q, want %q", user.Role, tt.wantRole)
+			}
+
+			// A role change must end the user's sessions so that no token
+			// carries the old role.
+			_, err := rotateRefreshToken(pair.RefreshToken)
+			if changed := tt.want == http.StatusOK; changed != errors.Is(err, errRefreshInvalid) {
+				t.Errorf("refresh after role change error = %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileIgnoresProtectedFields(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]any
+	}{
+		{"role", map[string]any{"role": RoleSuperadmin}},
+		{"verification flags", map[string]any{"photo_verified": true, "age_verified": true}},
+		{"id", map[string]any{"id": 999}},
+		{"password", map[string]any{"password": "hunter2"}},
+		{"mixed with allowed field", map[string]any{"name": "New Name", "role": RoleAdmin}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+
+			w := serveTest(updateProfile, http.MethodPut, "/profile", "/profile", tt.body, user.ID, user.Role)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			var got User
+			if err := db.First(&got, user.ID).Error; err != nil {
+				t.Fatalf("user lost: %v", err)
+			}
+			if got.Role != RoleUser || got.PhotoVerified || got.AgeVerified || got.Password != user.Password {
+				t.Errorf("protected fields changed: %+v", got)
+			}
+			if name, ok := tt.body["name"]; ok && got.Name != name {
+				t.Errorf("name = %q, want %q", got.Name, name)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]any
+		want int
+	}{
+		{"valid timezone", map[string]any{"timezone": "Europe/London"}, http.StatusOK},
+		{"unknown timezone", map[string]any{"timezone": "Mars/Olympus"}, http.StatusBadRequest},
+		{"empty name", map[string]any{"name": ""}, http.StatusBadRequest},
+		{"wrong type", map[string]any{"name": 5}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+
+			w := serveTest(updateProfile, http.MethodPut, "/profile", "/profile", tt.body, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
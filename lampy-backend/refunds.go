@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Refund statuses
+const (
+	RefundPending    = "pending"    // queued, not yet accepted by the gateway
+	RefundProcessing = "processing" // accepted, waiting for the gateway to settle
+	RefundSucceeded  = "succeeded"
+	RefundFailed     = "failed"
+)
+
+// Refund kinds
+const (
+	RefundCancellation = "cancellation"
+	RefundManual       = "manual"
+	RefundAutomatic    = "automatic"
+)
+
+// Ledger entry types
+const (
+	LedgerPayment = "payment"
+	LedgerRefund  = "refund"
+)
+
+const maxRefundAttempts = 5
+
+var refundPollInterval = time.Duration(getEnvInt("REFUND_POLL_SECONDS", 60)) * time.Second
+
+var errRefundExceedsBalance = errors.New("refund exceeds the refundable balance")
+
+// LedgerEntry is an append-only record of money moving for a session:
+// what was paid for it when a payment is captured, and each refund once
+// the gateway has settled it. Refund amounts are negative.
+type LedgerEntry struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	SessionID       uint      `json:"session_id" gorm:"index;not null"`
+	PaymentIntentID uint      `json:"payment_intent_id" gorm:"index;not null"`
+	RefundID        *uint     `json:"refund_id,omitempty"`
+	Type            string    `json:"type"`
+	Amount          int64     `json:"amount"` // minor units
+	Currency        string    `json:"currency"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Refund is a request to return money for a session. It is queued in the
+// same transaction as the change that caused it and submitted to the
+// refund gateway by the refund worker.
+type Refund struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	SessionID        uint       `json:"session_id" gorm:"index;not null"`
+	PaymentIntentID  uint       `json:"payment_intent_id" gorm:"index;not null"`
+	Amount           int64      `json:"amount"` // minor units
+	Currency         string     `json:"currency"`
+	Kind             string     `json:"kind"`
+	Reason           string     `json:"reason"`
+	ActorID          uint       `json:"actor_id"` // 0 for the system
+	Status           string     `json:"status" gorm:"index"`
+	ProviderRefundID string     `json:"provider_refund_id,omitempty"`
+	Attempts         int        `json:"attempts"`
+	Error            string     `json:"error,omitempty"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type ManualRefundRequest struct {
+	Amount int64  `json:"amount" binding:"min=0"` // minor units; 0 refunds the whole balance
+	Reason string `json:"reason" binding:"required"`
+}
+
+// SessionBalance summarises the money held for a session. Refundable is
+// what has been paid and is not already refunded or being refunded.
+type SessionBalance struct {
+	Paid       int64  `json:"paid"`
+	Refunded   int64  `json:"refunded"`
+	Pending    int64  `json:"pending_refunds"`
+	Refundable int64  `json:"refundable"`
+	Currency   string `json:"currency"`
+
+	paymentIntentID uint
+}
+
+func sessionBalance(tx *gorm.DB, sessionID uint) (SessionBalance, error) {
+	var balance SessionBalance
+
+	var payment LedgerEntry
+	err := tx.Where("session_id = ? AND type = ?", sessionID, LedgerPayment).First(&payment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return balance, nil
+	}
+	if err != nil {
+		return balance, err
+	}
+	balance.Paid = payment.Amount
+	balance.Currency = payment.Currency
+	balance.paymentIntentID = payment.PaymentIntentID
+
+	var refunds []Refund
+	if err := tx.Where("session_id = ? AND status <> ?", sessionID, RefundFailed).Find(&refunds).Error; err != nil {
+		return balance, err
+	}
+	for _, r := range refunds {
+		if r.Status == RefundSucceeded {
+			balance.Refunded += r.Amount
+		} else {
+			balance.Pending += r.Amount
+		}
+	}
+
+	balance.Refundable = balance.Paid - balance.Refunded - balance.Pending
+	return balance, nil
+}
+
+// cancellationRefund is the part of the refundable balance returned to the
+// user under a cancellation outcome: everything except the fee.
+func cancellationRefund(balance SessionBalance, outcome CancellationOutcome) int64 {
+	return balance.Refundable * int64(100-outcome.FeePercent) / 100
+}
+
+// queueRefund records a refund for the worker to submit. A zero amount
+// queues nothing.
+func queueRefund(tx *gorm.DB, session Session, amount int64, kind, reason string, actorID uint) (*Refund, error) {
+	balance, err := sessionBalance(tx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	if amount > balance.Refundable {
+		return nil, errRefundExceedsBalance
+	}
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	refund := Refund{
+		SessionID:       session.ID,
+		PaymentIntentID: balance.paymentIntentID,
+		Amount:          amount,
+		Currency:        balance.Currency,
+		Kind:            kind,
+		Reason:          reason,
+		ActorID:         actorID,
+		Status:          RefundPending,
+	}
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, err
+	}
+	return &refund, nil
+}
+
+func startRefundWorker() {
+	go func() {
+		ticker := time.NewTicker(refundPollInterval)
+		defer ticker.Stop()
+
+		for {
+			processRefunds()
+			<-ticker.C
+		}
+	}()
+}
+
+// processRefunds submits queued refunds to the gateway and polls the ones
+// it has accepted until they succeed or fail.
+func processRefunds() {
+	var refunds []Refund
+	if err := db.Where("status IN ?", []string{RefundPending, RefundProcessing}).Order("id").Find(&refunds).Error; err != nil {
+		log.Printf("failed to look up open refunds: %v", err)
+		return
+	}
+
+	for i := range refunds {
+		var err error
+		if refunds[i].Status == RefundPending {
+			err = submitRefund(&refunds[i])
+		} else {
+			err = pollRefund(&refunds[i])
+		}
+		if err != nil {
+			log.Printf("refund %d: %v", refunds[i].ID, err)
+		}
+	}
+}
+
+func submitRefund(refund *Refund) error {
+	var intent PaymentIntent
+	if err := db.First(&intent, refund.PaymentIntentID).Error; err != nil {
+		return err
+	}
+
+	if intent.Provider != refundGateway.Name() {
+		return finishRefund(refund, RefundFailed, "payment was taken by "+intent.Provider+", which is not configured")
+	}
+
+	// The attempt is claimed before the gateway is called, so two workers
+	// cannot submit the same refund. An earlier attempt may have created the
+	// refund even if its response was lost, so retries look for it by
+	// reference before creating another.
+	claim := db.Model(&Refund{}).
+		Where("id = ? AND status = ? AND attempts = ?", refund.ID, RefundPending, refund.Attempts).
+		Update("attempts", refund.Attempts+1)
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return claim.Error
+	}
+	reference := "lampy_refund_" + strconv.Itoa(int(refund.ID))
+
+	var (
+		result ProviderRefund
+		found  bool
+		err    error
+	)
+	if refund.Attempts > 0 {
+		result, found, err = refundGateway.FindRefund(intent.ProviderPaymentID, reference)
+	}
+	if err == nil && !found {
+		result, err = refundGateway.CreateRefund(RefundRequest{
+			PaymentID: intent.ProviderPaymentID,
+			Amount:    refund.Amount,
+			Currency:  refund.Currency,
+			Reference: reference,
+		})
+	}
+	if err != nil {
+		// Gateway errors are usually transient; try again on the next run.
+		if refund.Attempts+1 >= maxRefundAttempts {
+			return finishRefund(refund, RefundFailed, err.Error())
+		}
+		db.Model(&Refund{}).Where("id = ?", refund.ID).Update("error", err.Error())
+		return err
+	}
+
+	if err := db.Model(&Refund{}).Where("id = ?", refund.ID).Updates(map[string]interface{}{
+		"status":             RefundProcessing,
+		"provider_refund_id": result.ID,
+		"error":              "",
+	}).Error; err != nil {
+		return err
+	}
+	refund.Attempts++
+	refund.Status = RefundProcessing
+	refund.ProviderRefundID = result.ID
+
+	if result.Status != RefundProcessing {
+		return finishRefund(refund, result.Status, "")
+	}
+	return nil
+}
+
+func pollRefund(refund *Refund) error {
+	status, err := refundGateway.RefundStatus(refund.ProviderRefundID)
+	if err != nil {
+		return err
+	}
+	if status == RefundProcessing {
+		return nil
+	}
+	return finishRefund(refund, status, "")
+}
+
+// finishRefund records the final status of a refund. Successful refunds are
+// written to the ledger.
+func finishRefund(refund *Refund, status, reason string) error {
+	now := time.Now()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Refund{}).
+			Where("id = ? AND status IN ?", refund.ID, []string{RefundPending, RefundProcessing}).
+			Updates(map[string]interface{}{
+				"status":       status,
+				"error":        reason,
+				"completed_at": now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		refund.Status = status
+		refund.CompletedAt = &now
+		if status != RefundSucceeded {
+			return nil
+		}
+
+		return tx.Create(&LedgerEntry{
+			SessionID:       refund.SessionID,
+			PaymentIntentID: refund.PaymentIntentID,
+			RefundID:        &refund.ID,
+			Type:            LedgerRefund,
+			Amount:          -refund.Amount,
+			Currency:        refund.Currency,
+		}).Error
+	})
+}
+
+// Session handlers
+func getSessionRefunds(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	respondSessionRefunds(c, session, false)
+}
+
+// Admin handlers
+func getSessionLedger(c *gin.Context) {
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	respondSessionRefunds(c, session, true)
+}
+
+// issueManualRefund refunds part or all of what was paid for a session,
+// whatever the cancellation policy says.
+func issueManualRefund(c *gin.Context) {
+	adminID := c.MustGet("user_id").(uint)
+
+	var req ManualRefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	var refund *Refund
+	err := db.Transaction(func(tx *gorm.DB) error {
+		balance, err := sessionBalance(tx, session.ID)
+		if err != nil {
+			return err
+		}
+
+		amount := req.Amount
+		if amount == 0 {
+			amount = balance.Refundable
+		}
+		if amount == 0 {
+			return errRefundExceedsBalance
+		}
+
+		refund, err = queueRefund(tx, session, amount, RefundManual, req.Reason, adminID)
+		return err
+	})
+	if errors.Is(err, errRefundExceedsBalance) {
+		balance, _ := sessionBalance(db, session.ID)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":      fmt.Sprintf("At most %s can be refunded for this session", Money{Amount: balance.Refundable, Currency: balance.Currency}),
+			"refundable": balance.Refundable,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue refund"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, refund)
+}
+
+func respondSessionRefunds(c *gin.Context, session Session, withLedger bool) {
+	balance, err := sessionBalance(db, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load refunds"})
+		return
+	}
+
+	var refunds []Refund
+	db.Where("session_id = ?", session.ID).Order("created_at").Find(&refunds)
+
+	response := gin.H{"balance": balance, "refunds": refunds}
+	if withLedger {
+		var entries []LedgerEntry
+		db.Where("session_id = ?", session.ID).Order("id").Find(&entries)
+		response["ledger"] = entries
+	}
+
+	c.JSON(http.StatusOK, response)
+}
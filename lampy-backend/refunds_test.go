@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createPaidSession creates a confirmed session whose payment of amount INR
+// paise has been captured by the fake gateway.
+func createPaidSession(t *testing.T, startsIn time.Duration, amount int64) (User, Session) {
+	t.Helper()
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Refund", nil)
+	session := createTestSession(t, user, counsellor, time.Now().Add(startsIn), SessionConfirmed)
+
+	now := time.Now()
+	intent := PaymentIntent{
+		UserID:            user.ID,
+		SessionID:         &session.ID,
+		Provider:          "fake",
+		ProviderIntentID:  fmt.Sprintf("fake_pi_%d", session.ID),
+		ProviderPaymentID: fmt.Sprintf("fake_pay_%d", session.ID),
+		Amount:            amount,
+		Currency:          "INR",
+		Status:            PaymentCaptured,
+		CapturedAt:        &now,
+	}
+	db.Create(&intent)
+	db.Create(&LedgerEntry{SessionID: session.ID, PaymentIntentID: intent.ID, Type: LedgerPayment, Amount: amount, Currency: "INR"})
+	return user, session
+}
+
+// flakyGateway wraps the fake gateway and fails the first failures refund
+// requests. With accepted set the gateway creates those refunds anyway, as
+// when a response is lost to a timeout.
+type flakyGateway struct {
+	*fakeGateway
+	failures int
+	accepted bool
+	creates  int
+}
+
+func (g *flakyGateway) CreateRefund(req RefundRequest) (ProviderRefund, error) {
+	g.creates++
+	if g.failures > 0 {
+		g.failures--
+		if g.accepted {
+			g.fakeGateway.CreateRefund(req)
+		}
+		return ProviderRefund{}, errors.New("gateway timeout")
+	}
+	return g.fakeGateway.CreateRefund(req)
+}
+
+func TestCancellationRefund(t *testing.T) {
+	tests := []struct {
+		refundable int64
+		feePercent int
+		want       int64
+	}{
+		{80000, 0, 80000},
+		{80000, 50, 40000},
+		{80000, 100, 0},
+		{99999, 50, 49999},
+		{80001, 25, 60000},
+		{0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d less %d%%", tt.refundable, tt.feePercent), func(t *testing.T) {
+			got := cancellationRefund(SessionBalance{Refundable: tt.refundable}, CancellationOutcome{FeePercent: tt.feePercent})
+			if got != tt.want {
+				t.Errorf("cancellationRefund() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionBalance(t *testing.T) {
+	tests := []struct {
+		name           string
+		refunds        map[string]int64 // status to amount
+		wantRefunded   int64
+		wantPending    int64
+		wantRefundable int64
+	}{
+		{"no refunds", nil, 0, 0, 80000},
+		{"settled refund", map[string]int64{RefundSucceeded: 30000}, 30000, 0, 50000},
+		{"open refunds", map[string]int64{RefundPending: 10000, RefundProcessing: 20000}, 0, 30000, 50000},
+		{"failed refund is ignored", map[string]int64{RefundFailed: 80000}, 0, 0, 80000},
+		{"mixed", map[string]int64{RefundSucceeded: 40000, RefundPending: 40000}, 40000, 40000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			_, session := createPaidSession(t, 48*time.Hour, 80000)
+			for status, amount := range tt.refunds {
+				db.Create(&Refund{SessionID: session.ID, PaymentIntentID: 1, Amount: amount, Currency: "INR", Status: status})
+			}
+
+			balance, err := sessionBalance(db, session.ID)
+			if err != nil {
+				t.Fatalf("sessionBalance() error = %v", err)
+			}
+			if balance.Paid != 80000 || balance.Refunded != tt.wantRefunded || balance.Pending != tt.wantPending || balance.Refundable != tt.wantRefundable {
+				t.Errorf("balance = %+v, want refunded %d, pending %d, refundable %d", balance, tt.wantRefunded, tt.wantPending, tt.wantRefundable)
+			}
+		})
+	}
+}
+
+func TestCancelPaidSessionRefunds(t *testing.T) {
+	tests := []struct {
+		name       string
+		startsIn   time.Duration
+		wantRefund int64
+	}{
+		{"free cancellation", 72 * time.Hour, 80000},
+		{"late cancellation", 2 * time.Hour, 80000 * int64(100-defaultCancellationPolicy.LateCancelFeePercent) / 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			refundGateway.(*fakeGateway).refundDelay = 0
+			user, session := createPaidSession(t, tt.startsIn, 80000)
+
+			w := serveTest(cancelSession, http.MethodPut, "/sessions/:id", fmt.Sprintf("/sessions/%d", session.ID), CancelSessionRequest{Reason: "busy"}, user.ID, user.Role)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			// The first run submits the refund, the second sees it settled.
+			processRefunds()
+			processRefunds()
+
+			var refund Refund
+			db.Where("session_id = ?", session.ID).First(&refund)
+			if refund.Amount != tt.wantRefund || refund.Kind != RefundCancellation || refund.Status != RefundSucceeded {
+				t.Fatalf("refund = %d %s %s, want %d succeeded", refund.Amount, refund.Kind, refund.Status, tt.wantRefund)
+			}
+
+			balance, _ := sessionBalance(db, session.ID)
+			if balance.Refunded != tt.wantRefund || balance.Refundable != 80000-tt.wantRefund {
+				t.Errorf("balance after refund = %+v", balance)
+			}
+			var entry LedgerEntry
+			db.Where("session_id = ? AND type = ?", session.ID, LedgerRefund).First(&entry)
+			if entry.Amount != -tt.wantRefund || entry.RefundID == nil || *entry.RefundID != refund.ID {
+				t.Errorf("ledger refund entry = %+v", entry)
+			}
+		})
+	}
+}
+
+func TestSubmitRefund(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		accepted     bool
+		runs         int
+		provider     string
+		wantStatus   string
+		wantAttempts int
+		wantCreates  int
+	}{
+		{name: "accepted first time", runs: 1, provider: "fake", wantStatus: RefundProcessing, wantAttempts: 1, wantCreates: 1},
+		{name: "lost response is found, not repeated", failures: 1, accepted: true, runs: 2, provider: "fake", wantStatus: RefundProcessing, wantAttempts: 2, wantCreates: 1},
+		{name: "retried after an error", failures: 2, runs: 3, provider: "fake", wantStatus: RefundProcessing, wantAttempts: 3, wantCreates: 3},
+		{name: "gives up after the limit", failures: 100, runs: maxRefundAttempts + 2, provider: "fake", wantStatus: RefundFailed, wantAttempts: maxRefundAttempts, wantCreates: maxRefundAttempts},
+		{name: "other provider", runs: 1, provider: "razorpay", wantStatus: RefundFailed, wantAttempts: 0, wantCreates: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			gateway := &flakyGateway{fakeGateway: refundGateway.(*fakeGateway), failures: tt.failures, accepted: tt.accepted}
+			refundGateway = gateway
+			_, session := createPaidSession(t, 48*time.Hour, 80000)
+			db.Model(&PaymentIntent{}).Where("session_id = ?", session.ID).Update("provider", tt.provider)
+
+			refund, err := queueRefund(db, session, 30000, RefundManual, "goodwill", 1)
+			if err != nil {
+				t.Fatalf("queueRefund() error = %v", err)
+			}
+			for i := 0; i < tt.runs; i++ {
+				processRefunds()
+			}
+
+			db.First(refund, refund.ID)
+			if refund.Status != tt.wantStatus || refund.Attempts != tt.wantAttempts || gateway.creates != tt.wantCreates {
+				t.Errorf("status %q, attempts %d, creates %d; want %q, %d, %d",
+					refund.Status, refund.Attempts, gateway.creates, tt.wantStatus, tt.wantAttempts, tt.wantCreates)
+			}
+		})
+	}
+}
+
+func TestIssueManualRefund(t *testing.T) {
+	tests := []struct {
+		name       string
+		already    int64 // refunded before the request
+		amount     int64
+		want       int
+		wantAmount int64
+	}{
+		{"whole balance", 0, 0, http.StatusCreated, 80000},
+		{"part", 0, 25000, http.StatusCreated, 25000},
+		{"rest after a refund", 30000, 0, http.StatusCreated, 50000},
+		{"more than paid", 0, 80001, http.StatusUnprocessableEntity, 0},
+		{"more than is left", 60000, 30000, http.StatusUnprocessableEntity, 0},
+		{"nothing left", 80000, 0, http.StatusUnprocessableEntity, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			admin := createTestUser(t, "admin@example.com", RoleAdmin)
+			_, session := createPaidSession(t, 48*time.Hour, 80000)
+			if tt.already > 0 {
+				db.Create(&Refund{SessionID: session.ID, PaymentIntentID: 1, Amount: tt.already, Currency: "INR", Status: RefundSucceeded})
+			}
+
+			w := serveTest(issueManualRefund, http.MethodPost, "/sessions/:id/refunds", fmt.Sprintf("/sessions/%d/refunds", session.ID),
+				ManualRefundRequest{Amount: tt.amount, Reason: "goodwill"}, admin.ID, admin.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var queued []Refund
+			db.Where("session_id = ? AND kind = ?", session.ID, RefundManual).Find(&queued)
+			if tt.want != http.StatusCreated {
+				if len(queued) != 0 {
+					t.Errorf("rejected refund was queued: %+v", queued)
+				}
+				return
+			}
+			if len(queued) != 1 || queued[0].Amount != tt.wantAmount || queued[0].ActorID != admin.ID {
+				t.Errorf("queued %+v, want %d by admin %d", queued, tt.wantAmount, admin.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Reminder settings. REMINDER_OFFSETS is a comma separated list of Go
+// durations before the session start, e.g. "24h,1h".
+var (
+	reminderOffsets      = parseReminderOffsets(getEnv("REMINDER_OFFSETS", "24h,1h"))
+	reminderPollInterval = time.Minute
+	reminderMaxAttempts  = getEnvInt("REMINDER_MAX_ATTEMPTS", 3)
+)
+
+// SessionReminder records the delivery of one reminder. The unique index
+// means a reminder is claimed before it is sent, so it can never go out
+// twice, even across restarts. Failed sends are retried on later polls up
+// to reminderMaxAttempts, and rescheduling a session clears its reminders.
+type SessionReminder struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	SessionID     uint       `json:"session_id" gorm:"uniqueIndex:idx_session_reminder;not null"`
+	OffsetMinutes int        `json:"offset_minutes" gorm:"uniqueIndex:idx_session_reminder"`
+	Recipient     string     `json:"recipient" gorm:"uniqueIndex:idx_session_reminder"` // "user", "counsellor"
+	Channel       string     `json:"channel" gorm:"uniqueIndex:idx_session_reminder"`
+	Status        string     `json:"status"` // "sending", "sent", "skipped", "failed"
+	Attempts      int        `json:"attempts" gorm:"default:0"`
+	Error         string     `json:"error,omitempty"`
+	SentAt        *time.Time `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type PushTokenRequest struct {
+	PushToken string `json:"push_token"`
+}
+
+// User handlers
+func updatePushToken(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var req PushTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := db.Model(&User{}).Where("id = ?", userID).Update("push_token", req.PushToken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update push token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Push token updated successfully"})
+}
+
+func startReminderScheduler() {
+	if len(reminderOffsets) == 0 || len(notifiers) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(reminderPollInterval)
+		defer ticker.Stop()
+
+		for {
+			sendDueReminders(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// sendDueReminders sends every reminder whose offset has been reached. A
+// reminder is due when the time left before the session is within its
+// offset but still more than the next smaller offset, so a session booked
+// at short notice only gets the most relevant reminder.
+func sendDueReminders(now time.Time) {
+	for i, offset := range reminderOffsets {
+		var floor time.Duration
+		if i+1 < len(reminderOffsets) {
+			floor = reminderOffsets[i+1]
+		}
+
+		var sessions []Session
+		if err := db.Preload("User").Preload("Counsellor").
+			Where("status IN ? AND session_date > ? AND session_date <= ?",
+				[]string{SessionPending, SessionConfirmed}, now.Add(floor).UTC(), now.Add(offset).UTC()).
+			Find(&sessions).Error; err != nil {
+			log.Printf("failed to look up sessions for reminders: %v", err)
+			return
+		}
+
+		for _, session := range sessions {
+			sendSessionReminders(session, offset)
+		}
+	}
+}
+
+func sendSessionReminders(session Session, offset time.Duration) {
+	recipients := map[string]Recipient{
+		"user": {
+			UserID:    session.User.ID,
+			Name:      session.User.Name,
+			Email:     session.User.Email,
+			PushToken: session.User.PushToken,
+		},
+	}
+	timezones := map[string]string{"user": session.User.Timezone}
+
+	if session.Counsellor.UserID != nil {
+		var account User
+		if err := db.First(&account, *session.Counsellor.UserID).Error; err == nil {
+			recipients["counsellor"] = Recipient{
+				UserID:    account.ID,
+				Name:      session.Counsellor.Name,
+				Email:     account.Email,
+				PushToken: account.PushToken,
+			}
+			timezones["counsellor"] = session.Counsellor.Timezone
+		}
+	}
+
+	for role, recipient := range recipients {
+		msg := reminderNotification(session, role, timezones[role])
+		for _, notifier := range notifiers {
+			deliverReminder(session.ID, offset, role, recipient, notifier, msg)
+		}
+	}
+}
+
+// deliverReminder claims the reminder row and then sends it. If the row
+// exists the reminder was already handled, unless it failed and has
+// attempts left, in which case it is claimed again for a retry.
+func deliverReminder(sessionID uint, offset time.Duration, role string, to Recipient, notifier Notifier, msg Notification) {
+	reminder := SessionReminder{
+		SessionID:     sessionID,
+		OffsetMinutes: int(offset.Minutes()),
+		Recipient:     role,
+		Channel:       notifier.Channel(),
+		Status:        "sending",
+		Attempts:      1,
+	}
+
+	result := db.Where(SessionReminder{
+		SessionID:     reminder.SessionID,
+		OffsetMinutes: reminder.OffsetMinutes,
+		Recipient:     reminder.Recipient,
+		Channel:       reminder.Channel,
+	}).FirstOrCreate(&reminder)
+	if result.Error != nil {
+		return
+	}
+	if result.RowsAffected == 0 {
+		retry := db.Model(&SessionReminder{}).
+			Where("id = ? AND status = ? AND attempts < ?", reminder.ID, "failed", reminderMaxAttempts).
+			Updates(map[string]interface{}{"status": "sending", "attempts": gorm.Expr("attempts + 1")})
+		if retry.Error != nil || retry.RowsAffected == 0 {
+			return
+		}
+	}
+
+	updates := map[string]interface{}{"status": "sent", "sent_at": time.Now()}
+	if err := notifier.Notify(to, msg); err != nil {
+		updates = map[string]interface{}{"status": "failed", "error": err.Error()}
+		if errors.Is(err, errNoAddress) {
+			updates["status"] = "skipped"
+		} else {
+			log.Printf("failed to send %s reminder for session %d: %v", notifier.Channel(), sessionID, err)
+		}
+	}
+
+	db.Model(&reminder).Updates(updates)
+}
+
+// clearSessionReminders forgets the reminders of a session that has moved,
+// so they are sent again for its new time.
+func clearSessionReminders(tx *gorm.DB, sessionID uint) error {
+	return tx.Where("session_id = ?", sessionID).Delete(&SessionReminder{}).Error
+}
+
+func reminderNotification(session Session, role, timezone string) Notification {
+	local := localiseSession(session, timezone)
+
+	with := session.Counsellor.Name
+	if role == "counsellor" {
+		with = session.User.Name
+	}
+
+	return Notification{
+		Title: "Upcoming LAMPY session",
+		Body: fmt.Sprintf("Your %d minute session with %s starts at %s (%s).",
+			session.Duration, with, local.Start.Format("Mon 2 Jan 15:04"), local.Timezone),
+		Data: map[string]interface{}{
+			"type":       "session_reminder",
+			"session_id": session.ID,
+		},
+	}
+}
+
+// parseReminderOffsets parses the offsets and sorts them largest first.
+func parseReminderOffsets(value string) []time.Duration {
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid reminder offset %q", part)
+			continue
+		}
+		offsets = append(offsets, d)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNotifier records notifications and fails with err, if set.
+type testNotifier struct {
+	mu   sync.Mutex
+	err  error
+	sent []Recipient
+}
+
+func (n *testNotifier) Channel() string { return "test" }
+
+func (n *testNotifier) Notify(to Recipient, msg Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, to)
+	return nil
+}
+
+func useTestNotifier(t *testing.T) *testNotifier {
+	t.Helper()
+	previous, previousOffsets := notifiers, reminderOffsets
+	t.Cleanup(func() { notifiers, reminderOffsets = previous, previousOffsets })
+
+	n := &testNotifier{}
+	notifiers = []Notifier{n}
+	reminderOffsets = []time.Duration{24 * time.Hour, time.Hour}
+	return n
+}
+
+func TestParseReminderOffsets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"24h,1h", "[24h0m0s 1h0m0s]"},
+		{"1h, 24h ,15m", "[24h0m0s 1h0m0s 15m0s]"},
+		{"1h,soon,-5m,0s", "[1h0m0s]"},
+		{"", "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := fmt.Sprint(parseReminderOffsets(tt.value)); got != tt.want {
+				t.Errorf("parseReminderOffsets(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendDueReminders(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		startsIn   time.Duration
+		status     string
+		wantOffset int // minutes; 0 for no reminder
+	}{
+		{"day before", 23 * time.Hour, SessionConfirmed, 24 * 60},
+		{"hour before", 30 * time.Minute, SessionPending, 60},
+		{"too early", 25 * time.Hour, SessionConfirmed, 0},
+		{"already started", -time.Minute, SessionConfirmed, 0},
+		{"cancelled", 30 * time.Minute, SessionCancelledByUser, 0},
+		{"unpaid", 30 * time.Minute, SessionPendingPayment, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			notifier := useTestNotifier(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Remind", nil)
+			session := createTestSession(t, user, counsellor, now.Add(tt.startsIn), tt.status)
+
+			// A second poll must not send anything again.
+			sendDueReminders(now)
+			sendDueReminders(now)
+
+			var reminders []SessionReminder
+			db.Where("session_id = ?", session.ID).Find(&reminders)
+			if tt.wantOffset == 0 {
+				if len(reminders) != 0 || len(notifier.sent) != 0 {
+					t.Errorf("sent %d reminders, want none", len(notifier.sent))
+				}
+				return
+			}
+			if len(reminders) != 1 || reminders[0].OffsetMinutes != tt.wantOffset || reminders[0].Status != "sent" {
+				t.Fatalf("reminders = %+v, want one sent at %d minutes", reminders, tt.wantOffset)
+			}
+			if len(notifier.sent) != 1 || notifier.sent[0].Email != user.Email {
+				t.Errorf("notified %+v, want %s once", notifier.sent, user.Email)
+			}
+		})
+	}
+}
+
+func TestDeliverReminderRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		polls        int
+		recoverAfter int // polls after which the channel works again; 0 for never
+		wantStatus   string
+		wantAttempts int
+		wantSent     int
+	}{
+		{"sent once", nil, 3, 0, "sent", 1, 1},
+		{"retried until sent", errors.New("gateway down"), 3, 1, "sent", 2, 1},
+		{"gives up after the limit", errors.New("gateway down"), reminderMaxAttempts + 2, 0, "failed", reminderMaxAttempts, 0},
+		{"no address is not retried", errNoAddress, 3, 0, "skipped", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			notifier := useTestNotifier(t)
+			notifier.err = tt.err
+
+			to := Recipient{UserID: 1, Email: "user@example.com"}
+			for poll := 0; poll < tt.polls; poll++ {
+				if tt.recoverAfter != 0 && poll == tt.recoverAfter {
+					notifier.err = nil
+				}
+				deliverReminder(1, time.Hour, "user", to, notifier, Notification{})
+			}
+
+			var reminder SessionReminder
+			db.Where("session_id = ?", 1).First(&reminder)
+			if reminder.Status != tt.wantStatus || reminder.Attempts != tt.wantAttempts || len(notifier.sent) != tt.wantSent {
+				t.Errorf("status %q, attempts %d, sent %d; want %q, %d, %d",
+					reminder.Status, reminder.Attempts, len(notifier.sent), tt.wantStatus, tt.wantAttempts, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestRescheduleResendsReminders(t *testing.T) {
+	setupTestDB(t)
+	notifier := useTestNotifier(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	counsellor := createTestCounsellor(t, "Dr Remind", nil)
+	openAllWeek(t, counsellor)
+
+	start := time.Now().Add(72 * time.Hour).Truncate(time.Hour)
+	session := createTestSession(t, user, counsellor, start, SessionConfirmed)
+	sendDueReminders(start.Add(-23 * time.Hour))
+
+	moved := start.Add(24 * time.Hour)
+	w := serveTest(rescheduleSession, http.MethodPut, "/sessions/:id/reschedule", fmt.Sprintf("/sessions/%d/reschedule", session.ID),
+		RescheduleRequest{SessionDate: moved.Format(time.RFC3339)}, user.ID, user.Role)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reschedule status = %d, body %s", w.Code, w.Body)
+	}
+
+	sendDueReminders(moved.Add(-23 * time.Hour))
+	if len(notifier.sent) != 2 {
+		t.Errorf("sent %d reminders, want one for each time", len(notifier.sent))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Reschedule policy, overridable with RESCHEDULE_MIN_NOTICE_HOURS and
+// RESCHEDULE_MAX_COUNT.
+var (
+	rescheduleMinNotice = time.Duration(getEnvInt("RESCHEDULE_MIN_NOTICE_HOURS", 24)) * time.Hour
+	rescheduleMaxCount  = getEnvInt("RESCHEDULE_MAX_COUNT", 2)
+)
+
+// SessionHistory records changes made to a session over its lifetime.
+type SessionHistory struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	SessionID   uint       `json:"session_id" gorm:"index;not null"`
+	Action      string     `json:"action"`   // "rescheduled", "status_changed"
+	ActorID     uint       `json:"actor_id"` // 0 for system changes
+	FromStatus  string     `json:"from_status,omitempty"`
+	ToStatus    string     `json:"to_status,omitempty"`
+	FromDate    *time.Time `json:"from_date,omitempty"`
+	ToDate      *time.Time `json:"to_date,omitempty"`
+	OldDuration int        `json:"old_duration,omitempty"`
+	NewDuration int        `json:"new_duration,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type RescheduleRequest struct {
+	SessionDate string `json:"session_date" binding:"required"`
+	Duration    int    `json:"duration" binding:"omitempty,min=1,max=480"`
+	Reason      string `json:"reason"`
+}
+
+// Session handlers
+func rescheduleSession(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+	sessionID := c.Param("id")
+
+	var req RescheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	newDate, err := parseSessionDate(req.SessionDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session date format"})
+		return
+	}
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	// Unpaid sessions move to pending only when their payment is captured.
+	if session.Status == SessionPendingPayment ||
+		(session.Status != SessionPending && !canTransitionSession(session.Status, SessionPending)) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only pending or confirmed sessions can be rescheduled"})
+		return
+	}
+
+	if time.Until(session.SessionDate) < rescheduleMinNotice {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Sessions can only be rescheduled at least %d hours in advance", int(rescheduleMinNotice.Hours())),
+		})
+		return
+	}
+
+	if session.RescheduleCount >= rescheduleMaxCount {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Sessions can be rescheduled at most %d times", rescheduleMaxCount),
+		})
+		return
+	}
+
+	if !newDate.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New session date must be in the future"})
+		return
+	}
+
+	// The session was paid for, or taken from a credit, at its booked
+	// length, so only its time can move.
+	if req.Duration != 0 && req.Duration != session.Duration {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The length of a session cannot be changed when rescheduling; cancel it and book again"})
+		return
+	}
+	duration := session.Duration
+
+	var counsellor Counsellor
+	if err := db.First(&counsellor, session.CounsellorID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Counsellor not found"})
+		return
+	}
+
+	withinHours, err := isWithinAvailability(db, counsellor, newDate, time.Duration(duration)*time.Minute)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check availability"})
+		return
+	}
+
+	if !withinHours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requested time is outside the counsellor's availability"})
+		return
+	}
+
+	oldDate := session.SessionDate
+	oldDuration := session.Duration
+	moved := session
+	moved.SessionDate = newDate
+	moved.Duration = duration
+
+	err = reserveSession(&moved, session.ID, func(tx *gorm.DB) error {
+		// The counsellor has to confirm the new time again.
+		result := tx.Model(&Session{}).
+			Where("id = ? AND reschedule_count = ?", session.ID, session.RescheduleCount).
+			Updates(map[string]interface{}{
+				"session_date":     newDate,
+				"duration":         duration,
+				"status":           SessionPending,
+				"reschedule_count": session.RescheduleCount + 1,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("session was modified concurrently")
+		}
+
+		if err := clearSessionReminders(tx, session.ID); err != nil {
+			return err
+		}
+
+		return tx.Create(&SessionHistory{
+			SessionID:   session.ID,
+			Action:      "rescheduled",
+			ActorID:     userID,
+			FromStatus:  session.Status,
+			ToStatus:    SessionPending,
+			FromDate:    &oldDate,
+			ToDate:      &newDate,
+			OldDuration: oldDuration,
+			NewDuration: duration,
+			Reason:      req.Reason,
+		}).Error
+	})
+	if respondBookingConflict(c, err, counsellor, userID, newDate, duration) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reschedule session"})
+		return
+	}
+
+	notifyCounsellorOfReschedule(counsellor, oldDate, newDate, duration)
+
+	db.Preload("User").Preload("Counsellor").First(&session, session.ID)
+
+	c.JSON(http.StatusOK, presentSession(session))
+}
+
+func getSessionHistory(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+	sessionID := c.Param("id")
+
+	var session Session
+	if err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	var history []SessionHistory
+	if err := db.Where("session_id = ?", session.ID).Order("created_at ASC").Find(&history).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// notifyCounsellorOfReschedule emails the counsellor's linked account, if it
+// has one. Failures are logged and do not undo the reschedule.
+func notifyCounsellorOfReschedule(counsellor Counsellor, from, to time.Time, duration int) {
+	if counsellor.UserID == nil {
+		return
+	}
+
+	var account User
+	if err := db.First(&account, *counsellor.UserID).Error; err != nil {
+		return
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nA session booked with you has been moved from %s to %s (%d minutes). Please confirm the new time in the LAMPY app.",
+		counsellor.Name, from.UTC().Format(time.RFC1123), to.UTC().Format(time.RFC1123), duration)
+	if err := mailer.Send(account.Email, "A session has been rescheduled", body); err != nil {
+		log.Printf("failed to notify counsellor %d of reschedule: %v", counsellor.ID, err)
+	}
+}
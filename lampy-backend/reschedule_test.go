@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRescheduleSession(t *testing.T) {
+	now := time.Now().Truncate(time.Hour)
+	booked := now.Add(72 * time.Hour)
+	target := now.Add(96 * time.Hour)
+
+	tests := []struct {
+		name     string
+		status   string
+		start    time.Time
+		count    int
+		foreign  bool // session belongs to another user
+		req      RescheduleRequest
+		prepare  func(t *testing.T, user User, counsellor Counsellor)
+		want     int
+		wantDate time.Time
+	}{
+		{name: "confirmed session", status: SessionConfirmed, start: booked, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusOK, wantDate: target},
+		{name: "overlapping its own slot", status: SessionPending, start: booked, req: RescheduleRequest{SessionDate: booked.Add(30 * time.Minute).Format(time.RFC3339)}, want: http.StatusOK, wantDate: booked.Add(30 * time.Minute)},
+		{name: "same duration given", status: SessionPending, start: booked, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339), Duration: 50}, want: http.StatusOK, wantDate: target},
+		{name: "duration change", status: SessionConfirmed, start: booked, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339), Duration: 90}, want: http.StatusUnprocessableEntity, wantDate: booked},
+		{name: "too little notice", status: SessionConfirmed, start: now.Add(12 * time.Hour), req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusUnprocessableEntity, wantDate: now.Add(12 * time.Hour)},
+		{name: "limit reached", status: SessionConfirmed, start: booked, count: rescheduleMaxCount, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusUnprocessableEntity, wantDate: booked},
+		{name: "unpaid session", status: SessionPendingPayment, start: booked, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusConflict, wantDate: booked},
+		{name: "cancelled session", status: SessionCancelledByUser, start: booked, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusConflict, wantDate: booked},
+		{name: "new date in the past", status: SessionConfirmed, start: booked, req: RescheduleRequest{SessionDate: now.Add(-time.Hour).Format(time.RFC3339)}, want: http.StatusBadRequest, wantDate: booked},
+		{name: "another user's session", status: SessionConfirmed, start: booked, foreign: true, req: RescheduleRequest{SessionDate: target.Format(time.RFC3339)}, want: http.StatusNotFound, wantDate: booked},
+		{
+			name:   "counsellor busy at the new time",
+			status: SessionConfirmed,
+			start:  booked,
+			req:    RescheduleRequest{SessionDate: target.Format(time.RFC3339)},
+			prepare: func(t *testing.T, user User, counsellor Counsellor) {
+				other := createTestUser(t, "other@example.com", RoleUser)
+				createTestSession(t, other, counsellor, target.Add(10*time.Minute), SessionConfirmed)
+			},
+			want:     http.StatusConflict,
+			wantDate: booked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			owner := user
+			if tt.foreign {
+				owner = createTestUser(t, "owner@example.com", RoleUser)
+			}
+			counsellor := createTestCounsellor(t, "Dr Move", nil)
+			openAllWeek(t, counsellor)
+			session := createTestSession(t, owner, counsellor, tt.start, tt.status)
+			db.Model(&session).Update("reschedule_count", tt.count)
+			if tt.prepare != nil {
+				tt.prepare(t, user, counsellor)
+			}
+
+			w := serveTest(rescheduleSession, http.MethodPut, "/sessions/:id/reschedule", fmt.Sprintf("/sessions/%d/reschedule", session.ID), tt.req, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&session, session.ID)
+			if !session.SessionDate.Equal(tt.wantDate) {
+				t.Errorf("session date = %s, want %s", session.SessionDate, tt.wantDate)
+			}
+			if session.Duration != 50 {
+				t.Errorf("duration = %d, want 50", session.Duration)
+			}
+
+			var history int64
+			db.Model(&SessionHistory{}).Where("session_id = ? AND action = ?", session.ID, "rescheduled").Count(&history)
+			if tt.want == http.StatusOK {
+				if session.Status != SessionPending || session.RescheduleCount != tt.count+1 || history != 1 {
+					t.Errorf("status %q, count %d, history %d after reschedule", session.Status, session.RescheduleCount, history)
+				}
+			} else if session.Status != tt.status || history != 0 {
+				t.Errorf("refused reschedule changed status to %q or recorded history %d", session.Status, history)
+			}
+		})
+	}
+}
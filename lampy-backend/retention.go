@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// verificationRetention is how long each type of verification image is
+// kept after the request is approved or rejected. Zero purges it on the
+// next run of the purge job.
+var verificationRetention = map[string]time.Duration{
+	"photo": time.Duration(getEnvInt("RETENTION_PHOTO_DAYS", 30)) * 24 * time.Hour,
+	"age":   time.Duration(getEnvInt("RETENTION_AGE_DAYS", 7)) * 24 * time.Hour,
+}
+
+var documentPurgeInterval = time.Hour
+
+// DocumentPurge is the audit record of a verification image deleted under
+// the retention policy. It is kept after the image is gone to prove when it
+// was deleted and why.
+type DocumentPurge struct {
+	ID                    uint      `json:"id" gorm:"primaryKey"`
+	VerificationRequestID uint      `json:"verification_request_id" gorm:"uniqueIndex"`
+	UserID                uint      `json:"user_id" gorm:"index"`
+	Type                  string    `json:"type"`
+	ReviewStatus          string    `json:"review_status"`
+	ReviewedAt            time.Time `json:"reviewed_at"`
+	BlobKey               string    `json:"blob_key"`
+	BlobDeleted           bool      `json:"blob_deleted"` // false when another request still uses the same file
+	RetentionDays         int       `json:"retention_days"`
+	PurgedAt              time.Time `json:"purged_at"`
+}
+
+// purgeExpiredDocuments deletes the images of reviewed verification
+// requests whose retention window has passed.
+func purgeExpiredDocuments() {
+	now := time.Now()
+
+	for verificationType, retention := range verificationRetention {
+		var requests []VerificationRequest
+		if err := db.Where("type = ? AND status IN ? AND image_url <> ''", verificationType, []string{"approved", "rejected"}).
+			Where("COALESCE(reviewed_at, updated_at) <= ?", now.Add(-retention)).
+			Find(&requests).Error; err != nil {
+			log.Printf("failed to look up %s verifications to purge: %v", verificationType, err)
+			continue
+		}
+
+		for _, request := range requests {
+			if err := purgeVerificationDocument(request, retention, now); err != nil {
+				log.Printf("failed to purge verification request %d: %v", request.ID, err)
+			}
+		}
+	}
+}
+
+// purgeVerificationDocument deletes a request's image and redacts the
+// references to it. The request is redacted first, which locks its row
+// against rotate-keys, and the blob is deleted in the same transaction: if
+// the delete fails the redaction is rolled back and retried on the next run
+// rather than leaving an image nothing points to. Photos are keyed by
+// content, so one still used by another request is kept.
+func purgeVerificationDocument(request VerificationRequest, retention time.Duration, now time.Time) error {
+	key := blobKeyFromStored(request.ImageURL)
+	stored := []string{key, "uploads/" + key}
+
+	reviewedAt := request.UpdatedAt
+	if request.ReviewedAt != nil {
+		reviewedAt = *request.ReviewedAt
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&VerificationRequest{}).
+			Where("id = ? AND image_url = ?", request.ID, request.ImageURL).
+			Update("image_url", "")
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+
+		var others int64
+		if err := tx.Model(&VerificationRequest{}).
+			Where("image_url IN ? AND id <> ?", stored, request.ID).
+			Count(&others).Error; err != nil {
+			return err
+		}
+
+		deleted := others == 0
+		if deleted {
+			if err := blobStore.Delete(key); err != nil && !errors.Is(err, errBlobNotFound) {
+				return err
+			}
+			for _, column := range []string{"verification_photo_url", "age_verification_photo_url"} {
+				if err := tx.Model(&User{}).Where(column+" IN ?", stored).Update(column, "").Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Create(&DocumentPurge{
+			VerificationRequestID: request.ID,
+			UserID:                request.UserID,
+			Type:                  request.Type,
+			ReviewStatus:          request.Status,
+			ReviewedAt:            reviewedAt,
+			BlobKey:               key,
+			BlobDeleted:           deleted,
+			RetentionDays:         int(retention / (24 * time.Hour)),
+			PurgedAt:              now,
+		}).Error
+	})
+}
+
+func startDocumentPurgeJob() {
+	go func() {
+		ticker := time.NewTicker(documentPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			purgeExpiredDocuments()
+			<-ticker.C
+		}
+	}()
+}
+
+// Admin handlers
+func getDocumentPurges(c *gin.Context) {
+	query := db.Order("purged_at DESC")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var purges []DocumentPurge
+	if err := query.Limit(500).Find(&purges).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch purge records"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"retention_days": gin.H{
+			"photo": int(verificationRetention["photo"] / (24 * time.Hour)),
+			"age":   int(verificationRetention["age"] / (24 * time.Hour)),
+		},
+		"purges": purges,
+	})
+}
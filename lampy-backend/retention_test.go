@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createVerification stores data as a verification image and adds a request
+// for it, reviewed reviewedAgo ago when reviewedAgo is non-zero.
+func createVerification(t *testing.T, user User, verificationType, status string, key string, reviewedAgo time.Duration) VerificationRequest {
+	t.Helper()
+	if err := blobStore.Put(key, []byte("image of "+key), ContentJPEG); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	request := VerificationRequest{UserID: user.ID, Type: verificationType, Status: status, ImageURL: key}
+	if reviewedAgo != 0 {
+		reviewedAt := time.Now().Add(-reviewedAgo)
+		request.ReviewedAt = &reviewedAt
+	}
+	if err := db.Create(&request).Error; err != nil {
+		t.Fatalf("failed to create verification request: %v", err)
+	}
+	return request
+}
+
+func TestPurgeExpiredDocuments(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		typ         string
+		status      string
+		reviewedAgo time.Duration
+		updatedAgo  time.Duration // for requests reviewed before reviewed_at was recorded
+		wantPurged  bool
+	}{
+		{"age document past retention", "age", "approved", 8 * day, 0, true},
+		{"age document within retention", "age", "approved", 6 * day, 0, false},
+		{"rejected age document", "age", "rejected", 8 * day, 0, true},
+		{"photo past retention", "photo", "approved", 31 * day, 0, true},
+		{"photo within retention", "photo", "approved", 8 * day, 0, false},
+		{"pending request", "age", "pending", 0, 60 * day, false},
+		{"legacy review, old", "age", "approved", 0, 8 * day, true},
+		{"legacy review, recent", "age", "approved", 0, day, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			key := tt.typ + "/doc"
+			request := createVerification(t, user, tt.typ, tt.status, key, tt.reviewedAgo)
+			if tt.updatedAgo != 0 {
+				db.Model(&request).UpdateColumn("updated_at", time.Now().Add(-tt.updatedAgo))
+			}
+			column := map[string]string{"photo": "verification_photo_url", "age": "age_verification_photo_url"}[tt.typ]
+			db.Model(&user).Update(column, key)
+
+			purgeExpiredDocuments()
+
+			db.First(&request, request.ID)
+			db.First(&user, user.ID)
+			_, blobErr := blobStore.Get(key)
+			var purges []DocumentPurge
+			db.Find(&purges)
+
+			if !tt.wantPurged {
+				if request.ImageURL != key || blobErr != nil || len(purges) != 0 {
+					t.Errorf("document was purged: image_url %q, blob error %v, %d records", request.ImageURL, blobErr, len(purges))
+				}
+				return
+			}
+			if request.ImageURL != "" || !errors.Is(blobErr, errBlobNotFound) {
+				t.Errorf("document kept: image_url %q, blob error %v", request.ImageURL, blobErr)
+			}
+			if user.VerificationPhotoURL != "" || user.AgeVerificationPhotoURL != "" {
+				t.Errorf("user still references the document: %q, %q", user.VerificationPhotoURL, user.AgeVerificationPhotoURL)
+			}
+			if len(purges) != 1 {
+				t.Fatalf("got %d purge records, want 1", len(purges))
+			}
+			purge := purges[0]
+			wantDays := int(verificationRetention[tt.typ] / day)
+			if purge.VerificationRequestID != request.ID || purge.UserID != user.ID || purge.Type != tt.typ ||
+				purge.ReviewStatus != tt.status || purge.BlobKey != key || !purge.BlobDeleted || purge.RetentionDays != wantDays {
+				t.Errorf("purge record = %+v", purge)
+			}
+		})
+	}
+}
+
+func TestPurgeKeepsSharedPhoto(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	const key = "verification/shared"
+
+	// Photos are keyed by content, so a resubmitted photo shares the blob.
+	old := createVerification(t, user, "photo", "rejected", key, 40*24*time.Hour)
+	current := createVerification(t, user, "photo", "pending", "uploads/"+key, 0)
+	db.Model(&user).Update("verification_photo_url", key)
+
+	purgeExpiredDocuments()
+
+	db.First(&old, old.ID)
+	db.First(&user, user.ID)
+	if old.ImageURL != "" {
+		t.Errorf("expired request still has image_url %q", old.ImageURL)
+	}
+	if _, err := blobStore.Get(key); err != nil {
+		t.Fatalf("shared photo was deleted: %v", err)
+	}
+	if user.VerificationPhotoURL != key {
+		t.Errorf("user photo reference = %q, want it kept", user.VerificationPhotoURL)
+	}
+	var purge DocumentPurge
+	db.Where("verification_request_id = ?", old.ID).First(&purge)
+	if purge.BlobDeleted {
+		t.Error("purge record says the shared photo was deleted")
+	}
+
+	// Once the other request expires too, the photo goes.
+	reviewedAt := time.Now().Add(-40 * 24 * time.Hour)
+	db.Model(&current).Updates(map[string]any{"status": "approved", "reviewed_at": reviewedAt})
+	purgeExpiredDocuments()
+
+	db.First(&user, user.ID)
+	if _, err := blobStore.Get(key); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("photo kept after its last request was purged: %v", err)
+	}
+	if user.VerificationPhotoURL != "" {
+		t.Errorf("user photo reference = %q, want it redacted", user.VerificationPhotoURL)
+	}
+	var count int64
+	db.Model(&DocumentPurge{}).Count(&count)
+	if count != 2 {
+		t.Errorf("got %d purge records, want 2", count)
+	}
+}
+
+// failingDeleteStore is a blob store whose deletes fail.
+type failingDeleteStore struct {
+	BlobStore
+}
+
+func (failingDeleteStore) Delete(string) error { return errors.New("store unavailable") }
+
+func TestPurgeRollsBackWhenDeleteFails(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+	request := createVerification(t, user, "age", "approved", "age_verification/doc", 8*24*time.Hour)
+	blobStore = failingDeleteStore{blobStore}
+
+	purgeExpiredDocuments()
+
+	db.First(&request, request.ID)
+	var count int64
+	db.Model(&DocumentPurge{}).Count(&count)
+	if request.ImageURL != "age_verification/doc" || count != 0 {
+		t.Errorf("failed purge left image_url %q and %d records, want it rolled back", request.ImageURL, count)
+	}
+}
+
+func TestGetDocumentPurges(t *testing.T) {
+	setupTestDB(t)
+	admin := createTestUser(t, "admin@example.com", RoleAdmin)
+	first := createTestUser(t, "first@example.com", RoleUser)
+	second := createTestUser(t, "second@example.com", RoleUser)
+	createVerification(t, first, "age", "approved", "age_verification/first", 8*24*time.Hour)
+	createVerification(t, second, "age", "approved", "age_verification/second", 8*24*time.Hour)
+	purgeExpiredDocuments()
+
+	tests := []struct {
+		name   string
+		query  string
+		wantN  int
+		wantBy uint
+	}{
+		{"all", "", 2, 0},
+		{"one user", fmt.Sprintf("?user_id=%d", first.ID), 1, first.ID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(getDocumentPurges, http.MethodGet, "/purges", "/purges"+tt.query, nil, admin.ID, admin.Role)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+			var resp struct {
+				RetentionDays map[string]int  `json:"retention_days"`
+				Purges        []DocumentPurge `json:"purges"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if len(resp.Purges) != tt.wantN || resp.RetentionDays["age"] != 7 {
+				t.Fatalf("response = %+v", resp)
+			}
+			if tt.wantBy != 0 && resp.Purges[0].UserID != tt.wantBy {
+				t.Errorf("purge for user %d, want %d", resp.Purges[0].UserID, tt.wantBy)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxSeriesOccurrences = 52
+
+var errTooManyOccurrences = errors.New("recurrence has too many occurrences")
+
+// Series statuses
+const (
+	SeriesActive    = "active"
+	SeriesCancelled = "cancelled"
+)
+
+// SessionSeries is a recurring booking. Each occurrence is an ordinary
+// Session pointing back at the series.
+type SessionSeries struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	UserID       uint       `json:"user_id" gorm:"index;not null"`
+	CounsellorID uint       `json:"counsellor_id" gorm:"index;not null"`
+	Frequency    string     `json:"frequency"` // "weekly", "biweekly"
+	StartDate    time.Time  `json:"start_date"`
+	Duration     int        `json:"duration"`
+	Count        int        `json:"count"`
+	Until        *time.Time `json:"until,omitempty"`
+	Timezone     string     `json:"timezone"` // occurrences keep this wall-clock time
+	Status       string     `json:"status"`
+	Notes        string     `json:"notes"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Request/Response DTOs
+type RecurrenceRequest struct {
+	Frequency string `json:"frequency" binding:"required,oneof=weekly biweekly"`
+	Count     int    `json:"count" binding:"omitempty,min=2,max=52"`
+	Until     string `json:"until"`
+}
+
+type CancelSeriesRequest struct {
+	FromSessionID uint `json:"from_session_id"`
+}
+
+// OccurrenceProblem explains why one occurrence of a series cannot be booked.
+type OccurrenceProblem struct {
+	Occurrence int       `json:"occurrence"`
+	Start      time.Time `json:"start"`
+	Reason     string    `json:"reason"`
+}
+
+type SeriesConflictError struct {
+	Problems []OccurrenceProblem
+}
+
+func (e *SeriesConflictError) Error() string {
+	return "series occurrences conflict with existing sessions"
+}
+
+// bookSeries creates a recurring booking. Every occurrence must be free and
+// inside the counsellor's hours; otherwise nothing is booked and the
+// response lists the occurrences that failed. price is per occurrence, after
+// any promo discount.
+func bookSeries(c *gin.Context, user User, counsellor Counsellor, req SessionBookingRequest, start time.Time, price Money, promo *PromoQuote) {
+	rec := req.Recurrence
+
+	var until *time.Time
+	if rec.Until != "" {
+		t, err := parseRangeBound(rec.Until, time.Time{}, loadLocation(user.Timezone))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until date"})
+			return
+		}
+		// A bare date includes the whole of that day
+		if len(rec.Until) == len("2006-01-02") {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		until = &t
+	}
+
+	if rec.Count == 0 && until == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Recurrence needs a count or an until date"})
+		return
+	}
+
+	dates, err := seriesOccurrences(start, rec.Frequency, rec.Count, until, loadLocation(user.Timezone))
+	if errors.Is(err, errTooManyOccurrences) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Recurrence must produce at most %d occurrences", maxSeriesOccurrences)})
+		return
+	}
+	if len(dates) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Recurrence must produce at least two occurrences"})
+		return
+	}
+
+	length := time.Duration(req.Duration) * time.Minute
+
+	var problems []OccurrenceProblem
+	for i, date := range dates {
+		ok, err := isWithinAvailability(db, counsellor, date, length)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check availability"})
+			return
+		}
+		if !ok {
+			problems = append(problems, OccurrenceProblem{Occurrence: i + 1, Start: date, Reason: "outside_availability"})
+		}
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Some occurrences cannot be booked", "occurrences": problems})
+		return
+	}
+
+	series := SessionSeries{
+		UserID:       user.ID,
+		CounsellorID: counsellor.ID,
+		Frequency:    rec.Frequency,
+		StartDate:    start,
+		Duration:     req.Duration,
+		Count:        len(dates),
+		Until:        until,
+		Timezone:     loadLocation(user.Timezone).String(),
+		Status:       SeriesActive,
+		Notes:        req.Notes,
+	}
+
+	useCredits := price.Amount > 0 && promo == nil && (req.UseCredits == nil || *req.UseCredits)
+	paidWithCredits := false
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := lockBookingCalendars(tx, counsellor.ID, user.ID); err != nil {
+			return err
+		}
+
+		var conflicts []OccurrenceProblem
+		for i, date := range dates {
+			for _, owner := range []struct {
+				column string
+				id     uint
+				party  string
+			}{{"counsellor_id = ?", counsellor.ID, "counsellor"}, {"user_id = ?", user.ID, "user"}} {
+				clash, err := findOverlappingSession(tx, owner.column, owner.id, date, length, 0)
+				if err != nil {
+					return err
+				}
+				if clash != nil {
+					conflicts = append(conflicts, OccurrenceProblem{Occurrence: i + 1, Start: date, Reason: owner.party + "_busy"})
+					break
+				}
+			}
+		}
+		if len(conflicts) > 0 {
+			return &SeriesConflictError{Problems: conflicts}
+		}
+
+		if err := tx.Create(&series).Error; err != nil {
+			return err
+		}
+
+		if promo != nil {
+			discount := promo.Discount * int64(len(dates))
+			if _, err := redeemPromo(tx, *promo, PromoRedemption{UserID: user.ID, SeriesID: &series.ID, Discount: discount}); err != nil {
+				return err
+			}
+		}
+
+		// Credits are only used when they cover every occurrence, so a
+		// series is paid for entirely one way or the other.
+		status := initialSessionStatus(price.Amount)
+		if useCredits {
+			available, err := availableCredits(tx, user.ID, counsellor.ID, req.Duration, price)
+			if err != nil {
+				return err
+			}
+			paidWithCredits = available >= len(dates)
+		}
+		if paidWithCredits {
+			status = SessionPending
+		}
+
+		for _, date := range dates {
+			session := Session{
+				UserID:       user.ID,
+				CounsellorID: counsellor.ID,
+				SeriesID:     &series.ID,
+				SessionDate:  date,
+				Duration:     req.Duration,
+				Status:       status,
+				Notes:        req.Notes,
+			}
+			if err := tx.Create(&session).Error; err != nil {
+				return err
+			}
+			if paidWithCredits {
+				if _, err := consumeCredit(tx, session, price); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	var conflict *SeriesConflictError
+	if errors.As(err, &conflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Some occurrences cannot be booked", "occurrences": conflict.Problems})
+		return
+	}
+	if respondPromoError(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to book series"})
+		return
+	}
+
+	// Otherwise the whole series is paid for up front with a single payment.
+	if price.Amount > 0 && !paidWithCredits {
+		total := Money{Amount: price.Amount * int64(len(dates)), Currency: price.Currency}
+		if _, err := createPaymentIntent(PaymentIntent{UserID: user.ID, SeriesID: &series.ID}, total); err != nil {
+			log.Printf("failed to create payment for series %d: %v", series.ID, err)
+			var sessions []Session
+			db.Where("series_id = ?", series.ID).Find(&sessions)
+			abandonUnpaidSessions(sessions)
+			db.Model(&series).Update("status", SeriesCancelled)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start payment"})
+			return
+		}
+	}
+
+	respondSeries(c, http.StatusCreated, series.ID)
+}
+
+// seriesOccurrences expands a recurrence. Steps are taken in calendar days in
+// loc so that occurrences keep the same local time across DST changes. An
+// until date that allows more than maxSeriesOccurrences is an error rather
+// than being cut short.
+func seriesOccurrences(start time.Time, frequency string, count int, until *time.Time, loc *time.Location) ([]time.Time, error) {
+	step := 7
+	if frequency == "biweekly" {
+		step = 14
+	}
+
+	local := start.In(loc)
+	var dates []time.Time
+	for i := 0; count == 0 || i < count; i++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+i*step,
+			local.Hour(), local.Minute(), local.Second(), 0, loc).UTC()
+		if until != nil && date.After(*until) {
+			break
+		}
+		if i == maxSeriesOccurrences {
+			return nil, errTooManyOccurrences
+		}
+		dates = append(dates, date)
+	}
+	return dates, nil
+}
+
+// Series handlers
+func getUserSeries(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var series []SessionSeries
+	if err := db.Where("user_id = ?", userID).Order("start_date DESC").Find(&series).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch series"})
+		return
+	}
+
+	c.JSON(http.StatusOK, series)
+}
+
+func getSeries(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var series SessionSeries
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&series).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Series not found"})
+		return
+	}
+
+	respondSeries(c, http.StatusOK, series.ID)
+}
+
+// cancelSeries cancels every upcoming occurrence from from_session_id on, or
+// all upcoming occurrences when it is omitted. Single occurrences are
+// cancelled through the normal session cancel endpoint.
+func cancelSeries(c *gin.Context) {
+	userID := c.MustGet("user_id").(uint)
+
+	var req CancelSeriesRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var series SessionSeries
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&series).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Series not found"})
+		return
+	}
+
+	from := time.Now()
+	if req.FromSessionID != 0 {
+		var first Session
+		if err := db.Where("id = ? AND series_id = ?", req.FromSessionID, series.ID).First(&first).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found in this series"})
+			return
+		}
+		if first.SessionDate.After(from) {
+			from = first.SessionDate
+		}
+	}
+
+	var upcoming []Session
+	db.Where("series_id = ? AND session_date >= ?", series.ID, from.UTC()).Order("session_date").Find(&upcoming)
+
+	cancelled := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i := range upcoming {
+			if !canTransitionSession(upcoming[i].Status, SessionCancelledByUser) {
+				continue
+			}
+			if err := transitionSession(tx, &upcoming[i], SessionCancelledByUser, userID, "series cancelled"); err != nil {
+				return err
+			}
+			if _, err := applyCancellationPolicy(tx, &upcoming[i], SessionCancelledByUser, "series cancelled"); err != nil {
+				return err
+			}
+			cancelled++
+		}
+
+		var remaining int64
+		tx.Model(&Session{}).Where("series_id = ? AND status IN ?", series.ID, activeSessionStatuses).Count(&remaining)
+		if remaining == 0 {
+			return tx.Model(&series).Update("status", SeriesCancelled).Error
+		}
+		return nil
+	})
+	if respondSessionTransitionError(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel series"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Series cancelled successfully", "cancelled": cancelled})
+}
+
+func respondSeries(c *gin.Context, status int, seriesID uint) {
+	var series SessionSeries
+	db.First(&series, seriesID)
+
+	var sessions []Session
+	db.Where("series_id = ?", seriesID).Preload("User").Preload("Counsellor").Order("session_date").Find(&sessions)
+
+	response := gin.H{
+		"series":   series,
+		"sessions": presentSessions(sessions),
+	}
+
+	var intent PaymentIntent
+	if db.Where("series_id = ?", seriesID).Order("created_at DESC").First(&intent).Error == nil {
+		response["payment"] = intent
+	}
+
+	c.JSON(status, response)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSeriesOccurrences(t *testing.T) {
+	london := loadLocation("Europe/London")
+	start := time.Date(2030, 3, 20, 10, 0, 0, 0, london)
+	until := func(d time.Time) *time.Time { return &d }
+
+	tests := []struct {
+		name      string
+		frequency string
+		count     int
+		until     *time.Time
+		wantLen   int
+		wantLast  time.Time
+		wantErr   error
+	}{
+		{name: "weekly count", frequency: "weekly", count: 3, wantLen: 3, wantLast: time.Date(2030, 4, 3, 10, 0, 0, 0, london)},
+		{name: "biweekly count", frequency: "biweekly", count: 3, wantLen: 3, wantLast: time.Date(2030, 4, 17, 10, 0, 0, 0, london)},
+		{name: "until includes its day", frequency: "weekly", until: until(time.Date(2030, 4, 3, 23, 59, 59, 0, london)), wantLen: 3, wantLast: time.Date(2030, 4, 3, 10, 0, 0, 0, london)},
+		{name: "until cuts the count", frequency: "weekly", count: 10, until: until(time.Date(2030, 3, 28, 0, 0, 0, 0, london)), wantLen: 2, wantLast: time.Date(2030, 3, 27, 10, 0, 0, 0, london)},
+		{name: "count of the maximum", frequency: "weekly", count: maxSeriesOccurrences, wantLen: maxSeriesOccurrences, wantLast: time.Date(2031, 3, 12, 10, 0, 0, 0, london)},
+		{name: "until allowing the maximum", frequency: "weekly", until: until(time.Date(2031, 3, 12, 10, 0, 0, 0, london)), wantLen: maxSeriesOccurrences, wantLast: time.Date(2031, 3, 12, 10, 0, 0, 0, london)},
+		{name: "until allowing one more", frequency: "weekly", until: until(time.Date(2031, 3, 19, 10, 0, 0, 0, london)), wantErr: errTooManyOccurrences},
+		{name: "until years away", frequency: "biweekly", until: until(time.Date(2040, 1, 1, 0, 0, 0, 0, london)), wantErr: errTooManyOccurrences},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dates, err := seriesOccurrences(start, tt.frequency, tt.count, tt.until, london)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("seriesOccurrences() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(dates) != tt.wantLen || !dates[len(dates)-1].Equal(tt.wantLast) {
+				t.Fatalf("got %d dates ending %s, want %d ending %s", len(dates), dates[len(dates)-1], tt.wantLen, tt.wantLast)
+			}
+
+			// Occurrences keep the local time across the change to summer time.
+			for _, d := range dates {
+				if local := d.In(london); local.Hour() != 10 || local.Minute() != 0 {
+					t.Errorf("occurrence at %s local, want 10:00", local.Format("2006-01-02 15:04"))
+				}
+			}
+		})
+	}
+}
+
+func TestBookSeries(t *testing.T) {
+	start := time.Now().Add(72 * time.Hour).Truncate(time.Hour).UTC()
+
+	tests := []struct {
+		name       string
+		recurrence RecurrenceRequest
+		prepare    func(t *testing.T, counsellor Counsellor)
+		want       int
+		wantCount  int
+	}{
+		{name: "weekly series", recurrence: RecurrenceRequest{Frequency: "weekly", Count: 4}, want: http.StatusCreated, wantCount: 4},
+		{name: "until date", recurrence: RecurrenceRequest{Frequency: "biweekly", Until: start.Add(30 * 24 * time.Hour).Format("2006-01-02")}, want: http.StatusCreated, wantCount: 3},
+		{name: "neither count nor until", recurrence: RecurrenceRequest{Frequency: "weekly"}, want: http.StatusBadRequest},
+		{name: "count over the maximum", recurrence: RecurrenceRequest{Frequency: "weekly", Count: 53}, want: http.StatusBadRequest},
+		{name: "until too far away", recurrence: RecurrenceRequest{Frequency: "weekly", Until: start.AddDate(2, 0, 0).Format("2006-01-02")}, want: http.StatusBadRequest},
+		{name: "monthly", recurrence: RecurrenceRequest{Frequency: "monthly", Count: 3}, want: http.StatusBadRequest},
+		{
+			name:       "one occurrence taken",
+			recurrence: RecurrenceRequest{Frequency: "weekly", Count: 4},
+			prepare: func(t *testing.T, counsellor Counsellor) {
+				other := createTestUser(t, "other@example.com", RoleUser)
+				createTestSession(t, other, counsellor, start.AddDate(0, 0, 14), SessionConfirmed)
+			},
+			want: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Weekly", nil)
+			openAllWeek(t, counsellor)
+			if tt.prepare != nil {
+				tt.prepare(t, counsellor)
+			}
+
+			rec := tt.recurrence
+			req := SessionBookingRequest{CounsellorID: counsellor.ID, SessionDate: start.Format(time.RFC3339), Duration: 50, Recurrence: &rec}
+			w := serveTest(bookSession, http.MethodPost, "/book", "/book", req, user.ID, user.Role)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			var booked []Session
+			db.Where("user_id = ?", user.ID).Find(&booked)
+			if len(booked) != tt.wantCount {
+				t.Fatalf("booked %d sessions, want %d", len(booked), tt.wantCount)
+			}
+			if tt.wantCount == 0 {
+				return
+			}
+
+			var intent PaymentIntent
+			if err := db.Where("series_id = ?", *booked[0].SeriesID).First(&intent).Error; err != nil {
+				t.Fatalf("no payment for the series: %v", err)
+			}
+			if want := int64(80000 * tt.wantCount); intent.Amount != want {
+				t.Errorf("payment = %d, want %d", intent.Amount, want)
+			}
+		})
+	}
+}
+
+func TestCancelSeries(t *testing.T) {
+	tests := []struct {
+		name       string
+		fromIndex  int // index of from_session_id, or -1 to omit it
+		wantCancel int
+		wantStatus string
+	}{
+		{"all upcoming", -1, 3, SeriesCancelled},
+		{"from the second occurrence", 1, 2, SeriesActive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Weekly", nil)
+
+			series := SessionSeries{UserID: user.ID, CounsellorID: counsellor.ID, Frequency: "weekly", Count: 3, Status: SeriesActive}
+			db.Create(&series)
+			var sessions []Session
+			for i := 0; i < 3; i++ {
+				s := createTestSession(t, user, counsellor, time.Now().AddDate(0, 0, 7*(i+1)), SessionConfirmed)
+				db.Model(&s).Update("series_id", series.ID)
+				sessions = append(sessions, s)
+			}
+
+			var body any
+			if tt.fromIndex >= 0 {
+				body = CancelSeriesRequest{FromSessionID: sessions[tt.fromIndex].ID}
+			}
+			w := serveTest(cancelSeries, http.MethodPut, "/series/:id/cancel", fmt.Sprintf("/series/%d/cancel", series.ID), body, user.ID, user.Role)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			var cancelled int64
+			db.Model(&Session{}).Where("series_id = ? AND status = ?", series.ID, SessionCancelledByUser).Count(&cancelled)
+			db.First(&series, series.ID)
+			if int(cancelled) != tt.wantCancel || series.Status != tt.wantStatus {
+				t.Errorf("cancelled %d, series %q; want %d, %q", cancelled, series.Status, tt.wantCancel, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Session statuses
+const (
+	SessionPendingPayment        = "pending_payment"
+	SessionPending               = "pending"
+	SessionConfirmed             = "confirmed"
+	SessionInProgress            = "in_progress"
+	SessionCompleted             = "completed"
+	SessionCancelledByUser       = "cancelled_by_user"
+	SessionCancelledByCounsellor = "cancelled_by_counsellor"
+	SessionNoShow                = "no_show"
+	SessionExpired               = "expired"
+
+	// SessionCancelled is a cancellation from before the state machine
+	// whose actor is not recorded. It is terminal and carries no fee.
+	SessionCancelled = "cancelled"
+)
+
+// sessionTransitions lists the statuses each status may move to. Statuses
+// without an entry are terminal.
+var sessionTransitions = map[string][]string{
+	// Paid bookings wait here until the payment webhook reports a capture.
+	SessionPendingPayment: {SessionPending, SessionCancelledByUser, SessionExpired},
+	SessionPending:        {SessionConfirmed, SessionCancelledByUser, SessionCancelledByCounsellor, SessionExpired},
+	// A confirmed session goes back to pending when it is rescheduled, so the
+	// counsellor confirms the new time.
+	SessionConfirmed:  {SessionPending, SessionInProgress, SessionCancelledByUser, SessionCancelledByCounsellor, SessionNoShow},
+	SessionInProgress: {SessionCompleted},
+}
+
+var sessionExpiryInterval = 5 * time.Minute
+
+// SessionTransitionError is returned when a session cannot move from its
+// current status to the requested one.
+type SessionTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *SessionTransitionError) Error() string {
+	return fmt.Sprintf("session cannot move from %s to %s", e.From, e.To)
+}
+
+func canTransitionSession(from, to string) bool {
+	for _, next := range sessionTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionSession moves session to status to and records the change in
+// the session history. The update is conditional on the status the session
+// was loaded with, so a concurrent change makes it fail instead of being
+// overwritten.
+func transitionSession(tx *gorm.DB, session *Session, to string, actorID uint, reason string) error {
+	from := session.Status
+	if !canTransitionSession(from, to) {
+		return &SessionTransitionError{From: from, To: to}
+	}
+
+	result := tx.Model(&Session{}).
+		Where("id = ? AND status = ?", session.ID, from).
+		Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &SessionTransitionError{From: from, To: to}
+	}
+
+	session.Status = to
+
+	// A booking that is never paid for gives back its promo code.
+	if from == SessionPendingPayment && to != SessionPending {
+		if err := releasePromo(tx, *session); err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&SessionHistory{
+		SessionID:  session.ID,
+		Action:     "status_changed",
+		ActorID:    actorID,
+		FromStatus: from,
+		ToStatus:   to,
+		Reason:     reason,
+	}).Error
+}
+
+// respondSessionTransitionError writes a 409 for a rejected transition and
+// reports whether err was one.
+func respondSessionTransitionError(c *gin.Context, err error) bool {
+	var transitionErr *SessionTransitionError
+	if !errors.As(err, &transitionErr) {
+		return false
+	}
+
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   fmt.Sprintf("Session is %s and cannot be moved to %s", transitionErr.From, transitionErr.To),
+		"status":  transitionErr.From,
+		"allowed": sessionTransitions[transitionErr.From],
+	})
+	return true
+}
+
+// expireStaleSessions marks pending sessions whose start time has passed
+// without the counsellor confirming them as expired, and releases the slots
+// of bookings that were not paid for within paymentHoldTTL.
+func expireStaleSessions() {
+	now := time.Now()
+	expireSessions(db.Where("status = ? AND session_date < ?", SessionPending, now.UTC()), "not confirmed before start time")
+	expireSessions(db.Where("status = ? AND (created_at < ? OR session_date < ?)", SessionPendingPayment, now.Add(-paymentHoldTTL), now.UTC()), "not paid in time")
+}
+
+func expireSessions(query *gorm.DB, reason string) {
+	var stale []Session
+	if err := query.Find(&stale).Error; err != nil {
+		log.Printf("failed to look up stale sessions: %v", err)
+		return
+	}
+
+	for i := range stale {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return transitionSession(tx, &stale[i], SessionExpired, 0, reason)
+		})
+		if err != nil {
+			log.Printf("failed to expire session %d: %v", stale[i].ID, err)
+		}
+	}
+}
+
+func startSessionExpiryJob() {
+	go func() {
+		ticker := time.NewTicker(sessionExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			expireStaleSessions()
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCanTransitionSession(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{SessionPendingPayment, SessionPending, true},
+		{SessionPendingPayment, SessionExpired, true},
+		{SessionPendingPayment, SessionConfirmed, false},
+		{SessionPending, SessionConfirmed, true},
+		{SessionPending, SessionCancelledByCounsellor, true},
+		{SessionPending, SessionInProgress, false},
+		{SessionPending, SessionNoShow, false},
+		{SessionConfirmed, SessionPending, true},
+		{SessionConfirmed, SessionInProgress, true},
+		{SessionConfirmed, SessionNoShow, true},
+		{SessionConfirmed, SessionExpired, false},
+		{SessionInProgress, SessionCompleted, true},
+		{SessionInProgress, SessionCancelledByUser, false},
+		{SessionCompleted, SessionConfirmed, false},
+		{SessionCancelledByUser, SessionPending, false},
+		{SessionCancelledByCounsellor, SessionConfirmed, false},
+		{SessionNoShow, SessionCompleted, false},
+		{SessionExpired, SessionPending, false},
+		{SessionCancelled, SessionCancelledByUser, false},
+		{"unknown", SessionPending, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			if got := canTransitionSession(tt.from, tt.to); got != tt.want {
+				t.Errorf("canTransitionSession(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransitionSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   string // status in the database when the transition runs
+		to       string
+		wantErr  bool
+		wantFrom string
+	}{
+		{"allowed", SessionPending, SessionConfirmed, false, SessionPending},
+		{"not allowed", SessionPending, SessionCompleted, true, SessionPending},
+		{"changed underneath", SessionCancelledByUser, SessionConfirmed, true, SessionPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr State", nil)
+			session := createTestSession(t, user, counsellor, time.Now().Add(48*time.Hour), SessionPending)
+
+			// The copy in hand still says pending.
+			loaded := session
+			db.Model(&session).Update("status", tt.stored)
+
+			err := transitionSession(db, &loaded, tt.to, user.ID, "test")
+			var transitionErr *SessionTransitionError
+			if tt.wantErr != errors.As(err, &transitionErr) {
+				t.Fatalf("transitionSession() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			db.First(&session, session.ID)
+			var history []SessionHistory
+			db.Where("session_id = ?", session.ID).Find(&history)
+			if tt.wantErr {
+				if session.Status != tt.stored || len(history) != 0 {
+					t.Errorf("failed transition left status %q and %d history rows", session.Status, len(history))
+				}
+				return
+			}
+			if session.Status != tt.to || len(history) != 1 || history[0].FromStatus != tt.wantFrom || history[0].ActorID != user.ID {
+				t.Errorf("status %q, history %+v", session.Status, history)
+			}
+		})
+	}
+}
+
+func TestExpireStaleSessions(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		status  string
+		start   time.Time
+		created time.Time
+		want    string
+	}{
+		{"pending past start", SessionPending, now.Add(-time.Minute), now.Add(-time.Hour), SessionExpired},
+		{"pending in future", SessionPending, now.Add(time.Hour), now.Add(-time.Hour), SessionPending},
+		{"unpaid past hold", SessionPendingPayment, now.Add(48 * time.Hour), now.Add(-paymentHoldTTL - time.Minute), SessionExpired},
+		{"unpaid within hold", SessionPendingPayment, now.Add(48 * time.Hour), now, SessionPendingPayment},
+		{"confirmed past start", SessionConfirmed, now.Add(-time.Minute), now.Add(-time.Hour), SessionConfirmed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Expiry", nil)
+			session := createTestSession(t, user, counsellor, tt.start, tt.status)
+			db.Model(&session).UpdateColumn("created_at", tt.created)
+
+			expireStaleSessions()
+
+			db.First(&session, session.ID)
+			if session.Status != tt.want {
+				t.Errorf("status = %q, want %q", session.Status, tt.want)
+			}
+		})
+	}
+}
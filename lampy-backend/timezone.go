@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+// LocalTime is a session's start and end rendered in one party's timezone.
+type LocalTime struct {
+	Timezone string    `json:"timezone"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// SessionResponse is a session as returned by the API, with its times
+// localised for both the user and the counsellor. Session, User and
+// Counsellor must be loaded for the localisation to be correct.
+type SessionResponse struct {
+	Session
+	LocalTimes map[string]LocalTime `json:"local_times"`
+	Payment    *PaymentIntent       `json:"payment,omitempty"`
+	Credit     *CreditLedgerEntry   `json:"credit,omitempty"`
+	Promo      *PromoRedemption     `json:"promo,omitempty"`
+}
+
+func presentSession(session Session) SessionResponse {
+	return SessionResponse{
+		Session: session,
+		LocalTimes: map[string]LocalTime{
+			"user":       localiseSession(session, session.User.Timezone),
+			"counsellor": localiseSession(session, session.Counsellor.Timezone),
+		},
+	}
+}
+
+func presentSessions(sessions []Session) []SessionResponse {
+	responses := make([]SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		responses = append(responses, presentSession(s))
+	}
+	return responses
+}
+
+func localiseSession(session Session, timezone string) LocalTime {
+	loc := loadLocation(timezone)
+	start := session.SessionDate.In(loc)
+	return LocalTime{
+		Timezone: loc.String(),
+		Start:    start,
+		End:      start.Add(time.Duration(session.Duration) * time.Minute),
+	}
+}
+
+// loadLocation resolves an IANA timezone name, falling back to the default
+// timezone for empty or unknown names.
+func loadLocation(name string) *time.Location {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	loc, _ := time.LoadLocation(defaultTimezone)
+	return loc
+}
+
+func isValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSessionDate(t *testing.T) {
+	want := time.Date(2030, 7, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"2030-07-01T10:00:00Z", false},
+		{"2030-07-01T15:30:00+05:30", false},
+		{"2030-07-01T06:00:00-04:00", false},
+		{"2030-07-01T10:00:00", true},
+		{"2030-07-01", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSessionDate(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSessionDate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !got.Equal(want) || got.Location() != time.UTC {
+				t.Errorf("parseSessionDate() = %s, want %s in UTC", got, want)
+			}
+		})
+	}
+}
+
+func TestIsValidTimezone(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Asia/Kolkata", true},
+		{"Europe/London", true},
+		{"UTC", true},
+		{"", false},
+		{"Local", false},
+		{"Mars/Olympus", false},
+		{"+05:30", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isValidTimezone(tt.name); got != tt.want {
+				t.Errorf("isValidTimezone(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocaliseSession(t *testing.T) {
+	session := Session{SessionDate: time.Date(2030, 1, 15, 9, 0, 0, 0, time.UTC), Duration: 50}
+
+	tests := []struct {
+		timezone  string
+		wantZone  string
+		wantStart string
+		wantEnd   string
+	}{
+		{"Asia/Kolkata", "Asia/Kolkata", "14:30", "15:20"},
+		{"America/New_York", "America/New_York", "04:00", "04:50"},
+		{"Europe/London", "Europe/London", "09:00", "09:50"},
+		{"", defaultTimezone, "14:30", "15:20"},
+		{"Nowhere/Special", defaultTimezone, "14:30", "15:20"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			got := localiseSession(session, tt.timezone)
+			if got.Timezone != tt.wantZone || got.Start.Format("15:04") != tt.wantStart || got.End.Format("15:04") != tt.wantEnd {
+				t.Errorf("localiseSession() = %s %s-%s, want %s %s-%s",
+					got.Timezone, got.Start.Format("15:04"), got.End.Format("15:04"), tt.wantZone, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+// Stored times are UTC text, so a bound in another zone that is not
+// converted compares wrongly as a string.
+func TestQueriesUseUTCBounds(t *testing.T) {
+	stored := time.Date(2030, 7, 1, 22, 0, 0, 0, time.UTC)
+
+	for _, zone := range []string{"UTC", "Asia/Kolkata", "America/Los_Angeles", "Pacific/Kiritimati"} {
+		t.Run(zone, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			counsellor := createTestCounsellor(t, "Dr Zones", nil)
+			createTestSession(t, user, counsellor, stored, SessionConfirmed)
+
+			start := stored.Add(10 * time.Minute).In(loadLocation(zone))
+
+			conflict, err := findOverlappingSession(db, "counsellor_id = ?", counsellor.ID, start, 30*time.Minute, 0)
+			if err != nil || conflict == nil {
+				t.Errorf("findOverlappingSession() = %v, %v, want the stored session", conflict, err)
+			}
+
+			busy, err := busyIntervals(db, counsellor.ID, start.Add(-time.Hour), start.Add(time.Hour), 0)
+			if err != nil || len(busy) != 1 {
+				t.Errorf("busyIntervals() = %v, %v, want the stored session", busy, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Token lifetimes. Access tokens are short-lived; refresh tokens rotate on every use.
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// RefreshToken is one link in a rotating refresh token family. Every login
+// starts a new family; each refresh marks the presented token as used and
+// issues a successor in the same family. Only the SHA-256 hash is stored.
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	FamilyID  string     `json:"family_id" gorm:"index;not null"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+}
+
+var (
+	errRefreshInvalid = errors.New("invalid refresh token")
+	errRefreshReused  = errors.New("refresh token reuse detected")
+)
+
+// Auth handlers
+func refreshTokens(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pair, err := rotateRefreshToken(req.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"expires_in":    pair.ExpiresIn,
+	})
+}
+
+func logout(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var token RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&token).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if err := revokeTokenFamily(db, token.FamilyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// issueTokenPair starts a new refresh token family for the user and returns
+// an access token bound to it.
+func issueTokenPair(user User) (TokenPair, error) {
+	familyID := generateRandomString(24)
+	raw, err := createRefreshToken(db, user.ID, familyID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	access, err := generateJWT(user, familyID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{AccessToken: access, RefreshToken: raw, ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new pair. Presenting a
+// token that was already rotated revokes the whole family, since it means
+// the token has leaked to a second party.
+func rotateRefreshToken(raw string) (TokenPair, error) {
+	var pair TokenPair
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var token RefreshToken
+		if err := tx.Where("token_hash = ?", hashToken(raw)).First(&token).Error; err != nil {
+			return errRefreshInvalid
+		}
+
+		if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+			return errRefreshInvalid
+		}
+
+		if token.UsedAt != nil {
+			return errRefreshReused
+		}
+
+		// Conditional update so that two concurrent refreshes cannot both win.
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshReused
+		}
+
+		next, err := createRefreshToken(tx, token.UserID, token.FamilyID)
+		if err != nil {
+			return err
+		}
+
+		// Reload the user so role changes are picked up on refresh.
+		var user User
+		if err := tx.First(&user, token.UserID).Error; err != nil {
+			return errRefreshInvalid
+		}
+
+		access, err := generateJWT(user, token.FamilyID)
+		if err != nil {
+			return err
+		}
+
+		pair = TokenPair{AccessToken: access, RefreshToken: next, ExpiresIn: int(accessTokenTTL.Seconds())}
+		return nil
+	})
+
+	if errors.Is(err, errRefreshReused) {
+		// Revoke outside the rolled-back transaction so the revocation sticks.
+		var token RefreshToken
+		if db.Where("token_hash = ?", hashToken(raw)).First(&token).Error == nil {
+			revokeTokenFamily(db, token.FamilyID)
+		}
+	}
+
+	return pair, err
+}
+
+func createRefreshToken(tx *gorm.DB, userID uint, familyID string) (string, error) {
+	raw := generateRandomString(64)
+	token := RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(raw),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+
+	if err := tx.Create(&token).Error; err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+func revokeTokenFamily(tx *gorm.DB, familyID string) error {
+	return tx.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeUserTokens ends every session the user has open.
+func revokeUserTokens(tx *gorm.DB, userID uint) error {
+	return tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// isTokenFamilyRevoked reports whether the access token's family has been
+// logged out, so access tokens die with their refresh tokens.
+func isTokenFamilyRevoked(familyID string) bool {
+	var count int64
+	db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NOT NULL", familyID).
+		Count(&count)
+	return count > 0
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, user User) string
+		wantErr error
+		revoked bool // whether the family should end up revoked
+	}{
+		{
+			name: "fresh token rotates",
+			prepare: func(t *testing.T, user User) string {
+				pair, err := issueTokenPair(user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return pair.RefreshToken
+			},
+		},
+		{
+			name: "unknown token",
+			prepare: func(t *testing.T, user User) string {
+				return "not-a-token"
+			},
+			wantErr: errRefreshInvalid,
+		},
+		{
+			name: "expired token",
+			prepare: func(t *testing.T, user User) string {
+				pair, _ := issueTokenPair(user)
+				db.Model(&RefreshToken{}).Where("token_hash = ?", hashToken(pair.RefreshToken)).
+					Update("expires_at", time.Now().Add(-time.Minute))
+				return pair.RefreshToken
+			},
+			wantErr: errRefreshInvalid,
+		},
+		{
+			name: "revoked family",
+			prepare: func(t *testing.T, user User) string {
+				pair, _ := issueTokenPair(user)
+				revokeUserTokens(db, user.ID)
+				return pair.RefreshToken
+			},
+			wantErr: errRefreshInvalid,
+			revoked: true,
+		},
+		{
+			name: "reused token revokes the family",
+			prepare: func(t *testing.T, user User) string {
+				pair, _ := issueTokenPair(user)
+				if _, err := rotateRefreshToken(pair.RefreshToken); err != nil {
+					t.Fatal(err)
+				}
+				return pair.RefreshToken
+			},
+			wantErr: errRefreshReused,
+			revoked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+			raw := tt.prepare(t, user)
+
+			pair, err := rotateRefreshToken(raw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("rotateRefreshToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (pair.AccessToken == "" || pair.RefreshToken == "" || pair.RefreshToken == raw) {
+				t.Fatalf("rotateRefreshToken() returned an unusable pair: %+v", pair)
+			}
+
+			var live int64
+			db.Model(&RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).Count(&live)
+			if tt.revoked && live != 0 {
+				t.Errorf("%d tokens still live, want the family revoked", live)
+			}
+			if !tt.revoked && tt.wantErr == nil && live == 0 {
+				t.Error("family was revoked after a normal rotation")
+			}
+		})
+	}
+}
+
+func TestRotatedTokenReuseKillsSuccessor(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+
+	first, _ := issueTokenPair(user)
+	second, err := rotateRefreshToken(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker replays the first token; the legitimate holder of the
+	// second must be logged out too.
+	if _, err := rotateRefreshToken(first.RefreshToken); !errors.Is(err, errRefreshReused) {
+		t.Fatalf("replay error = %v, want %v", err, errRefreshReused)
+	}
+	if _, err := rotateRefreshToken(second.RefreshToken); !errors.Is(err, errRefreshInvalid) {
+		t.Fatalf("successor error = %v, want %v", err, errRefreshInvalid)
+	}
+
+	var token RefreshToken
+	db.Where("token_hash = ?", hashToken(second.RefreshToken)).First(&token)
+	if !isTokenFamilyRevoked(token.FamilyID) {
+		t.Error("family not reported as revoked, so access tokens would stay valid")
+	}
+}
+
+func TestLogoutRevokesOnlyThatFamily(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com", RoleUser)
+
+	phone, _ := issueTokenPair(user)
+	laptop, _ := issueTokenPair(user)
+
+	w := serveTest(logout, http.MethodPost, "/logout", "/logout", RefreshRequest{RefreshToken: phone.RefreshToken}, 0, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout status = %d, body %s", w.Code, w.Body)
+	}
+
+	if _, err := rotateRefreshToken(phone.RefreshToken); !errors.Is(err, errRefreshInvalid) {
+		t.Errorf("logged out token rotated, error = %v", err)
+	}
+	if _, err := rotateRefreshToken(laptop.RefreshToken); err != nil {
+		t.Errorf("other device's token stopped working: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers the JPEG decoder used by verifyUpload
+	_ "image/png"  // registers the PNG decoder used by verifyUpload
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload content types
+const (
+	ContentJPEG = "image/jpeg"
+	ContentPNG  = "image/png"
+	ContentHEIC = "image/heic"
+	ContentPDF  = "application/pdf"
+)
+
+var contentTypeNames = map[string]string{
+	ContentJPEG: "JPEG",
+	ContentPNG:  "PNG",
+	ContentHEIC: "HEIC",
+	ContentPDF:  "PDF",
+}
+
+// heifBrands are the ftyp brands of HEIF images as saved by phones.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "mif1": true, "msf1": true,
+}
+
+var (
+	maxImageBytes    = int64(getEnvInt("UPLOAD_MAX_IMAGE_MB", 10)) << 20
+	maxDocumentBytes = int64(getEnvInt("UPLOAD_MAX_DOCUMENT_MB", 15)) << 20
+)
+
+// maxImagePixels bounds decoded image size, so a small file cannot expand
+// into gigabytes of memory.
+const maxImagePixels = 50_000_000
+
+// UploadKind describes what one upload form field accepts and where it is
+// stored.
+type UploadKind struct {
+	Field    string // multipart form field
+	Label    string // names the file in error messages
+	Prefix   string // blob key prefix
+	MaxBytes int64
+	Types    []string
+	Encrypt  bool // encrypt at rest; see encryptDocument
+}
+
+var (
+	profilePhotoUpload = UploadKind{
+		Field: "photo", Label: "Photo", Prefix: "profiles",
+		MaxBytes: maxImageBytes, Types: []string{ContentJPEG, ContentPNG, ContentHEIC},
+	}
+	verificationPhotoUpload = UploadKind{
+		Field: "photo", Label: "Photo", Prefix: "verification",
+		MaxBytes: maxImageBytes, Types: []string{ContentJPEG, ContentPNG, ContentHEIC},
+	}
+	idDocumentUpload = UploadKind{
+		Field: "id_document", Label: "ID document", Prefix: "age_verification",
+		MaxBytes: maxDocumentBytes, Types: []string{ContentJPEG, ContentPNG, ContentHEIC, ContentPDF},
+		Encrypt: true,
+	}
+)
+
+// UploadError is an upload rejected because of what the client sent.
+type UploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadError) Error() string { return e.Message }
+
+// receiveUpload reads the file for kind from the request, checks it and
+// stores it, returning its blob key. On failure it writes the error
+// response and returns false.
+func receiveUpload(c *gin.Context, kind UploadKind) (string, bool) {
+	data, contentType, err := readUpload(c, kind)
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) {
+		c.JSON(uploadErr.Status, gin.H{"error": uploadErr.Message})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return "", false
+	}
+
+	key, err := storeUpload(kind.Prefix, data, contentType, kind.Encrypt)
+	if err != nil {
+		log.Printf("failed to store %s upload: %v", kind.Prefix, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save %s", strings.ToLower(kind.Label))})
+		return "", false
+	}
+	return key, true
+}
+
+// readUpload returns the contents and sniffed content type of the file
+// uploaded for kind. The client's file name and Content-Type are not
+// trusted; the type comes from the bytes.
+func readUpload(c *gin.Context, kind UploadKind) ([]byte, string, error) {
+	tooLarge := &UploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s must be at most %d MB", kind.Label, kind.MaxBytes>>20)}
+
+	// Leave room for the multipart framing and any other small fields.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, kind.MaxBytes+64<<10)
+
+	file, header, err := c.Request.FormFile(kind.Field)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return nil, "", tooLarge
+	case errors.Is(err, http.ErrMissingFile):
+		return nil, "", &UploadError{http.StatusBadRequest, kind.Label + " upload required"}
+	case err != nil:
+		return nil, "", &UploadError{http.StatusBadRequest, "Expected a multipart/form-data upload in the " + kind.Field + " field"}
+	}
+	defer file.Close()
+
+	if !safeUploadName(header) {
+		return nil, "", &UploadError{http.StatusBadRequest, "Invalid file name"}
+	}
+	if header.Size > kind.MaxBytes {
+		return nil, "", tooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, kind.MaxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > kind.MaxBytes {
+		return nil, "", tooLarge
+	}
+	if len(data) == 0 {
+		return nil, "", &UploadError{http.StatusBadRequest, kind.Label + " is empty"}
+	}
+
+	contentType := sniffContentType(data)
+	if !acceptsType(kind, contentType) {
+		names := make([]string, len(kind.Types))
+		for i, t := range kind.Types {
+			names[i] = contentTypeNames[t]
+		}
+		return nil, "", &UploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("%s must be a %s file", kind.Label, joinOr(names))}
+	}
+
+	if err := verifyUpload(data, contentType); err != nil {
+		return nil, "", &UploadError{http.StatusUnprocessableEntity, fmt.Sprintf("%s is not a valid %s file: %v", kind.Label, contentTypeNames[contentType], err)}
+	}
+
+	return data, contentType, nil
+}
+
+// safeUploadName rejects file names that try to reach outside a directory.
+// The name is never used for storage, but such a request is not a real
+// upload. mime/multipart strips directories from FileName, so the raw
+// Content-Disposition is checked.
+func safeUploadName(header *multipart.FileHeader) bool {
+	name := header.Filename
+	if _, params, err := mime.ParseMediaType(header.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffContentType identifies the upload types from their signatures, or
+// returns "" for anything else.
+func sniffContentType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" && heifBrands[string(data[8:12])] {
+		return ContentHEIC
+	}
+	switch detected := http.DetectContentType(data); detected {
+	case ContentJPEG, ContentPNG, ContentPDF:
+		return detected
+	}
+	return ""
+}
+
+func acceptsType(kind UploadKind, contentType string) bool {
+	for _, t := range kind.Types {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyUpload checks that data is a well-formed file of contentType rather
+// than something that only starts like one. JPEG and PNG are fully decoded.
+// There is no HEIC decoder in the standard library, so HEIC and PDF files
+// are checked structurally.
+func verifyUpload(data []byte, contentType string) error {
+	switch contentType {
+	case ContentJPEG, ContentPNG:
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if config.Width == 0 || config.Height == 0 {
+			return errors.New("image has no pixels")
+		}
+		if config.Width*config.Height > maxImagePixels {
+			return fmt.Errorf("image is %dx%d, which is too large", config.Width, config.Height)
+		}
+		_, _, err = image.Decode(bytes.NewReader(data))
+		return err
+	case ContentHEIC:
+		return verifyHEIF(data)
+	case ContentPDF:
+		tail := data[len(data)-min(len(data), 1024):]
+		if !bytes.Contains(tail, []byte("%%EOF")) {
+			return errors.New("document is truncated")
+		}
+		return nil
+	}
+	return errors.New("unsupported type")
+}
+
+// verifyHEIF walks the top-level ISO BMFF boxes of a HEIF file, checking
+// that their sizes add up and that the metadata box describing the image
+// is present.
+func verifyHEIF(data []byte) error {
+	hasMeta := false
+	for offset := 0; offset < len(data); {
+		remaining := uint64(len(data) - offset)
+		if remaining < 8 {
+			return errors.New("truncated box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		headerSize := uint64(8)
+		switch size {
+		case 0: // box runs to the end of the file
+			size = remaining
+		case 1: // 64-bit size follows the type
+			if remaining < 16 {
+				return errors.New("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > remaining {
+			return fmt.Errorf("%q box has an invalid size", boxType)
+		}
+
+		if boxType == "meta" {
+			hasMeta = true
+		}
+		offset += int(size)
+	}
+
+	if !hasMeta {
+		return errors.New("image metadata is missing")
+	}
+	return nil
+}
+
+// joinOr formats names as "A", "A or B", or "A, B or C".
+func joinOr(names []string) string {
+	if len(names) <= 1 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
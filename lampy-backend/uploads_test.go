@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func pngBytes(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// pngClaiming is a valid 1x1 PNG whose header claims width x height.
+func pngClaiming(width, height uint32) []byte {
+	data := pngBytes(1, 1)
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func jpegBytes() []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil)
+	return buf.Bytes()
+}
+
+// isoBox builds an ISO BMFF box with a 32-bit size.
+func isoBox(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+func heifBytes(brand string, boxes ...[]byte) []byte {
+	data := isoBox("ftyp", []byte(brand+"\x00\x00\x00\x00mif1"+brand))
+	for _, b := range boxes {
+		data = append(data, b...)
+	}
+	return data
+}
+
+var pdfBytes = []byte("%PDF-1.4\n1 0 obj\n<< >>\nendobj\ntrailer\n<< >>\n%%EOF\n")
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"png", pngBytes(2, 2), ContentPNG},
+		{"jpeg", jpegBytes(), ContentJPEG},
+		{"pdf", pdfBytes, ContentPDF},
+		{"heic", heifBytes("heic", isoBox("meta", nil)), ContentHEIC},
+		{"heif mif1", heifBytes("mif1", isoBox("meta", nil)), ContentHEIC},
+		{"mp4 is not heif", heifBytes("isom", isoBox("meta", nil)), ""},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), ""},
+		{"html", []byte("<html><script>alert(1)</script>"), ""},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), ""},
+		{"short", []byte{0xff}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffContentType(tt.data); got != tt.want {
+				t.Errorf("sniffContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyUpload(t *testing.T) {
+	validPNG := pngBytes(3, 3)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		wantErr     bool
+	}{
+		{"png", validPNG, ContentPNG, false},
+		{"jpeg", jpegBytes(), ContentJPEG, false},
+		{"truncated png", validPNG[:len(validPNG)-20], ContentPNG, true},
+		{"png header only", validPNG[:33], ContentPNG, true},
+		{"zero width png", pngClaiming(0, 10), ContentPNG, true},
+		{"png claiming too many pixels", pngClaiming(10000, 10000), ContentPNG, true},
+		{"pdf", pdfBytes, ContentPDF, false},
+		{"truncated pdf", pdfBytes[:20], ContentPDF, true},
+		{"heic", heifBytes("heic", isoBox("meta", []byte("data")), isoBox("mdat", []byte("pixels"))), ContentHEIC, false},
+		{"unknown type", validPNG, "image/gif", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyUpload(tt.data, tt.contentType); (err != nil) != tt.wantErr {
+				t.Errorf("verifyUpload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyHEIF(t *testing.T) {
+	meta := isoBox("meta", []byte("data"))
+	largeBox := append([]byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 0, 0, 0, 0, 20}, "data"...)
+	toEnd := append([]byte{0, 0, 0, 0, 'm', 'd', 'a', 't'}, "pixels"...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"meta present", heifBytes("heic", meta), false},
+		{"64-bit box size", heifBytes("heic", meta, largeBox), false},
+		{"box to the end", heifBytes("heic", meta, toEnd), false},
+		{"no meta", heifBytes("heic", isoBox("mdat", []byte("pixels"))), true},
+		{"box longer than the file", heifBytes("heic", meta, isoBox("mdat", []byte("pixels"))[:10]), true},
+		{"box smaller than its header", heifBytes("heic", meta, []byte{0, 0, 0, 4, 'f', 'r', 'e', 'e'}), true},
+		{"trailing bytes", heifBytes("heic", meta, []byte{0, 0}), true},
+		{"truncated 64-bit header", heifBytes("heic", meta, largeBox[:12]), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyHEIF(tt.data); (err != nil) != tt.wantErr {
+				t.Errorf("verifyHEIF() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJoinOr(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"PDF"}, "PDF"},
+		{[]string{"JPEG", "PNG"}, "JPEG or PNG"},
+		{[]string{"JPEG", "PNG", "HEIC"}, "JPEG, PNG or HEIC"},
+	}
+
+	for _, tt := range tests {
+		if got := joinOr(tt.names); got != tt.want {
+			t.Errorf("joinOr(%v) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+// newUploadRequest builds a multipart request carrying data as filename in
+// field. The file name is written raw so tests can send unsafe names.
+func newUploadRequest(field, filename string, data []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if field != "" {
+		header := make(map[string][]string)
+		header["Content-Disposition"] = []string{`form-data; name="` + field + `"; filename="` + filename + `"`}
+		header["Content-Type"] = []string{"application/octet-stream"}
+		part, _ := form.CreatePart(header)
+		part.Write(data)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestReadUpload(t *testing.T) {
+	kind := UploadKind{Field: "photo", Label: "Photo", Prefix: "test", MaxBytes: 1 << 20, Types: []string{ContentJPEG, ContentPNG}}
+	oversized := append(pngBytes(1, 1), make([]byte, 1<<20)...)
+
+	tests := []struct {
+		name     string
+		field    string
+		filename string
+		data     []byte
+		want     int
+		wantType string
+	}{
+		{"png", "photo", "me.png", pngBytes(2, 2), http.StatusOK, ContentPNG},
+		{"misleading name", "photo", "me.pdf", jpegBytes(), http.StatusOK, ContentJPEG},
+		{"other field", "document", "me.png", pngBytes(2, 2), http.StatusBadRequest, ""},
+		{"no file", "", "", nil, http.StatusBadRequest, ""},
+		{"empty", "photo", "me.png", nil, http.StatusBadRequest, ""},
+		{"too large", "photo", "me.png", oversized, http.StatusRequestEntityTooLarge, ""},
+		{"type not accepted", "photo", "me.pdf", pdfBytes, http.StatusUnsupportedMediaType, ""},
+		{"unknown type", "photo", "me.png", []byte("<svg/>"), http.StatusUnsupportedMediaType, ""},
+		{"corrupt image", "photo", "me.png", pngBytes(2, 2)[:40], http.StatusUnprocessableEntity, ""},
+		{"path traversal", "photo", "../../etc/me.png", pngBytes(2, 2), http.StatusBadRequest, ""},
+		{"windows path", "photo", `..\\me.png`, pngBytes(2, 2), http.StatusBadRequest, ""},
+		{"dot dot", "photo", "..", pngBytes(2, 2), http.StatusBadRequest, ""},
+		{"control character", "photo", "me\x01.png", pngBytes(2, 2), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotType string
+			r := gin.New()
+			r.POST("/upload", func(c *gin.Context) {
+				_, contentType, err := readUpload(c, kind)
+				if uploadErr, ok := err.(*UploadError); ok {
+					c.JSON(uploadErr.Status, gin.H{"error": uploadErr.Message})
+					return
+				}
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				gotType = contentType
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, newUploadRequest(tt.field, tt.filename, tt.data))
+			if w.Code != tt.want || gotType != tt.wantType {
+				t.Errorf("status %d, type %q; want %d, %q; body %s", w.Code, gotType, tt.want, tt.wantType, w.Body)
+			}
+		})
+	}
+}
+
+func TestUploadPhoto(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"valid photo", pngBytes(4, 4), http.StatusOK},
+		{"document instead of a photo", pdfBytes, http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com", RoleUser)
+
+			r := gin.New()
+			r.POST("/upload", func(c *gin.Context) { c.Set("user_id", user.ID) }, uploadPhoto)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, newUploadRequest("photo", "me.png", tt.data))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.want, w.Body)
+			}
+
+			db.First(&user, user.ID)
+			if tt.want != http.StatusOK {
+				if user.ProfilePhotoURL != "" {
+					t.Errorf("rejected upload was saved as %q", user.ProfilePhotoURL)
+				}
+				return
+			}
+			if !strings.HasPrefix(user.ProfilePhotoURL, "profiles/") {
+				t.Fatalf("profile photo key = %q", user.ProfilePhotoURL)
+			}
+			if stored, err := blobStore.Get(user.ProfilePhotoURL); err != nil || !bytes.Equal(stored, tt.data) {
+				t.Errorf("stored photo differs from the upload: %v", err)
+			}
+		})
+	}
+}